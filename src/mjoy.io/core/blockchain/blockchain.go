@@ -587,6 +587,12 @@ func (bc *BlockChain) GetReceiptsByHash(hash types.Hash) transaction.Receipts {
 	return GetBlockReceipts(bc.chainDb, hash, GetBlockNumber(bc.chainDb, hash))
 }
 
+// GetTxLookupEntry retrieves the block hash, block number and index within the
+// block of an included transaction, or a zero block hash if it isn't included.
+func (bc *BlockChain) GetTxLookupEntry(hash types.Hash) (types.Hash, uint64, uint64) {
+	return GetTxLookupEntry(bc.chainDb, hash)
+}
+
 // GetBlocksFromHash returns the block corresponding to hash and up to n-1 ancestors.
 func (bc *BlockChain) GetBlocksFromHash(hash types.Hash, n int) (blocks []*block.Block) {
 	number := bc.hc.GetBlockNumber(hash)
@@ -29,6 +29,10 @@ import (
 // TxPreEvent is posted when a transaction enters the transaction pool.
 type TxPreEvent struct{ Tx *transaction.Transaction}
 
+// TxReplaceEvent is posted when a pooled transaction is swapped out for another
+// one of the same sender and nonce.
+type TxReplaceEvent struct{ Old, New *transaction.Transaction }
+
 // PendingLogsEvent is posted pre producing and notifies of pending logs.
 type PendingLogsEvent struct {
 	Logs []*transaction.Log
@@ -99,6 +99,18 @@ func (self *StateDB) Error() error {
 	return self.dbErr
 }
 
+// AccountError returns the error encountered loading the account of addr from
+// the state trie, e.g. if its trie nodes were pruned. Unlike the accessors, which
+// fall back to an empty account, it doesn't record the error in the StateDB. A
+// nonexistent account is not an error.
+func (self *StateDB) AccountError(addr types.Address) error {
+	if obj := self.stateObjects[addr]; obj != nil {
+		return nil
+	}
+	_, err := self.trie.TryGet(addr[:])
+	return err
+}
+
 // Reset clears out all emphemeral state objects from the state db, but keeps
 // the underlying state trie to avoid reloading data for the next operations.
 func (self *StateDB) Reset(root types.Hash) error {
@@ -372,6 +384,56 @@ func (self *StateDB) getStateObject(addr types.Address) (stateObject *stateObjec
 	return obj
 }
 
+// Prefetch loads the given accounts into the live object set, resolving those
+// not cached yet from the trie concurrently on up to the given number of
+// workers. Every worker reads through its own copy of the trie, the decoded
+// objects are inserted on the calling goroutine. Accounts that are missing or
+// fail to load are skipped, later lookups resolve them as usual.
+func (self *StateDB) Prefetch(addrs []types.Address, workers int) {
+	var missing []types.Address
+	for _, addr := range addrs {
+		if _, ok := self.stateObjects[addr]; !ok {
+			missing = append(missing, addr)
+		}
+	}
+	if workers > len(missing) {
+		workers = len(missing)
+	}
+	if workers < 1 {
+		return
+	}
+	encs := make([][]byte, len(missing))
+
+	tasks := make(chan int, len(missing))
+	for i := range missing {
+		tasks <- i
+	}
+	close(tasks)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(tr Trie) {
+			defer wg.Done()
+			for i := range tasks {
+				encs[i], _ = tr.TryGet(missing[i][:])
+			}
+		}(self.db.CopyTrie(self.trie))
+	}
+	wg.Wait()
+
+	for i, addr := range missing {
+		if len(encs[i]) == 0 {
+			continue
+		}
+		var data Account
+		if err := msgp.Decode(bytes.NewBuffer(encs[i]), &data); err != nil {
+			continue
+		}
+		self.setStateObject(newObject(self, addr, data, self.MarkStateObjectDirty))
+	}
+}
+
 func (self *StateDB) setStateObject(object *stateObject) {
 	self.stateObjects[object.Address()] = object
 }
@@ -169,6 +169,49 @@ func TestCopy(t *testing.T) {
 	}
 }
 
+// Tests that prefetching accounts concurrently yields the same values as
+// loading them on demand, without overwriting modified live objects.
+func TestPrefetch(t *testing.T) {
+	db, _ := database.OpenMemDB()
+	orig, _ := New(types.Hash{}, NewDatabase(db))
+
+	var addrs []types.Address
+	for i := byte(1); i < 64; i++ {
+		addr := types.BytesToAddress([]byte{i})
+		orig.AddBalance(addr, big.NewInt(int64(i)))
+		orig.SetNonce(addr, uint64(i))
+		addrs = append(addrs, addr)
+	}
+	root, err := orig.CommitTo(db, true)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	state, _ := New(root, NewDatabase(db))
+	state.SetNonce(addrs[0], 100) // live modification to retain
+
+	missing := types.BytesToAddress([]byte{0xff})
+	state.Prefetch(append(addrs, missing), 4)
+
+	for i, addr := range addrs {
+		if _, ok := state.stateObjects[addr]; !ok {
+			t.Errorf("account %d not prefetched", i)
+		}
+		want := uint64(i + 1)
+		if i == 0 {
+			want = 100
+		}
+		if nonce := state.GetNonce(addr); nonce != want {
+			t.Errorf("account %d: nonce mismatch: have %d, want %d", i, nonce, want)
+		}
+		if balance := state.GetBalance(addr); balance.Int64() != int64(i+1) {
+			t.Errorf("account %d: balance mismatch: have %v, want %d", i, balance, i+1)
+		}
+	}
+	if _, ok := state.stateObjects[missing]; ok {
+		t.Errorf("missing account prefetched")
+	}
+}
+
 func TestSnapshotRandom(t *testing.T) {
 	config := &quick.Config{MaxCount: 1000}
 	err := quick.Check((*snapshotTest).run, config)
@@ -23,6 +23,8 @@ package transaction
 import (
 	"crypto/ecdsa"
 	"errors"
+	"hash"
+	"sync"
 
 	"math/big"
 	"mjoy.io/utils/crypto"
@@ -33,17 +35,52 @@ import (
 	"bytes"
 	"github.com/tinylib/msgp/msgp"
 	"mjoy.io/utils/crypto/sha3"
+	"mjoy.io/common/math"
+	"mjoy.io/common/types/util"
 )
 
 var (
 	ErrInvalidChainId = errors.New("invalid chain id for signer")
+
+	// ErrInvalidSigR and ErrInvalidSigS are returned if a signature component
+	// falls outside of the (0, N) range of the secp256k1 curve order.
+	ErrInvalidSigR = errors.New("signature r value out of range")
+	ErrInvalidSigS = errors.New("signature s value out of range")
+
+	// ErrPubkeyMismatch is returned if a transaction signature doesn't verify
+	// against the public key its sender is claimed to have.
+	ErrPubkeyMismatch = errors.New("signature does not match public key")
+
+	// ErrUnsignedTransaction is returned if a transaction carries no signature
+	// at all, its V, R and S values all being zero, as opposed to a corrupt one.
+	ErrUnsignedTransaction = errors.New("transaction not signed")
+)
+
+// signerCacheLimit is the maximum number of chain ids to cache signers for. The
+// cache is capped as chain ids derived from network transactions are arbitrary.
+const signerCacheLimit = 64
+
+var (
+	signerCache     = make(map[string]MSigner) // Default signers keyed by big endian chain id
+	signerCacheLock sync.RWMutex               // Lock protecting the signer cache
 )
 
+// msignerVersion is the signature scheme version of MSigner, the secp256k1
+// recoverable signatures with the chain id folded into V.
+const msignerVersion byte = 1
+
 // sigCache is used to cache the derived sender and contains
-// the signer used to derive it.
+// the signer used to derive it, along with its scheme version.
 type sigCache struct {
-	signer Signer
-	from   types.Address
+	signer  Signer
+	version byte
+	from    types.Address
+}
+
+// valid reports whether the cached sender was derived by a signer equal to the
+// given one, under the same signature scheme version.
+func (sc sigCache) valid(signer Signer) bool {
+	return sc.version == signer.Version() && sc.signer.Equal(signer)
 }
 
 // MakeSigner returns a Signer based on the given chain config and block number.
@@ -84,9 +121,9 @@ func Sender(signer Signer, tx *Transaction) (types.Address, error) {
 	if sc := tx.from.Load(); sc != nil {
 		sigCache := sc.(sigCache)
 		// If the signer used to derive from in a previous
-		// call is not the same as used current, invalidate
-		// the cache.
-		if sigCache.signer.Equal(signer) {
+		// call is not the same as used current, or its scheme
+		// version changed since, invalidate the cache.
+		if sigCache.valid(signer) {
 			return sigCache.from, nil
 		}
 	}
@@ -95,7 +132,76 @@ func Sender(signer Signer, tx *Transaction) (types.Address, error) {
 	if err != nil {
 		return types.Address{}, err
 	}
-	tx.from.Store(sigCache{signer: signer, from: addr})
+	tx.from.Store(sigCache{signer: signer, version: signer.Version(), from: addr})
+	return addr, nil
+}
+
+// CachedSender returns the sender cached in the transaction by an earlier call
+// with an equal signer, without falling back to deriving it. The boolean is
+// false if no such sender is cached.
+func CachedSender(signer Signer, tx *Transaction) (types.Address, bool) {
+	if sc := tx.from.Load(); sc != nil {
+		if sigCache := sc.(sigCache); sigCache.valid(signer) {
+			return sigCache.from, true
+		}
+	}
+	return types.Address{}, false
+}
+
+// SetSender seeds the sender cache of a transaction with an address previously
+// derived by the given signer, e.g. one stored by the node itself next to the
+// transaction. Later Sender calls with an equal signer skip the ecrecover. The
+// address is trusted as is, so it must never come from an untrusted source.
+func SetSender(signer Signer, tx *Transaction, from types.Address) {
+	tx.from.Store(sigCache{signer: signer, version: signer.Version(), from: from})
+}
+
+// SenderFromPubkey derives the sender of a transaction from the public key it
+// is already known to be signed with, e.g. from a peer handshake or a signed
+// envelope, verifying the signature against the key instead of recovering the
+// key blindly. The key may be compressed or uncompressed. As with Sender, the
+// derived address is cached for later calls with an equal signer.
+func SenderFromPubkey(signer Signer, pub []byte, tx *Transaction) (types.Address, error) {
+	R, S := &tx.Data.R.IntVal, &tx.Data.S.IntVal
+	if ms, ok := signer.(MSigner); ok {
+		// Apply the same chain and recovery id checks as the recovering path
+		if !ms.validV(&tx.Data.V.IntVal) {
+			return types.Address{}, ErrInvalidSig
+		}
+		if tx.ChainId().Cmp(ms.chainId) != 0 {
+			return types.Address{}, ErrInvalidChainId
+		}
+		V := new(big.Int).Sub(&tx.Data.V.IntVal, ms.chainIdMul)
+		V.Sub(V, big8)
+		if V.BitLen() > 8 || !crypto.ValidateSignatureValues(byte(V.Uint64()-27), R, S, true) {
+			return types.Address{}, ErrInvalidSig
+		}
+	} else if !validSigComponent(R) || !validSigComponent(S) {
+		return types.Address{}, ErrInvalidSig
+	}
+	// Expand compressed keys, the address is derived from the uncompressed form
+	if len(pub) == 33 {
+		key, err := crypto.DecompressPubkey(pub)
+		if err != nil {
+			return types.Address{}, err
+		}
+		pub = crypto.FromECDSAPub(key)
+	}
+	if len(pub) != 65 || pub[0] != 4 {
+		return types.Address{}, errors.New("invalid public key")
+	}
+	sig := make([]byte, 64)
+	R.FillBytes(sig[:32])
+	S.FillBytes(sig[32:])
+
+	hash := signer.Hash(tx)
+	if !crypto.VerifySignature(pub, hash[:], sig) {
+		return types.Address{}, ErrPubkeyMismatch
+	}
+	var addr types.Address
+	copy(addr[:], crypto.Keccak256(pub[1:])[12:])
+
+	tx.from.Store(sigCache{signer: signer, version: signer.Version(), from: addr})
 	return addr, nil
 }
 
@@ -111,32 +217,106 @@ type Signer interface {
 	Hash(tx *Transaction) types.Hash
 	// Equal returns true if the given signer is the same as the receiver.
 	Equal(Signer) bool
+	// Version returns the version of the signature scheme, senders cached
+	// under another version are derived again.
+	Version() byte
 }
 
 
 type MSigner struct {
 	chainId, chainIdMul *big.Int
+	hasher              func() hash.Hash // Digest producing the signing hash
+	hasherID            string           // Name of the digest, signers only match with the same one
 }
 
+// defaultHasherID names the Keccak256 digest signers hash with by default.
+const defaultHasherID = "keccak256"
+
+// NewMSigner returns a signer for the given chain id using the default hasher.
+// Signers are cached by chain id, so repeated calls for the same chain reuse one
+// instance instead of allocating it anew.
 func NewMSigner(chainId *big.Int) MSigner {
 	if chainId == nil {
 		chainId = new(big.Int)
 	}
+	// Chain ids that don't fit a 256 bit key are never cached
+	if chainId.Sign() < 0 || chainId.BitLen() > 256 {
+		return NewMSignerWithHasher(chainId, "", nil)
+	}
+	var key [32]byte
+	chainId.FillBytes(key[:])
+
+	signerCacheLock.RLock()
+	signer, ok := signerCache[string(key[:])]
+	signerCacheLock.RUnlock()
+	if ok {
+		return signer
+	}
+	// Copy the chain id, the cached signer must not alias the caller's
+	signer = NewMSignerWithHasher(new(big.Int).Set(chainId), "", nil)
+
+	signerCacheLock.Lock()
+	if len(signerCache) < signerCacheLimit {
+		signerCache[string(key[:])] = signer
+	}
+	signerCacheLock.Unlock()
+
+	return signer
+}
+
+// NewMSignerWithHasher returns a signer producing its signing hashes with the
+// given hasher instead of Keccak256, e.g. for hardware expecting SHA3-256. The
+// hasher must output 32 byte digests, nil selects the default Keccak256. The id
+// names the digest and tells signers apart, so it must be unique per digest and
+// is required for custom hashers.
+func NewMSignerWithHasher(chainId *big.Int, id string, hasher func() hash.Hash) MSigner {
+	if chainId == nil {
+		chainId = new(big.Int)
+	}
+	if hasher == nil {
+		hasher, id = sha3.NewKeccak256, defaultHasherID
+	}
+	if id == "" {
+		panic("custom signer hasher without id")
+	}
 	return MSigner{
 		chainId:    chainId,
 		chainIdMul: new(big.Int).Mul(chainId, big.NewInt(2)),
+		hasher:     hasher,
+		hasherID:   id,
 	}
 }
 
+// Version returns the signature scheme version of the signer.
+func (s MSigner) Version() byte { return msignerVersion }
+
+// Equal reports whether s2 is an MSigner with the exact same configuration, so
+// that senders cached by a differently configured signer get derived again.
 func (s MSigner) Equal(s2 Signer) bool {
 	eip155, ok := s2.(MSigner)
-	return ok && eip155.chainId.Cmp(s.chainId) == 0
+	return ok && eip155.chainId.Cmp(s.chainId) == 0 && eip155.chainIdMul.Cmp(s.chainIdMul) == 0 &&
+		eip155.hasherName() == s.hasherName()
+}
+
+// hasherName returns the id of the signing digest, the zero signer hashes
+// with the default Keccak256.
+func (s MSigner) hasherName() string {
+	if s.hasherID == "" {
+		return defaultHasherID
+	}
+	return s.hasherID
 }
 
 var big8 = big.NewInt(8)
 
 func (s MSigner) Sender(tx *Transaction) (types.Address, error) {
-
+	// Unsigned transactions derive a bogus chain id, catch them early
+	if unsigned(&tx.Data.R.IntVal, &tx.Data.S.IntVal, &tx.Data.V.IntVal) {
+		return types.Address{}, ErrUnsignedTransaction
+	}
+	if !s.validV(&tx.Data.V.IntVal) {
+		return types.Address{}, ErrInvalidSig
+	}
 	if tx.ChainId().Cmp(s.chainId) != 0 {
 		return types.Address{}, ErrInvalidChainId
 	}
@@ -158,6 +338,13 @@ func (s MSigner) SignatureValues(tx *Transaction, sig []byte) (R, S, V *big.Int,
 			R = new(big.Int).SetBytes(sig[:32])
 			S = new(big.Int).SetBytes(sig[32:64])
 			V = new(big.Int).SetBytes([]byte{sig[64] + 27})
+
+			// Reject malformed components now instead of at recovery time
+			if !validSigComponent(R) {
+				err = ErrInvalidSigR
+			} else if !validSigComponent(S) {
+				err = ErrInvalidSigS
+			}
 		}
 
 
@@ -173,6 +360,11 @@ func (s MSigner) SignatureValues(tx *Transaction, sig []byte) (R, S, V *big.Int,
 	return R, S, V, nil
 }
 
+// validSigComponent reports whether a signature value is within (0, N) of the
+// secp256k1 curve order.
+func validSigComponent(v *big.Int) bool {
+	return v.Sign() > 0 && v.Cmp(crypto.S256().Params().N) < 0
+}
 
 // Hash returns the hash to be signed by the sender.
 // It does not uniquely identify the transaction.
@@ -205,15 +397,85 @@ func (s MSigner) Hash(tx *Transaction) types.Hash {
 	}
 	var h types.Hash
 
-	hw:=sha3.NewKeccak256()
+	hasher := s.hasher
+	if hasher == nil {
+		hasher = sha3.NewKeccak256
+	}
+	hw := hasher()
 	hw.Write(buf.Bytes())
-	hw.Sum(h[:0])
+	copy(h[:], hw.Sum(nil))
 	return h
 }
 
 
+// TypedSigner signs a typed, domain separated encoding of the transaction
+// fields in the spirit of EIP-712, so wallets can show users a structured
+// representation of what they are signing. Signature values are laid out the
+// same way as for MSigner, only the signed hash differs.
+type TypedSigner struct {
+	MSigner
+	domain types.Hash
+}
+
+var (
+	// typedDomainType is the type hash of the signing domain separator.
+	typedDomainType = crypto.Keccak256([]byte("MjoyDomain(uint256 chainId)"))
+
+	// typedTransactionType is the type hash of the structured transaction.
+	typedTransactionType = crypto.Keccak256([]byte("Transaction(uint64 nonce,address to,uint256 amount,bytes payload)"))
+)
+
+// NewTypedSigner returns a typed structured data signer for the given chain.
+func NewTypedSigner(chainId *big.Int) TypedSigner {
+	signer := TypedSigner{MSigner: NewMSigner(chainId)}
+	copy(signer.domain[:], crypto.Keccak256(typedDomainType, math.PaddedBigBytes(signer.chainId, 32)))
+	return signer
+}
+
+func (s TypedSigner) Equal(s2 Signer) bool {
+	typed, ok := s2.(TypedSigner)
+	return ok && typed.MSigner.Equal(s.MSigner) && typed.domain == s.domain
+}
+
+func (s TypedSigner) Sender(tx *Transaction) (types.Address, error) {
+	if !s.validV(&tx.Data.V.IntVal) {
+		return types.Address{}, ErrInvalidSig
+	}
+	if tx.ChainId().Cmp(s.chainId) != 0 {
+		return types.Address{}, ErrInvalidChainId
+	}
+	V := new(big.Int).Sub(&tx.Data.V.IntVal, s.chainIdMul)
+	V.Sub(V, big8)
+	return recoverPlain(s.Hash(tx), &tx.Data.R.IntVal, &tx.Data.S.IntVal, V, true)
+}
+
+// Hash returns the typed structured hash to be signed by the sender, that is
+// keccak256(0x19 0x01 || domainSeparator || hashStruct(transaction)).
+func (s TypedSigner) Hash(tx *Transaction) types.Hash {
+	var to types.Address
+	if tx.Data.Recipient != nil {
+		to = *tx.Data.Recipient
+	}
+	amount := new(big.Int)
+	if tx.Data.Amount != nil {
+		amount = math.U256(new(big.Int).Set(&tx.Data.Amount.IntVal))
+	}
+	structHash := crypto.Keccak256(
+		typedTransactionType,
+		math.PaddedBigBytes(new(big.Int).SetUint64(tx.Data.AccountNonce), 32),
+		util.LeftPadBytes(to[:], 32),
+		math.PaddedBigBytes(amount, 32),
+		crypto.Keccak256(tx.Data.Payload),
+	)
+	var h types.Hash
+	copy(h[:], crypto.Keccak256([]byte{0x19, 0x01}, s.domain[:], structHash))
+	return h
+}
 
 func recoverPlain(sighash types.Hash, R, S, Vb *big.Int, homestead bool) (types.Address, error) {
+	if unsigned(R, S, Vb) {
+		return types.Address{}, ErrUnsignedTransaction
+	}
 	if Vb.BitLen() > 8 {
 		return types.Address{}, ErrInvalidSig
 	}
@@ -240,6 +502,28 @@ func recoverPlain(sighash types.Hash, R, S, Vb *big.Int, homestead bool) (types.
 	return addr, nil
 }
 
+// unsigned reports whether all signature values are zero, i.e. the transaction
+// was never signed.
+func unsigned(R, S, V *big.Int) bool {
+	return R.Sign() == 0 && S.Sign() == 0 && V.Sign() == 0
+}
+
+var (
+	big27 = big.NewInt(27)
+	big28 = big.NewInt(28)
+	big35 = big.NewInt(35)
+)
+
+// validV reports whether V is one deriveChainId can make sense of for this
+// signer: at least 35 when signing for a chain, otherwise also 27 or 28. Any
+// other value would underflow into a bogus chain id.
+func (s MSigner) validV(V *big.Int) bool {
+	if V.Cmp(big35) >= 0 {
+		return true
+	}
+	return s.chainId.Sign() == 0 && (V.Cmp(big27) == 0 || V.Cmp(big28) == 0)
+}
+
 // deriveChainId derives the chain id from the given v parameter
 func deriveChainId(v *big.Int) *big.Int {
 	if v.BitLen() <= 64 {
@@ -0,0 +1,345 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: transaction_signing_test.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package transaction
+
+import (
+	"hash"
+	"math/big"
+	"testing"
+
+	"mjoy.io/common/types"
+	"mjoy.io/common/types/util"
+	"mjoy.io/utils/crypto"
+	"mjoy.io/utils/crypto/sha3"
+)
+
+// Tests that transactions signed over the typed structured hash recover their
+// sender, and that the plain msgp signer does not accept them.
+func TestTypedSigner(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+
+	signer := NewTypedSigner(big.NewInt(18))
+	tx, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), []byte{0xca, 0xfe}), signer, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	from, err := Sender(signer, tx)
+	if err != nil {
+		t.Fatalf("failed to derive sender: %v", err)
+	}
+	if from != addr {
+		t.Errorf("sender mismatch: have %x, want %x", from, addr)
+	}
+	if signer.Hash(tx) == NewMSigner(big.NewInt(18)).Hash(tx) {
+		t.Errorf("typed hash matches plain msgp hash")
+	}
+	if plain, err := Sender(NewMSigner(big.NewInt(18)), tx); err == nil && plain == addr {
+		t.Errorf("plain signer accepted typed signature")
+	}
+	if signer.Equal(NewMSigner(big.NewInt(18))) || NewMSigner(big.NewInt(18)).Equal(signer) {
+		t.Errorf("typed and plain signers reported equal")
+	}
+}
+
+// Tests that signatures with components outside of the curve order are
+// rejected when assembling the transaction instead of at recovery.
+func TestSignatureValuesRange(t *testing.T) {
+	signer := NewMSigner(big.NewInt(1))
+	tx := NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil)
+
+	key, _ := crypto.GenerateKey()
+	h := signer.Hash(tx)
+	valid, err := crypto.Sign(h[:], key)
+	if err != nil {
+		t.Fatalf("failed to sign hash: %v", err)
+	}
+	if _, _, _, err := signer.SignatureValues(tx, valid); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	// Zero out the R component
+	sig := make([]byte, 65)
+	copy(sig, valid)
+	for i := 0; i < 32; i++ {
+		sig[i] = 0
+	}
+	if _, err := tx.WithSignature(signer, sig); err != ErrInvalidSigR {
+		t.Errorf("zero r error mismatch: have %v, want %v", err, ErrInvalidSigR)
+	}
+	// Push the S component to the curve order
+	copy(sig, valid)
+	copy(sig[32:64], util.LeftPadBytes(crypto.S256().Params().N.Bytes(), 32))
+	if _, err := tx.WithSignature(signer, sig); err != ErrInvalidSigS {
+		t.Errorf("out of range s error mismatch: have %v, want %v", err, ErrInvalidSigS)
+	}
+}
+
+// Tests that the default signer still hashes with Keccak256 and that a signer
+// with a custom hasher round-trips sender recovery on its own hashes only.
+func TestSignerHasher(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+	tx := NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), []byte{0xca, 0xfe})
+
+	plain := NewMSigner(big.NewInt(1))
+	if plain.Hash(tx) != NewMSignerWithHasher(big.NewInt(1), "keccak256", sha3.NewKeccak256).Hash(tx) {
+		t.Errorf("default signer doesn't hash with keccak256")
+	}
+	if !plain.Equal(NewMSignerWithHasher(big.NewInt(1), "", nil)) {
+		t.Errorf("default signers reported different")
+	}
+	custom := NewMSignerWithHasher(big.NewInt(1), "sha3-256", sha3.New256)
+	if custom.Hash(tx) == plain.Hash(tx) {
+		t.Errorf("custom hasher produced the default hash")
+	}
+	if custom.Equal(plain) || plain.Equal(custom) {
+		t.Errorf("signers with different hashers reported equal")
+	}
+	if !plain.Equal(MSigner{chainId: big.NewInt(1), chainIdMul: big.NewInt(2)}) {
+		t.Errorf("zero hasher signer reported different from default")
+	}
+	if custom.Equal(NewMSignerWithHasher(big.NewInt(1), "sha3-256-v2", sha3.New256)) {
+		t.Errorf("signers with different hasher ids reported equal")
+	}
+	if !custom.Equal(NewMSignerWithHasher(big.NewInt(1), "sha3-256", func() hash.Hash { return sha3.New256() })) {
+		t.Errorf("signers with the same hasher id reported different")
+	}
+	signed, err := SignTx(tx, custom, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	from, err := Sender(custom, signed)
+	if err != nil {
+		t.Fatalf("failed to derive sender: %v", err)
+	}
+	if from != addr {
+		t.Errorf("sender mismatch: have %x, want %x", from, addr)
+	}
+	if from, err := Sender(plain, signed); err == nil && from == addr {
+		t.Errorf("default signer recovered custom hashed signature")
+	}
+}
+
+// Tests that a sender cached by one signer is derived again when queried via a
+// signer on the same chain but with a different configuration.
+func TestSenderCacheSignerConfig(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+
+	plain := NewMSigner(big.NewInt(1))
+	custom := NewMSignerWithHasher(big.NewInt(1), "sha3-256", sha3.New256)
+
+	tx, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil), plain, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	if from, err := Sender(plain, tx); err != nil || from != addr {
+		t.Fatalf("sender mismatch: have %x (%v), want %x", from, err, addr)
+	}
+	if plain.Equal(custom) {
+		t.Fatalf("signers with different hashers reported equal")
+	}
+	// The cached sender must not leak to the differently configured signer
+	if from, err := Sender(custom, tx); err == nil && from == addr {
+		t.Errorf("cached sender returned for differently configured signer")
+	}
+	if from, err := Sender(plain, tx); err != nil || from != addr {
+		t.Errorf("sender mismatch after re-derivation: have %x (%v), want %x", from, err, addr)
+	}
+}
+
+// Tests that the cached sender is only reported once derived, and only to an
+// equal signer.
+func TestCachedSender(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+
+	signer := NewMSigner(big.NewInt(1))
+	tx, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil), signer, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	if _, ok := CachedSender(signer, tx); ok {
+		t.Fatalf("sender reported cached before derivation")
+	}
+	Sender(signer, tx)
+	if from, ok := CachedSender(signer, tx); !ok || from != addr {
+		t.Fatalf("cached sender mismatch: have %x (%v), want %x", from, ok, addr)
+	}
+	if _, ok := CachedSender(NewMSigner(big.NewInt(2)), tx); ok {
+		t.Fatalf("cached sender reported to a signer of another chain")
+	}
+}
+
+// Tests that senders cached under another signature scheme version are derived
+// again instead of being reported, even by an otherwise equal signer.
+func TestSenderCacheVersion(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+
+	signer := NewMSigner(big.NewInt(1))
+	tx, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil), signer, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	// Seed the cache with a bogus sender as if derived by an older scheme
+	tx.from.Store(sigCache{signer: signer, version: signer.Version() - 1, from: types.Address{0xff}})
+	if _, ok := CachedSender(signer, tx); ok {
+		t.Fatalf("sender cached under another version reported")
+	}
+	if from, err := Sender(signer, tx); err != nil || from != addr {
+		t.Fatalf("sender mismatch: have %x (%v), want %x", from, err, addr)
+	}
+	if from, ok := CachedSender(signer, tx); !ok || from != addr {
+		t.Errorf("re-derived sender not cached: have %x (%v), want %x", from, ok, addr)
+	}
+}
+
+// Tests that deriving the sender from a known public key yields the same address
+// as recovering it, and that keys not matching the signature are rejected.
+func TestSenderFromPubkey(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+
+	signer := NewMSigner(big.NewInt(1))
+	sign := func() *Transaction {
+		tx, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		return tx
+	}
+	want, err := Sender(signer, sign())
+	if err != nil {
+		t.Fatalf("failed to recover sender: %v", err)
+	}
+	pubs := map[string][]byte{
+		"uncompressed": crypto.FromECDSAPub(&key.PublicKey),
+		"compressed":   crypto.CompressPubkey(&key.PublicKey),
+	}
+	for name, pub := range pubs {
+		tx := sign()
+		if from, err := SenderFromPubkey(signer, pub, tx); err != nil || from != want {
+			t.Errorf("%s: sender mismatch: have %x (%v), want %x", name, from, err, want)
+		}
+		if from, ok := CachedSender(signer, tx); !ok || from != want {
+			t.Errorf("%s: derived sender not cached: have %x (%v), want %x", name, from, ok, want)
+		}
+	}
+	// Keys of other accounts and signers of other chains must not verify
+	if _, err := SenderFromPubkey(signer, crypto.FromECDSAPub(&other.PublicKey), sign()); err != ErrPubkeyMismatch {
+		t.Errorf("foreign key error mismatch: have %v, want %v", err, ErrPubkeyMismatch)
+	}
+	if _, err := SenderFromPubkey(NewMSigner(big.NewInt(2)), pubs["uncompressed"], sign()); err != ErrInvalidChainId {
+		t.Errorf("foreign chain error mismatch: have %v, want %v", err, ErrInvalidChainId)
+	}
+	if _, err := SenderFromPubkey(signer, []byte{0x04, 0x01}, sign()); err == nil {
+		t.Errorf("malformed public key accepted")
+	}
+}
+
+// Tests that unsigned transactions are told apart from ones with a corrupt
+// signature.
+func TestSenderUnsigned(t *testing.T) {
+	signer := NewMSigner(big.NewInt(1))
+
+	unsigned := NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil)
+	if _, err := Sender(signer, unsigned); err != ErrUnsignedTransaction {
+		t.Errorf("unsigned error mismatch: have %v, want %v", err, ErrUnsignedTransaction)
+	}
+	key, _ := crypto.GenerateKey()
+	corrupt, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil), signer, key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	corrupt.Data.S.IntVal.Set(crypto.S256().Params().N)
+	if _, err := Sender(signer, corrupt); err != ErrInvalidSig {
+		t.Errorf("corrupt signature error mismatch: have %v, want %v", err, ErrInvalidSig)
+	}
+}
+
+// Tests that signatures with a V too small to encode a chain id are rejected
+// as invalid instead of deriving a garbage chain id from it.
+func TestSenderDegenerateV(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+
+	signers := map[string]Signer{
+		"plain": NewMSigner(big.NewInt(1)),
+		"typed": NewTypedSigner(big.NewInt(1)),
+	}
+	for name, signer := range signers {
+		for _, v := range []int64{0, 1, 26, 27, 28, 29, 34} {
+			tx, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil), signer, key)
+			if err != nil {
+				t.Fatalf("%s: failed to sign transaction: %v", name, err)
+			}
+			tx.Data.V.IntVal.SetInt64(v)
+			if _, err := Sender(signer, tx); err != ErrInvalidSig {
+				t.Errorf("%s: v %d: error mismatch: have %v, want %v", name, v, err, ErrInvalidSig)
+			}
+		}
+	}
+	tx, err := SignTx(NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), nil), signers["plain"], key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	tx.Data.V.IntVal.SetInt64(30)
+	if _, err := SenderFromPubkey(signers["plain"], crypto.FromECDSAPub(&key.PublicKey), tx); err != ErrInvalidSig {
+		t.Errorf("pubkey: error mismatch: have %v, want %v", err, ErrInvalidSig)
+	}
+}
+
+// Tests that signers are reused across calls for the same chain id, without
+// aliasing the chain id passed in by the caller.
+func TestSignerCache(t *testing.T) {
+	chainId := big.NewInt(7)
+
+	first, second := NewMSigner(chainId), NewMSigner(big.NewInt(7))
+	if first.chainId != second.chainId || first.chainIdMul != second.chainIdMul {
+		t.Fatalf("signer not reused for the same chain id")
+	}
+	if !first.Equal(second) {
+		t.Fatalf("cached signer not equal to itself")
+	}
+	chainId.SetInt64(8)
+	if first.chainId.Int64() != 7 || NewMSigner(big.NewInt(7)).chainId.Int64() != 7 {
+		t.Fatalf("cached signer aliases the caller's chain id")
+	}
+	if other := NewMSigner(big.NewInt(8)); other.Equal(first) {
+		t.Fatalf("signers of different chains reported equal")
+	}
+}
+
+// Benchmarks constructing signers for the same chain id in a loop, fresh every
+// time versus reusing the cached instance.
+func BenchmarkSignerUncached(b *testing.B) {
+	chainId := big.NewInt(1)
+	for i := 0; i < b.N; i++ {
+		NewMSignerWithHasher(chainId, "", nil)
+	}
+}
+
+func BenchmarkSignerCached(b *testing.B) {
+	chainId := big.NewInt(1)
+	for i := 0; i < b.N; i++ {
+		NewMSigner(chainId)
+	}
+}
@@ -0,0 +1,117 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_audit.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"mjoy.io/common/types"
+	"mjoy.io/core/transaction"
+)
+
+// Reasons recorded in the audit log for transactions leaving the pool.
+const (
+	dropMined      = "mined"      // Nonce already used on chain
+	dropNoFunds    = "nofunds"    // Account can't pay for the transaction anymore
+	dropRateLimit  = "ratelimit"  // Account or pool limits exceeded
+	dropEvicted    = "evicted"    // Removed to make room or expired
+	dropSuperseded = "superseded" // Another transaction won the same nonce
+	dropCancelled  = "cancelled"  // Swapped out by its sender via Cancel
+	dropNoState    = "nostate"    // Account state couldn't be loaded
+	dropGap        = "gap"        // Stuck behind a nonce gap nothing queued can fill
+	dropDrained    = "drained"    // Handed out for inclusion via Drain
+)
+
+// auditRecord is a single line of the transaction audit log.
+type auditRecord struct {
+	Time  int64         `json:"time"`  // Unix nanoseconds of the event
+	Event string        `json:"event"` // accepted, rejected:<err> or dropped:<reason>
+	Hash  types.Hash    `json:"hash"`
+	From  types.Address `json:"from"`
+	Nonce uint64        `json:"nonce"`
+	Tag   string        `json:"tag,omitempty"` // Label attached via AddLocalTagged, if any
+}
+
+// txAudit is an append-only log of the lifecycle events of every transaction
+// passing through the pool, one JSON record per line. Unlike the journal it is
+// never read back by the pool, it exists for operators only.
+type txAudit struct {
+	signer transaction.Signer // Signer to derive the senders of audited transactions
+	writer io.WriteCloser     // Output stream to append audit records to
+	enc    *json.Encoder      // Encoder writing the records into the output stream
+}
+
+// newTxAudit opens, or creates, the audit log at path for appending.
+func newTxAudit(path string, signer transaction.Signer) (*txAudit, error) {
+	output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &txAudit{
+		signer: signer,
+		writer: output,
+		enc:    json.NewEncoder(output),
+	}, nil
+}
+
+// record appends a lifecycle event of the given transaction to the audit log,
+// along with the transaction's tag if it has one. It is a no-op on a nil audit
+// log, so callers needn't check whether auditing is enabled.
+func (audit *txAudit) record(tx *transaction.Transaction, event string, tag string) {
+	if audit == nil {
+		return
+	}
+	from, _ := transaction.Sender(audit.signer, tx) // zero if the signature is invalid
+	record := &auditRecord{
+		Time:  time.Now().UnixNano(),
+		Event: event,
+		Hash:  tx.Hash(),
+		From:  from,
+		Nonce: tx.Nonce(),
+		Tag:   tag,
+	}
+	if err := audit.enc.Encode(record); err != nil {
+		logger.Warn("Failed to write transaction audit record", "err", err)
+	}
+}
+
+// accepted records a transaction entering the pool.
+func (audit *txAudit) accepted(tx *transaction.Transaction, tag string) {
+	audit.record(tx, "accepted", tag)
+}
+
+// rejected records a transaction refused by the pool.
+func (audit *txAudit) rejected(tx *transaction.Transaction, err error, tag string) {
+	audit.record(tx, "rejected:"+err.Error(), tag)
+}
+
+// dropped records a transaction removed from the pool.
+func (audit *txAudit) dropped(tx *transaction.Transaction, reason string, tag string) {
+	audit.record(tx, "dropped:"+reason, tag)
+}
+
+// close closes the audit log file.
+func (audit *txAudit) close() error {
+	return audit.writer.Close()
+}
@@ -0,0 +1,111 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_iterator.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"container/heap"
+
+	"mjoy.io/common/types"
+	"mjoy.io/core/transaction"
+)
+
+// TxIterator steps through a sequence of pool transactions one at a time.
+type TxIterator interface {
+	// Next moves the iterator to the next transaction, returning false once the
+	// sequence is exhausted or the iterator was released.
+	Next() bool
+
+	// Tx returns the transaction the iterator currently points to.
+	Tx() *transaction.Transaction
+
+	// Release gives back the resources held by the iterator. It must be called
+	// once the caller is done iterating, and may be called more than once.
+	Release()
+}
+
+// accountIterator is a TxIterator over the transactions of a single account,
+// walking the gapless pending list first and the queue afterwards.
+type accountIterator struct {
+	pool    *TxPool
+	pending *txList   // Pending transactions of the account, nil once exhausted
+	next    uint64    // Nonce of the next pending transaction to return
+	queued  *txList   // Queued transactions of the account, nil if none
+	nonces  nonceHeap // Queued nonces not yet returned, popped lazily
+
+	tx       *transaction.Transaction // Transaction the iterator currently points to
+	released bool                     // Whether the pool lock was already given back
+}
+
+// AccountIterator returns an iterator over all the transactions of an account
+// in nonce order, pending ones first followed by the queued ones. Unlike the
+// Content methods it doesn't flatten the account's lists upfront, making it
+// suitable for stepping through huge accounts.
+//
+// The iterator holds the pool's read lock until it is released, blocking every
+// pool modification in the meantime, so it must be released promptly and the
+// pool must not be called into for writing while iterating.
+func (pool *TxPool) AccountIterator(addr types.Address) TxIterator {
+	pool.mu.RLock()
+
+	it := &accountIterator{pool: pool}
+	if list := pool.pending[addr]; list != nil && !list.Empty() {
+		it.pending, it.next = list, (*list.txs.index)[0]
+	}
+	if list := pool.queue[addr]; list != nil && !list.Empty() {
+		// Only the nonces are copied, the heap is sorted lazily while popping
+		it.queued = list
+		it.nonces = append(nonceHeap(nil), *list.txs.index...)
+	}
+	return it
+}
+
+// Next implements TxIterator, moving to the next transaction of the account.
+func (it *accountIterator) Next() bool {
+	if it.released {
+		return false
+	}
+	if it.pending != nil {
+		if tx := it.pending.txs.Get(it.next); tx != nil {
+			it.tx, it.next = tx, it.next+1
+			return true
+		}
+		it.pending = nil
+	}
+	if it.nonces.Len() > 0 {
+		it.tx = it.queued.txs.Get(heap.Pop(&it.nonces).(uint64))
+		return true
+	}
+	it.tx = nil
+	return false
+}
+
+// Tx implements TxIterator, returning the current transaction.
+func (it *accountIterator) Tx() *transaction.Transaction {
+	return it.tx
+}
+
+// Release implements TxIterator, giving back the pool's read lock.
+func (it *accountIterator) Release() {
+	if !it.released {
+		it.released, it.tx = true, nil
+		it.pool.mu.RUnlock()
+	}
+}
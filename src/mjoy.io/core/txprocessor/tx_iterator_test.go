@@ -0,0 +1,82 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_iterator_test.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"math/big"
+	"testing"
+
+	"mjoy.io/common/types"
+	"mjoy.io/utils/crypto"
+)
+
+// Tests that the account iterator walks the pending and then the queued
+// transactions of an account in nonce order, and that it releases the pool.
+func TestAccountIterator(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	// Add pending nonces 0..2 and gapped queued ones, out of order
+	for _, nonce := range []uint64{9, 2, 0, 7, 1, 5, 12} {
+		if err := pool.AddRemote(newxtransaction(nonce, 100, key)); err != nil {
+			t.Fatalf("nonce %d: failed to add transaction: %v", nonce, err)
+		}
+	}
+	if pending, queued := pool.Stats(); pending != 3 || queued != 4 {
+		t.Fatalf("pool size mismatch: have %d/%d, want 3/4", pending, queued)
+	}
+	it := pool.AccountIterator(from)
+
+	var nonces []uint64
+	for it.Next() {
+		nonces = append(nonces, it.Tx().Nonce())
+	}
+	it.Release()
+	it.Release() // releasing twice must not unlock the pool again
+
+	want := []uint64{0, 1, 2, 5, 7, 9, 12}
+	if len(nonces) != len(want) {
+		t.Fatalf("iterated nonces mismatch: have %v, want %v", nonces, want)
+	}
+	for i := range want {
+		if nonces[i] != want[i] {
+			t.Fatalf("iterated nonces mismatch: have %v, want %v", nonces, want)
+		}
+	}
+	if it.Next() {
+		t.Fatalf("released iterator still advancing")
+	}
+	// The pool must be writable again, and unknown accounts yield nothing
+	if err := pool.AddRemote(newxtransaction(3, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction after release: %v", err)
+	}
+	empty := pool.AccountIterator(types.Address{})
+	defer empty.Release()
+
+	if empty.Next() {
+		t.Fatalf("iterator of unknown account returned %v", empty.Tx())
+	}
+}
@@ -21,18 +21,41 @@
 package txprocessor
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sort"
+	"syscall"
+	"time"
 	"mjoy.io/common/types"
 	"github.com/tinylib/msgp/msgp"
 	"mjoy.io/core/transaction"
 )
 
+//go:generate msgp -unexported
+//msgp:ignore devNull txJournal journalError
+
 // errNoActiveJournal is returned if a transaction is attempted to be inserted
 // into the journal, but no such file is currently open.
 var errNoActiveJournal = errors.New("no active journal")
 
+// journalError is returned if a journal record fails to decode, locating the
+// corrupt record to allow diagnosing and repairing the journal by hand.
+type journalError struct {
+	index  int   // Index of the failing record in the journal
+	offset int64 // Byte offset of the failing record in the journal file
+	err    error // Underlying decoding error
+}
+
+func (e *journalError) Error() string {
+	return fmt.Sprintf("journal record %d at offset %d: %v", e.index, e.offset, e.err)
+}
+
+func (e *journalError) Unwrap() error { return e.err }
+
 // devNull is a WriteCloser that just discards anything written into it. Its
 // goal is to allow the transaction journal to write into a fake journal when
 // loading transactions on startup without printing warnings due to no file
@@ -42,23 +65,94 @@ type devNull struct{}
 func (*devNull) Write(p []byte) (n int, err error) { return len(p), nil }
 func (*devNull) Close() error                      { return nil }
 
+// journalEntry is the envelope each local transaction is journaled in, carrying
+// the pool metadata that should survive a node restart next to it.
+type journalEntry struct {
+	Tx   *transaction.Transaction
+	Time int64         // Unix nanoseconds the transaction was first seen by the pool
+	From types.Address // Sender derived when the transaction was pooled, zero if not recorded
+	Beat int64         // Unix nanoseconds of the sender's last heartbeat, zero if not recorded
+	Seq  uint64        // Local submission order across all accounts, zero if not recorded
+}
+
+// newJournalEntry wraps a transaction and its sender into a journal envelope,
+// along with the time the pool first saw the transaction and the sender's last
+// heartbeat.
+func newJournalEntry(tx *transaction.Transaction, from types.Address, seen, beat time.Time) *journalEntry {
+	entry := &journalEntry{Tx: tx, From: from}
+	if !seen.IsZero() {
+		entry.Time = seen.UnixNano()
+	}
+	if !beat.IsZero() {
+		entry.Beat = beat.UnixNano()
+	}
+	return entry
+}
+
+// seen returns the time the journaled transaction was first seen, or the zero
+// time if it was not recorded.
+func (entry *journalEntry) seen() time.Time {
+	if entry.Time == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, entry.Time)
+}
+
+// beat returns the last heartbeat of the journaled transaction's sender, or the
+// zero time if it was not recorded.
+func (entry *journalEntry) beat() time.Time {
+	if entry.Beat == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, entry.Beat)
+}
+
+// decodeJournalEntry parses a single journal record. Records written before the
+// envelope was introduced hold a bare transaction, these are still accepted.
+func decodeJournalEntry(raw msgp.Raw) (*journalEntry, error) {
+	entry := new(journalEntry)
+	if _, err := entry.UnmarshalMsg(raw); err == nil && entry.Tx != nil {
+		return entry, nil
+	}
+	tx := new(transaction.Transaction)
+	if _, err := tx.UnmarshalMsg(raw); err != nil {
+		return nil, err
+	}
+	return &journalEntry{Tx: tx}, nil
+}
+
 // txJournal is a rotating log of transactions with the aim of storing locally
 // created transactions to allow non-executed ones to survive node restarts.
 type txJournal struct {
 	path   string         // Filesystem path to store the transactions at
 	writer io.WriteCloser // Output stream to write new transactions into
+
+	buffered bool          // Whether inserts are coalesced until the next flush
+	buffer   *bufio.Writer // Write buffer on top of the output stream in buffered mode
+
+	rename func(oldpath, newpath string) error // Moves the regenerated journal in place, swappable by tests
+
+	sequenced bool                  // Whether entries carry their local submission order
+	seqs      map[types.Hash]uint64 // Submission order of the journaled transactions in sequenced mode
+	next      uint64                // Last submission order handed out in sequenced mode
 }
 
-// newTxJournal creates a new transaction journal to
-func newTxJournal(path string) *txJournal {
+// newTxJournal creates a new transaction journal to store transactions at path.
+// In buffered mode inserts only hit the disk when the journal is flushed.
+func newTxJournal(path string, buffered bool) *txJournal {
 	return &txJournal{
-		path: path,
+		path:     path,
+		buffered: buffered,
+		rename:   os.Rename,
 	}
 }
 
 // load parses a transaction journal dump from disk, loading its contents into
-// the specified pool.
-func (journal *txJournal) load(add func(*transaction.Transaction) error) error {
+// the specified pool. The recorded sender is passed along, or the zero address
+// for entries journaled without one, as are the recorded first seen and sender
+// heartbeat times, zero if missing. Entries carrying a submission order are
+// added in that order, the others in file order ahead of them.
+func (journal *txJournal) load(add func(tx *transaction.Transaction, from types.Address, seen, beat time.Time) error) error {
 	// Skip the parsing if the journal file doens't exist at all
 	if _, err := os.Stat(journal.path); os.IsNotExist(err) {
 		return nil
@@ -74,27 +168,39 @@ func (journal *txJournal) load(add func(*transaction.Transaction) error) error {
 	journal.writer = new(devNull)
 	defer func() { journal.writer = nil }()
 
-	// Inject all transactions from the journal into the pool
-
-
-	total, dropped := 0, 0
-
-	var failure error
+	// Parse all transactions from the journal, up to the first corrupt record
+	var (
+		entries []*journalEntry
+		failure error
+		offset  int64
+	)
+	stream := msgp.NewReader(input)
 	for {
 		// Parse the next transaction and terminate on error
-		tx := new(transaction.Transaction)
-
-		if err = msgp.Decode(input,tx); err != nil {
+		var raw msgp.Raw
+		if err = raw.DecodeMsg(stream); err != nil {
 			if err != io.EOF {
-				failure = err
+				failure = &journalError{index: len(entries), offset: offset, err: err}
 			}
 			break
 		}
+		entry, err := decodeJournalEntry(raw)
+		if err != nil {
+			failure = &journalError{index: len(entries), offset: offset, err: err}
+			break
+		}
+		offset += int64(len(raw))
+		entries = append(entries, entry)
+	}
+	// Restore the local submission order, map iteration having lost it on rotation
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
 
+	// Inject all transactions from the journal into the pool
+	total, dropped := 0, 0
+	for _, entry := range entries {
 		// Import the transaction and bump the appropriate progress counters
 		total++
-		tx.PrintDataInfo()
-		if err = add(tx); err != nil {
+		if err = add(entry.Tx, entry.From, entry.seen(), entry.beat()); err != nil {
 			logger.Debug("Failed to add journaled transaction", "err", err)
 			dropped++
 			continue
@@ -105,49 +211,93 @@ func (journal *txJournal) load(add func(*transaction.Transaction) error) error {
 	return failure
 }
 
-// insert adds the specified transaction to the local disk journal.
-func (journal *txJournal) insert(tx *transaction.Transaction) error {
+// insert adds the specified transaction to the local disk journal, along with
+// its sender, the time it was first seen by the pool and the sender's heartbeat.
+func (journal *txJournal) insert(tx *transaction.Transaction, from types.Address, seen, beat time.Time) error {
 	if journal.writer == nil {
 		return errNoActiveJournal
 	}
 
-	if err := msgp.Encode(journal.writer,tx); err != nil {
+	var output io.Writer = journal.writer
+	if journal.buffer != nil {
+		output = journal.buffer
+	}
+	entry := newJournalEntry(tx, from, seen, beat)
+	if journal.sequenced {
+		entry.Seq = journal.order(tx.Hash())
+	}
+	if err := msgp.Encode(output, entry); err != nil {
 		return err
 	}
 	return nil
 }
 
+// order returns the submission order of a journaled transaction in sequenced
+// mode, handing out the next one if the transaction wasn't journaled yet.
+func (journal *txJournal) order(hash types.Hash) uint64 {
+	if seq, ok := journal.seqs[hash]; ok {
+		return seq
+	}
+	if journal.seqs == nil {
+		journal.seqs = make(map[types.Hash]uint64)
+	}
+	journal.next++
+	journal.seqs[hash] = journal.next
+	return journal.next
+}
+
+// flush writes any buffered transactions out to the disk journal.
+func (journal *txJournal) flush() error {
+	if journal.buffer == nil {
+		return nil
+	}
+	return journal.buffer.Flush()
+}
+
 // rotate regenerates the transaction journal based on the current contents of
-// the transaction pool.
-func (journal *txJournal) rotate(all map[types.Address]transaction.Transactions) error {
-	// Close the current journal (if any is open)
-	if journal.writer != nil {
-		if err := journal.writer.Close(); err != nil {
-			return err
-		}
-		journal.writer = nil
+// the transaction pool. The arrival times of the transactions are looked up in
+// seen, the heartbeats of their senders in beats. In sequenced mode entries are
+// written in submission order and renumbered, transactions never journaled
+// before following in order of arrival.
+func (journal *txJournal) rotate(all map[types.Address]transaction.Transactions, seen map[types.Hash]time.Time, beats map[types.Address]time.Time) error {
+	// Close the current journal (if any is open). Its contents are regenerated
+	// below anyway, so failing to flush it, e.g. on a full disk, isn't fatal
+	if err := journal.close(); err != nil {
+		logger.Warn("Failed to close stale transaction journal", "err", err)
 	}
 	// Generate a new journal with the contents of the current pool
 	replacement, err := os.OpenFile(journal.path+".new", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
 	}
-	journaled := 0
-	for _, txs := range all {
-		for _, tx := range txs {
-
+	// Gather every transaction once, even if the pool somehow tracks it twice
+	var entries []*journalEntry
 
-			if err = msgp.Encode(replacement,tx); err != nil {
-				replacement.Close()
-				return err
+	written := make(map[types.Hash]struct{})
+	for from, txs := range all {
+		for _, tx := range txs {
+			hash := tx.Hash()
+			if _, ok := written[hash]; ok {
+				continue
 			}
+			entries = append(entries, newJournalEntry(tx, from, seen[hash], beats[from]))
+			written[hash] = struct{}{}
 		}
-		journaled += len(txs)
 	}
+	if journal.sequenced {
+		journal.sequence(entries)
+	}
+	for _, entry := range entries {
+		if err = msgp.Encode(replacement, entry); err != nil {
+			replacement.Close()
+			return err
+		}
+	}
+	journaled := len(written)
 	replacement.Close()
 
 	// Replace the live journal with the newly generated one
-	if err = os.Rename(journal.path+".new", journal.path); err != nil {
+	if err = journal.replace(journal.path+".new", journal.path); err != nil {
 		return err
 	}
 	sink, err := os.OpenFile(journal.path, os.O_WRONLY|os.O_APPEND, 0755)
@@ -155,18 +305,94 @@ func (journal *txJournal) rotate(all map[types.Address]transaction.Transactions)
 		return err
 	}
 	journal.writer = sink
+	if journal.buffered {
+		journal.buffer = bufio.NewWriter(sink)
+	}
 	logger.Info("Regenerated local transaction journal", "transactions", journaled, "accounts", len(all))
 
 	return nil
 }
 
+// sequence sorts the entries of a regenerated journal into submission order and
+// renumbers them, forgetting the order of transactions no longer journaled.
+func (journal *txJournal) sequence(entries []*journalEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		si, iok := journal.seqs[entries[i].Tx.Hash()]
+		sj, jok := journal.seqs[entries[j].Tx.Hash()]
+		switch {
+		case iok && jok:
+			return si < sj
+		case iok != jok:
+			return iok
+		case entries[i].Time != entries[j].Time:
+			return entries[i].Time < entries[j].Time
+		case entries[i].From != entries[j].From:
+			return bytes.Compare(entries[i].From[:], entries[j].From[:]) < 0
+		}
+		return entries[i].Tx.Nonce() < entries[j].Tx.Nonce()
+	})
+	journal.seqs = make(map[types.Hash]uint64, len(entries))
+	for i, entry := range entries {
+		entry.Seq = uint64(i + 1)
+		journal.seqs[entry.Tx.Hash()] = entry.Seq
+	}
+	journal.next = uint64(len(entries))
+}
+
+// replace moves the regenerated journal at src over the live one at dst. If the
+// two can't be renamed into each other because they are on different devices,
+// e.g. the journal directory being a symlink onto another mount, the contents
+// are copied over and synced instead.
+func (journal *txJournal) replace(src, dst string) error {
+	err := journal.rename(src, dst)
+	if err == nil {
+		logger.Debug("Replaced transaction journal by rename", "path", dst)
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	if err := os.Remove(src); err != nil {
+		logger.Warn("Failed to remove regenerated transaction journal", "path", src, "err", err)
+	}
+	logger.Info("Replaced transaction journal by copy across devices", "path", dst)
+	return nil
+}
+
+// copyFile overwrites dst with the contents of src, syncing them to disk.
+func copyFile(src, dst string) error {
+	input, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(output, input); err == nil {
+		err = output.Sync()
+	}
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 // close flushes the transaction journal contents to disk and closes the file.
 func (journal *txJournal) close() error {
 	var err error
 
 	if journal.writer != nil {
-		err = journal.writer.Close()
-		journal.writer = nil
+		err = journal.flush()
+		if cerr := journal.writer.Close(); err == nil {
+			err = cerr
+		}
+		journal.writer, journal.buffer = nil, nil
 	}
 	return err
 }
@@ -0,0 +1,237 @@
+package txprocessor
+
+// NOTE: THIS FILE WAS PRODUCED BY THE
+// MSGP CODE GENERATION TOOL (github.com/tinylib/msgp)
+// DO NOT EDIT
+
+import (
+	"github.com/tinylib/msgp/msgp"
+	"mjoy.io/core/transaction"
+)
+
+// DecodeMsg implements msgp.Decodable
+func (z *journalEntry) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Tx":
+			if dc.IsNil() {
+				err = dc.ReadNil()
+				if err != nil {
+					return
+				}
+				z.Tx = nil
+			} else {
+				if z.Tx == nil {
+					z.Tx = new(transaction.Transaction)
+				}
+				err = z.Tx.DecodeMsg(dc)
+				if err != nil {
+					return
+				}
+			}
+		case "Time":
+			z.Time, err = dc.ReadInt64()
+			if err != nil {
+				return
+			}
+		case "From":
+			err = z.From.DecodeMsg(dc)
+			if err != nil {
+				return
+			}
+		case "Beat":
+			z.Beat, err = dc.ReadInt64()
+			if err != nil {
+				return
+			}
+		case "Seq":
+			z.Seq, err = dc.ReadUint64()
+			if err != nil {
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *journalEntry) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 5
+	// write "Tx"
+	err = en.Append(0x85, 0xa2, 0x54, 0x78)
+	if err != nil {
+		return
+	}
+	if z.Tx == nil {
+		err = en.WriteNil()
+		if err != nil {
+			return
+		}
+	} else {
+		err = z.Tx.EncodeMsg(en)
+		if err != nil {
+			return
+		}
+	}
+	// write "Time"
+	err = en.Append(0xa4, 0x54, 0x69, 0x6d, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Time)
+	if err != nil {
+		return
+	}
+	// write "From"
+	err = en.Append(0xa4, 0x46, 0x72, 0x6f, 0x6d)
+	if err != nil {
+		return
+	}
+	err = z.From.EncodeMsg(en)
+	if err != nil {
+		return
+	}
+	// write "Beat"
+	err = en.Append(0xa4, 0x42, 0x65, 0x61, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Beat)
+	if err != nil {
+		return
+	}
+	// write "Seq"
+	err = en.Append(0xa3, 0x53, 0x65, 0x71)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint64(z.Seq)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *journalEntry) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 5
+	// string "Tx"
+	o = append(o, 0x85, 0xa2, 0x54, 0x78)
+	if z.Tx == nil {
+		o = msgp.AppendNil(o)
+	} else {
+		o, err = z.Tx.MarshalMsg(o)
+		if err != nil {
+			return
+		}
+	}
+	// string "Time"
+	o = append(o, 0xa4, 0x54, 0x69, 0x6d, 0x65)
+	o = msgp.AppendInt64(o, z.Time)
+	// string "From"
+	o = append(o, 0xa4, 0x46, 0x72, 0x6f, 0x6d)
+	o, err = z.From.MarshalMsg(o)
+	if err != nil {
+		return
+	}
+	// string "Beat"
+	o = append(o, 0xa4, 0x42, 0x65, 0x61, 0x74)
+	o = msgp.AppendInt64(o, z.Beat)
+	// string "Seq"
+	o = append(o, 0xa3, 0x53, 0x65, 0x71)
+	o = msgp.AppendUint64(o, z.Seq)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *journalEntry) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Tx":
+			if msgp.IsNil(bts) {
+				bts, err = msgp.ReadNilBytes(bts)
+				if err != nil {
+					return
+				}
+				z.Tx = nil
+			} else {
+				if z.Tx == nil {
+					z.Tx = new(transaction.Transaction)
+				}
+				bts, err = z.Tx.UnmarshalMsg(bts)
+				if err != nil {
+					return
+				}
+			}
+		case "Time":
+			z.Time, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				return
+			}
+		case "From":
+			bts, err = z.From.UnmarshalMsg(bts)
+			if err != nil {
+				return
+			}
+		case "Beat":
+			z.Beat, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				return
+			}
+		case "Seq":
+			z.Seq, bts, err = msgp.ReadUint64Bytes(bts)
+			if err != nil {
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *journalEntry) Msgsize() (s int) {
+	s = 1 + 3
+	if z.Tx == nil {
+		s += msgp.NilSize
+	} else {
+		s += z.Tx.Msgsize()
+	}
+	s += 5 + msgp.Int64Size + 5 + z.From.Msgsize() + 5 + msgp.Int64Size + 4 + msgp.Uint64Size
+	return
+}
@@ -0,0 +1,408 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_journal_test.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+	"mjoy.io/common/types"
+	"mjoy.io/core/transaction"
+	"mjoy.io/utils/crypto"
+)
+
+// Tests that the first-seen times of journaled transactions survive a rotate
+// and reload cycle.
+func TestJournalEntryRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key), newxtransaction(2, 100, key)}
+	seen := make(map[types.Hash]time.Time)
+	for i, tx := range txs {
+		seen[tx.Hash()] = time.Now().Add(-time.Duration(i+1) * time.Hour)
+	}
+	journal := newTxJournal(filepath.Join(dir, "transactions.msgp"), false)
+	if err := journal.rotate(map[types.Address]transaction.Transactions{from: txs}, seen, nil); err != nil {
+		t.Fatalf("failed to rotate journal: %v", err)
+	}
+	journal.close()
+
+	loaded := make(map[types.Hash]time.Time)
+	if err := journal.load(func(tx *transaction.Transaction, sender types.Address, at, _ time.Time) error {
+		if sender != from {
+			t.Errorf("transaction %x: sender mismatch: have %x, want %x", tx.Hash(), sender, from)
+		}
+		loaded[tx.Hash()] = at
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if len(loaded) != len(txs) {
+		t.Fatalf("loaded transaction count mismatch: have %d, want %d", len(loaded), len(txs))
+	}
+	for hash, want := range seen {
+		if have, ok := loaded[hash]; !ok || !have.Equal(want) {
+			t.Errorf("transaction %x: first seen mismatch: have %v, want %v", hash, have, want)
+		}
+	}
+}
+
+// Tests that journals written as bare transactions, before entries carried any
+// metadata, can still be loaded.
+func TestJournalLegacyFormat(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := crypto.GenerateKey()
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key)}
+
+	path := filepath.Join(dir, "transactions.msgp")
+	output, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create journal: %v", err)
+	}
+	for _, tx := range txs {
+		if err := msgp.Encode(output, tx); err != nil {
+			t.Fatalf("failed to write legacy entry: %v", err)
+		}
+	}
+	output.Close()
+
+	var loaded transaction.Transactions
+	if err := newTxJournal(path, false).load(func(tx *transaction.Transaction, from types.Address, at, _ time.Time) error {
+		if !at.IsZero() {
+			t.Errorf("legacy entry reported first seen time %v", at)
+		}
+		if from != (types.Address{}) {
+			t.Errorf("legacy entry reported sender %x", from)
+		}
+		loaded = append(loaded, tx)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to load legacy journal: %v", err)
+	}
+	if len(loaded) != len(txs) {
+		t.Fatalf("loaded transaction count mismatch: have %d, want %d", len(loaded), len(txs))
+	}
+	for i, tx := range loaded {
+		if tx.Hash() != txs[i].Hash() {
+			t.Errorf("transaction %d: hash mismatch: have %x, want %x", i, tx.Hash(), txs[i].Hash())
+		}
+	}
+}
+
+// Tests that rotating a journal with the same transaction tracked several times
+// writes it out only once.
+func TestJournalRotateDedup(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	dup, other := newxtransaction(0, 100, key), newxtransaction(1, 100, key)
+	all := map[types.Address]transaction.Transactions{
+		from:            {dup, other, dup},
+		types.Address{}: {dup},
+	}
+	journal := newTxJournal(filepath.Join(dir, "transactions.msgp"), false)
+	if err := journal.rotate(all, nil, nil); err != nil {
+		t.Fatalf("failed to rotate journal: %v", err)
+	}
+	journal.close()
+
+	loaded := make(map[types.Hash]int)
+	if err := journal.load(func(tx *transaction.Transaction, from types.Address, at, _ time.Time) error {
+		loaded[tx.Hash()]++
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("journaled transaction count mismatch: have %d, want %d", len(loaded), 2)
+	}
+	for hash, count := range loaded {
+		if count != 1 {
+			t.Errorf("transaction %x: journaled %d times, want once", hash, count)
+		}
+	}
+}
+
+// Tests that a corrupt journal record is reported along with its index and byte
+// offset, after the records preceding it were loaded.
+func TestJournalDecodeError(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := crypto.GenerateKey()
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key)}
+
+	path := filepath.Join(dir, "transactions.msgp")
+	output, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create journal: %v", err)
+	}
+	var offset int64
+	for _, tx := range txs {
+		blob, err := newJournalEntry(tx, types.Address{}, time.Time{}, time.Time{}).MarshalMsg(nil)
+		if err != nil {
+			t.Fatalf("failed to encode entry: %v", err)
+		}
+		output.Write(blob)
+		offset += int64(len(blob))
+	}
+	output.Write([]byte{0xc1}) // never used msgp type byte
+	output.Close()
+
+	loaded := 0
+	err = newTxJournal(path, false).load(func(tx *transaction.Transaction, from types.Address, at, _ time.Time) error {
+		loaded++
+		return nil
+	})
+	if loaded != len(txs) {
+		t.Errorf("loaded transaction count mismatch: have %d, want %d", loaded, len(txs))
+	}
+	jerr, ok := err.(*journalError)
+	if !ok {
+		t.Fatalf("decode error type mismatch: have %T (%v), want *journalError", err, err)
+	}
+	if jerr.index != len(txs) || jerr.offset != offset {
+		t.Errorf("corrupt record location mismatch: have #%d at %d, want #%d at %d", jerr.index, jerr.offset, len(txs), offset)
+	}
+	if want := fmt.Sprintf("journal record %d at offset %d", len(txs), offset); !strings.Contains(err.Error(), want) {
+		t.Errorf("error message %q doesn't contain %q", err, want)
+	}
+}
+
+// Benchmarks journaling a burst of local transactions with every insert going
+// straight to the file or being coalesced until a single flush.
+func BenchmarkJournalInsertUnbuffered(b *testing.B) { benchmarkJournalInsert(b, false) }
+func BenchmarkJournalInsertBuffered(b *testing.B)   { benchmarkJournalInsert(b, true) }
+
+func benchmarkJournalInsert(b *testing.B, buffered bool) {
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := crypto.GenerateKey()
+	txs := make(transaction.Transactions, 1000)
+	for i := range txs {
+		txs[i] = newxtransaction(uint64(i), 100, key)
+	}
+	journal := newTxJournal(filepath.Join(dir, "transactions.msgp"), buffered)
+	if err := journal.rotate(nil, nil, nil); err != nil {
+		b.Fatalf("failed to open journal: %v", err)
+	}
+	defer journal.close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tx := range txs {
+			if err := journal.insert(tx, types.Address{}, time.Time{}, time.Time{}); err != nil {
+				b.Fatalf("failed to insert transaction: %v", err)
+			}
+		}
+		if err := journal.flush(); err != nil {
+			b.Fatalf("failed to flush journal: %v", err)
+		}
+	}
+}
+
+// Benchmarks loading a large journal, recovering the sender of every entry from
+// its signature versus seeding it from the journaled address.
+func BenchmarkJournalLoadRecoverSenders(b *testing.B) { benchmarkJournalLoad(b, false) }
+func BenchmarkJournalLoadJournaledSenders(b *testing.B) { benchmarkJournalLoad(b, true) }
+
+func benchmarkJournalLoad(b *testing.B, journaled bool) {
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := crypto.GenerateKey()
+	txs := make(transaction.Transactions, 10000)
+	for i := range txs {
+		txs[i] = newxtransaction(uint64(i), 100, key)
+	}
+	// Journal the senders only if requested, legacy entries carry none
+	var from types.Address
+	if journaled {
+		from = crypto.PubkeyToAddress(key.PublicKey)
+	}
+	journal := newTxJournal(filepath.Join(dir, "transactions.msgp"), false)
+	if err := journal.rotate(map[types.Address]transaction.Transactions{from: txs}, nil, nil); err != nil {
+		b.Fatalf("failed to write journal: %v", err)
+	}
+	journal.close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := journal.load(func(tx *transaction.Transaction, from types.Address, seen, _ time.Time) error {
+			if from != (types.Address{}) {
+				transaction.SetSender(mSigner, tx, from)
+			}
+			_, err := transaction.Sender(mSigner, tx)
+			return err
+		})
+		if err != nil {
+			b.Fatalf("failed to load journal: %v", err)
+		}
+	}
+}
+
+// Tests that rotating the journal falls back to copying the regenerated journal
+// in place if it can't be renamed across devices, and that other rename errors
+// are still reported.
+func TestJournalRotateCrossDevice(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key)}
+
+	path := filepath.Join(dir, "transactions.msgp")
+	journal := newTxJournal(path, false)
+	journal.rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	if err := journal.rotate(map[types.Address]transaction.Transactions{from: txs}, nil, nil); err != nil {
+		t.Fatalf("failed to rotate journal across devices: %v", err)
+	}
+	journal.close()
+
+	if _, err := os.Stat(path + ".new"); !os.IsNotExist(err) {
+		t.Errorf("regenerated journal not removed after copy: %v", err)
+	}
+	loaded := 0
+	if err := newTxJournal(path, false).load(func(*transaction.Transaction, types.Address, time.Time, time.Time) error {
+		loaded++
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to load copied journal: %v", err)
+	}
+	if loaded != len(txs) {
+		t.Fatalf("loaded transactions mismatch: have %d, want %d", loaded, len(txs))
+	}
+	// Any other rename failure must surface
+	journal.rename = func(string, string) error { return syscall.EACCES }
+	if err := journal.rotate(nil, nil, nil); err != syscall.EACCES {
+		t.Fatalf("rename error mismatch: have %v, want %v", err, syscall.EACCES)
+	}
+}
+
+// Tests that a sequenced journal reloads local transactions in the order they
+// were submitted across accounts, even after being regenerated from the pool.
+func TestJournalSequenceOrder(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txjournal")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "transactions.msgp")
+	journal := newTxJournal(path, false)
+	journal.sequenced = true
+	if err := journal.rotate(nil, nil, nil); err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	// Submit transactions from a few accounts interleaved
+	keys := make([]*ecdsa.PrivateKey, 3)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	var submitted []types.Hash
+	all := make(map[types.Address]transaction.Transactions)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		for i := len(keys) - 1; i >= 0; i-- {
+			from := crypto.PubkeyToAddress(keys[i].PublicKey)
+			tx := newxtransaction(nonce, 100, keys[i])
+			if err := journal.insert(tx, from, time.Time{}, time.Time{}); err != nil {
+				t.Fatalf("failed to journal transaction: %v", err)
+			}
+			submitted = append(submitted, tx.Hash())
+			all[from] = append(all[from], tx)
+		}
+	}
+	// Regenerate the journal from the pool contents and reload it
+	if err := journal.rotate(all, nil, nil); err != nil {
+		t.Fatalf("failed to rotate journal: %v", err)
+	}
+	journal.close()
+
+	var loaded []types.Hash
+	if err := newTxJournal(path, false).load(func(tx *transaction.Transaction, from types.Address, seen, _ time.Time) error {
+		loaded = append(loaded, tx.Hash())
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if len(loaded) != len(submitted) {
+		t.Fatalf("loaded transaction count mismatch: have %d, want %d", len(loaded), len(submitted))
+	}
+	for i, hash := range submitted {
+		if loaded[i] != hash {
+			t.Errorf("transaction %d: order mismatch: have %x, want %x", i, loaded[i], hash)
+		}
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"math"
 	"math/big"
 	"sort"
+	"sync"
 
 	"mjoy.io/core/transaction"
 )
@@ -55,6 +56,8 @@ type txSortedMap struct {
 	items map[uint64]*transaction.Transaction // Hash map storing the transaction.Transaction data
 	index *nonceHeap                    // Heap of nonces of all the stored transaction.Transactions (non-strict mode)
 	cache transaction.Transactions            // Cache of the transaction.Transactions already sorted
+
+	cacheMu sync.Mutex // Guards filling the cache by concurrent readers holding only the pool's read lock
 }
 
 // newTxSortedMap creates a new nonce-sorted transaction.Transaction map.
@@ -178,7 +181,10 @@ func (m *txSortedMap) Remove(nonce uint64) bool {
 // Note, all transaction.Transactions with nonces lower than start will also be returned to
 // prevent getting into and invalid state. This is not something that should ever
 // happen but better to be self correcting than failing!
-func (m *txSortedMap) Ready(start uint64) transaction.Transactions {
+//
+// At most limit transactions are returned if it is positive, the rest stay in
+// the map for a later call.
+func (m *txSortedMap) Ready(start uint64, limit int) transaction.Transactions {
 	// Short circuit if no transaction.Transactions are available
 	if m.index.Len() == 0 || (*m.index)[0] > start {
 		return nil
@@ -186,6 +192,9 @@ func (m *txSortedMap) Ready(start uint64) transaction.Transactions {
 	// Otherwise start accumulating incremental transaction.Transactions
 	var ready transaction.Transactions
 	for next := (*m.index)[0]; m.index.Len() > 0 && (*m.index)[0] == next; next++ {
+		if limit > 0 && len(ready) >= limit {
+			break
+		}
 		ready = append(ready, m.items[next])
 		delete(m.items, next)
 		heap.Pop(m.index)
@@ -204,6 +213,11 @@ func (m *txSortedMap) Len() int {
 // sorted internal representation. The result of the sorting is cached in case
 // it's requested again before any modifications are made to the contents.
 func (m *txSortedMap) Flatten() transaction.Transactions {
+	// Flatten only reads the map, so it may be called under the pool's read lock
+	// concurrently. Mutators hold the write lock and needn't take the mutex
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
 	// If the sorting was not cached yet, create and cache it
 	if m.cache == nil {
 		m.cache = make(transaction.Transactions, 0, len(m.items))
@@ -266,6 +280,17 @@ func (l *txList) Add(tx *transaction.Transaction, rev uint64) (bool, *transactio
 	return true, nil
 }
 
+// Replace overwrites the transaction.Transaction at the nonce of tx, returning the one it
+// replaced, or nil if the list held none at that nonce.
+func (l *txList) Replace(tx *transaction.Transaction) *transaction.Transaction {
+	old := l.txs.Get(tx.Nonce())
+	l.txs.Put(tx)
+	if cost := tx.Cost(); l.costcap.Cmp(cost) < 0 {
+		l.costcap = cost
+	}
+	return old
+}
+
 // Forward removes all transaction.Transactions from the list with a nonce lower than the
 // provided threshold. Every removed transaction.Transaction is returned for any post-removal
 // maintenance.
@@ -337,8 +362,10 @@ func (l *txList) Remove(tx *transaction.Transaction) (bool, transaction.Transact
 // Note, all transaction.Transactions with nonces lower than start will also be returned to
 // prevent getting into and invalid state. This is not something that should ever
 // happen but better to be self correcting than failing!
-func (l *txList) Ready(start uint64) transaction.Transactions {
-	return l.txs.Ready(start)
+//
+// At most limit transactions are returned if it is positive.
+func (l *txList) Ready(start uint64, limit int) transaction.Transactions {
+	return l.txs.Ready(start, limit)
 }
 
 // Len returns the length of the transaction.Transaction list.
@@ -21,11 +21,17 @@
 package txprocessor
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
+	"io"
+	"math/big"
+	"math/rand"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"mjoy.io/common/types"
 	"mjoy.io/core"
@@ -36,19 +42,38 @@ import (
 	"mjoy.io/utils/metrics"
 	"gopkg.in/karalabe/cookiejar.v2/collections/prque"
 	"mjoy.io/core/transaction"
+	"mjoy.io/log"
+	"github.com/hashicorp/golang-lru"
+	"github.com/tinylib/msgp/msgp"
 )
 
 const (
 	// chainHeadChanSize is the size of channel listening to ChainHeadEvent.
 	chainHeadChanSize = 10
+	// maxPresize is the maximum number of transactions the lookup tables are
+	// sized for upfront, however large the configured limits are.
+	maxPresize = 1 << 16
 	// rmTxChanSize is the size of channel listening to RemovedTransactionEvent.
 	rmTxChanSize = 10
 )
 
 var (
 	// ErrInvalidSender is returned if the transaction contains an invalid signature.
+	// The more specific sender errors below all match it via errors.Is.
 	ErrInvalidSender = errors.New("invalid sender")
 
+	// ErrWrongChainID is returned if the transaction is signed for a different
+	// chain than the one the pool operates on.
+	ErrWrongChainID = fmt.Errorf("%w: wrong chain id", ErrInvalidSender)
+
+	// ErrBadSignature is returned if the sender of the transaction can't be
+	// recovered from its malformed or out of range signature values.
+	ErrBadSignature = fmt.Errorf("%w: bad signature", ErrInvalidSender)
+
+	// ErrUnsigned is returned if the transaction carries no signature at all. It
+	// also matches transaction.ErrUnsignedTransaction.
+	ErrUnsigned = fmt.Errorf("%w: %w", ErrInvalidSender, transaction.ErrUnsignedTransaction)
+
 	// ErrNonceTooLow is returned if the nonce of a transaction is lower than the
 	// one present in the local chain.
 	ErrNonceTooLow = errors.New("nonce too low")
@@ -71,11 +96,98 @@ var (
 	// than some meaningful limit a user might use. This is not a consensus error
 	// making the transaction invalid, rather a DOS protection.
 	ErrOversizedData = errors.New("oversized data")
+
+	// ErrPoolPaused is returned if a transaction is submitted while the pool is
+	// paused for maintenance.
+	ErrPoolPaused = errors.New("transaction pool paused")
+
+	// ErrPoolNotSynced is returned if a transaction is submitted while the pool
+	// failed to retrieve the state of the current chain head.
+	ErrPoolNotSynced = errors.New("transaction pool not synced")
+
+	// ErrPoolNotReady is returned if the pool is used before it ever managed to
+	// retrieve the state of a chain head, having nothing to validate against.
+	ErrPoolNotReady = errors.New("transaction pool not ready")
+
+	// ErrKnownMined is returned if a transaction is re-announced shortly after
+	// it was included in a block and removed from the pool.
+	ErrKnownMined = errors.New("transaction recently mined")
+
+	// ErrTooManyAccounts is returned if a remote transaction from a new sender
+	// is submitted while the pool already tracks the maximum number of accounts.
+	ErrTooManyAccounts = errors.New("too many accounts in pool")
+
+	// ErrCancelMismatch is returned if a cancellation replacement isn't from the
+	// same sender or at the same nonce as the transaction it should replace.
+	ErrCancelMismatch = errors.New("replacement doesn't match cancelled transaction")
+
+	// ErrAccountStateUnavailable is returned if the state of the sending account
+	// can't be loaded, e.g. because it was pruned.
+	ErrAccountStateUnavailable = errors.New("account state unavailable")
+
+	// ErrSenderNotWhitelisted is returned if the pool only accepts transactions
+	// of whitelisted senders and the sender of a transaction isn't one of them.
+	ErrSenderNotWhitelisted = errors.New("sender not whitelisted")
+
+	// ErrNoContractAtRecipient is returned if a transaction carrying a payload is
+	// sent to a recipient without contract code and such calls are refused.
+	ErrNoContractAtRecipient = errors.New("no contract code at recipient")
+
+	// ErrPoolBusy is returned if the pool lock couldn't be acquired within the
+	// deadline given for adding a transaction.
+	ErrPoolBusy = errors.New("transaction pool busy")
+
+	// ErrReorgInProgress is returned if a remote transaction is submitted while
+	// the pool has been busy processing a chain reorg for longer than allowed.
+	ErrReorgInProgress = errors.New("chain reorg in progress")
+
+	// ErrCancelUnknown is returned if there is no transaction to cancel.
+	ErrCancelUnknown = errors.New("no transaction to cancel")
+
+	// ErrKnownTransaction is returned if a transaction is already in the pool.
+	ErrKnownTransaction = errors.New("known transaction")
+
+	// ErrNonceOverlap is returned if a pending or queued transaction of the same
+	// sender already takes the nonce. Transactions carry no fee to outbid it with,
+	// so the pooled one is kept.
+	ErrNonceOverlap = errors.New("nonce taken by a pooled transaction")
+
+	// ErrPoolFull is returned if the pool holds as many transactions as its
+	// global limits allow and the new one can't be made room for.
+	ErrPoolFull = errors.New("pool.all > config.GlobalQueue")
+
+	// ErrForcePromoteDisabled is returned by ForcePromote unless the pool was
+	// configured to allow it.
+	ErrForcePromoteDisabled = errors.New("forced promotion disabled")
+
+	// ErrNotQueued is returned if a transaction expected in the queue isn't.
+	ErrNotQueued = errors.New("transaction not queued")
+
+	// ErrSenderMismatch is returned if a transaction of a per account batch is
+	// sent from a different account.
+	ErrSenderMismatch = errors.New("transaction from another sender")
+
+	// ErrNonceGap is returned if the transactions of a batch which must form a
+	// contiguous nonce sequence don't.
+	ErrNonceGap = errors.New("non-contiguous nonce")
+
+	// ErrAccountLimit is returned by batch simulations for transactions which
+	// the pool would take in, but drop right away for exceeding the allowance
+	// of their account.
+	ErrAccountLimit = errors.New("account transaction limit exceeded")
 )
 
 var (
 	evictionInterval    = time.Minute     // Time interval to check for evictable transactions
 	statsReportInterval = 8 * time.Second // Time interval to report transaction pool stats
+	statsReportJitter   = 0.1             // Fraction of the report interval to randomize by
+
+	lockRetryDelay = time.Millisecond // Delay between consecutive pool lock attempts with a deadline
+
+	stateRetries    = 3                      // Number of attempts to retrieve the head state on reset
+	stateRetryDelay = 100 * time.Millisecond // Delay between consecutive head state retrievals
+
+	minedCacheLimit = 4096 // Number of recently mined transaction hashes to remember
 )
 
 var (
@@ -85,6 +197,7 @@ var (
 	pendingReplaceCounter   = metrics.NewRegisteredCounter("txpool/pending/replace",nil)
 	pendingRateLimitCounter = metrics.NewRegisteredCounter("txpool/pending/ratelimit",nil) // Dropped due to rate limiting
 	pendingNofundsCounter   = metrics.NewRegisteredCounter("txpool/pending/nofunds",nil)   // Dropped due to out-of-funds
+	pendingGapCounter       = metrics.NewRegisteredCounter("txpool/pending/gap",nil)       // Dropped behind a removed pending one
 
 	// Metrics for the queued pool
 	queuedDiscardCounter   = metrics.NewRegisteredCounter("txpool/queued/discard",nil)
@@ -92,10 +205,40 @@ var (
 	queuedRateLimitCounter = metrics.NewRegisteredCounter("txpool/queued/ratelimit",nil) // Dropped due to rate limiting
 	queuedNofundsCounter   = metrics.NewRegisteredCounter("txpool/queued/nofunds",nil)   // Dropped due to out-of-funds
 
+	// Metrics for reorg handling
+	reinjectDropCounter = metrics.NewRegisteredCounter("txpool/reinject/dropped",nil) // Discarded by a reorg beyond MaxReinject
+
 	// General tx metrics
 	invalidTxCounter     = metrics.NewRegisteredCounter("txpool/invalid",nil)
+	hashCollisionCounter = metrics.NewRegisteredCounter("txpool/collision",nil) // Different transactions with the same hash
+	wrongChainIdCounter  = metrics.NewRegisteredCounter("txpool/invalid/chainid",nil)   // Signed for another chain
+	badSignatureCounter  = metrics.NewRegisteredCounter("txpool/invalid/signature",nil) // Unrecoverable sender
+	unsignedCounter      = metrics.NewRegisteredCounter("txpool/invalid/unsigned",nil)  // No signature at all
+
+	// Metrics for the eviction hook
+	sparedCounter = metrics.NewRegisteredCounter("txpool/evict/spared",nil) // Evictions vetoed by BeforeDrop
+
+	// Metrics for the local journal
+	journalSuspendCounter = metrics.NewRegisteredCounter("txpool/journal/suspended",nil) // Journaling stopped after repeated write failures
 )
 
+// InsufficientFundsError is returned if the spendable balance of an account, its
+// balance less the configured buffer, can't cover the cost of a transaction. It
+// matches ErrInsufficientFunds via errors.Is.
+type InsufficientFundsError struct {
+	Have *big.Int // Spendable balance of the sending account
+	Need *big.Int // Total cost of the transaction
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("%v: have %v, need %v", ErrInsufficientFunds, e.Have, e.Need)
+}
+
+// Is reports whether target is the ErrInsufficientFunds sentinel.
+func (e *InsufficientFundsError) Is(target error) bool {
+	return target == ErrInsufficientFunds
+}
+
 // TxStatus is the current status of a transaction as seen by the pool.
 type TxStatus uint
 
@@ -106,6 +249,51 @@ const (
 	TxStatusIncluded
 )
 
+// txStatusNames maps the known transaction statuses to their string forms.
+var txStatusNames = map[TxStatus]string{
+	TxStatusUnknown:  "unknown",
+	TxStatusQueued:   "queued",
+	TxStatusPending:  "pending",
+	TxStatusIncluded: "included",
+}
+
+// String implements fmt.Stringer, out of range values are reported as unknown.
+func (s TxStatus) String() string {
+	if name, ok := txStatusNames[s]; ok {
+		return name
+	}
+	return txStatusNames[TxStatusUnknown]
+}
+
+// MarshalJSON implements json.Marshaler, encoding the status in its string form.
+func (s TxStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// TxStatusInfo is the status of a transaction along with its position in the
+// chain if it was included.
+type TxStatusInfo struct {
+	Status      TxStatus `json:"status"`
+	BlockNumber *uint64  `json:"blockNumber,omitempty"` // Number of the including block, nil unless included
+	Index       *uint64  `json:"index,omitempty"`       // Index within the including block, nil unless included
+}
+
+// TxSummary holds the displayable fields of a pooled transaction, as reported
+// by Inspect.
+type TxSummary struct {
+	Nonce uint64         `json:"nonce"`
+	Hash  types.Hash     `json:"hash"`
+	From  types.Address  `json:"from"`
+	To    *types.Address `json:"to"` // nil for contract creations
+	Value *big.Int       `json:"value"`
+}
+
+// txLookup is implemented by chains able to locate included transactions. It is
+// optional, against other chains included transactions are reported unknown.
+type txLookup interface {
+	GetTxLookupEntry(hash types.Hash) (types.Hash, uint64, uint64)
+}
+
 // blockChain provides the state of blockchain  to do
 // some pre checks in tx pool and event subscribers.
 type blockChain interface {
@@ -116,18 +304,74 @@ type blockChain interface {
 	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
 }
 
+// FullPoolPolicy selects how the pool treats new transactions once it holds as
+// many transactions as its global limits allow.
+type FullPoolPolicy uint
+
+const (
+	FullPoolReject      FullPoolPolicy = iota // Reject new transactions until space frees up
+	FullPoolEvictOldest                       // Evict the oldest non-local queued transaction to make room
+)
+
 // TxPoolConfig are the configuration parameters of the transaction pool.
 type TxPoolConfig struct {
 	NoLocals  bool          // Whether local transaction handling should be disabled
 	Journal   string        // Journal of local transactions to survive node restarts
 	Rejournal time.Duration // Time interval to regenerate the local transaction journal
 
+	JournalFailures int  // Consecutive journal write failures after which journaling is suspended (0 = never)
+	JournalSequence bool // Whether the journal records the local submission order across accounts
+
 	AccountSlots uint64 // Minimum number of executable transaction slots guaranteed per account
 	GlobalSlots  uint64 // Maximum number of executable transaction slots for all accounts
 	AccountQueue uint64 // Maximum number of non-executable transaction slots permitted per account
 	GlobalQueue  uint64 // Maximum number of non-executable transaction slots for all accounts
 
-	Lifetime time.Duration // Maximum amount of time non-executable transaction are queued
+	Lifetime        time.Duration // Maximum amount of time non-executable transaction are queued
+	PendingLifetime time.Duration // Maximum amount of time executable transactions are pending (0 = forever)
+
+	MaxTxSize       uint64 // Maximum encoded size of calls and transfers accepted
+	MaxCreationSize uint64 // Maximum encoded size of contract creations accepted
+
+	BalanceBuffer *big.Int // Minimum balance to keep on top of a transaction's cost to accept it
+
+	SenderWorkers int // Number of goroutines recovering the senders of a batch before insertion (<= 1 disables)
+	DemoteWorkers int // Number of goroutines loading pending account states when demoting (<= 1 disables)
+
+	FullPoolPolicy FullPoolPolicy // Behavior for new transactions when the pool is full
+
+	MaxAccounts uint64 // Maximum number of distinct remote senders tracked by the pool (0 = unlimited)
+
+	DropDependents bool // Drop the higher nonce transactions of a removed pending one instead of requeueing them
+
+	SenderWhitelist       map[types.Address]bool // Only senders mapped to true are accepted (empty = allow all)
+	WhitelistBypassLocals bool                   // Whether local transactions are accepted regardless of the whitelist
+
+	RequireContractCode bool // Whether transactions carrying a payload must be sent to a contract
+
+	PromoteBatchSize int // Maximum number of transactions of an account promoted per pass (0 = unlimited)
+
+	ReorgRejectDelay time.Duration // Time a running reset may hold up remote additions before they are rejected (0 = always wait)
+	MaxReinject      int           // Maximum number of transactions discarded by a reorg to reinject (0 = unlimited)
+
+	RecipientRateWindow time.Duration // Time constant of the per recipient arrival rate average (0 = disabled)
+	RecipientRateLimit  int           // Maximum number of recipients whose arrival rate is tracked
+
+	AuditLog string // Append-only log of all transaction lifecycle events (empty = disabled)
+
+	ReportBackoff    float64       // Factor to stretch the stats report interval by while the pool keeps changing
+	ReportBackoffCap time.Duration // Maximum stats report interval while backing off
+
+	AllowForcePromote bool // Whether ForcePromote may move queued transactions into pending, for testing only
+
+	SaturationHigh float64 // Fraction of GlobalSlots+GlobalQueue at which the pool reports saturation (0 = disabled)
+	SaturationLow  float64 // Fraction of GlobalSlots+GlobalQueue below which a saturated pool reports relief
+
+	// BeforeDrop is called with the pool lock held before a transaction is
+	// evicted for being stale or over the pool limits. Returning false spares
+	// the transaction from that eviction pass, up to BeforeDropRetain times.
+	BeforeDrop       func(tx *transaction.Transaction, reason string) bool
+	BeforeDropRetain int // Maximum number of eviction passes a single transaction may be spared from
 }
 
 // DefaultTxPoolConfig contains the default configurations for the transaction
@@ -136,12 +380,31 @@ var DefaultTxPoolConfig = TxPoolConfig{
 	Journal:   "transactions.msgp",
 	Rejournal: time.Hour,
 
+	JournalFailures: 8,
+
 	AccountSlots: 16,
 	GlobalSlots:  4096,
 	AccountQueue: 64,
 	GlobalQueue:  1024,
 
 	Lifetime: 3 * time.Hour,
+
+	MaxTxSize:       32 * 1024,
+	MaxCreationSize: 128 * 1024,
+
+	SenderWorkers: runtime.NumCPU(),
+	DemoteWorkers: runtime.NumCPU(),
+
+	RecipientRateWindow: time.Minute,
+	RecipientRateLimit:  1024,
+
+	ReportBackoff:    2,
+	ReportBackoffCap: 2 * time.Minute,
+
+	SaturationHigh: 0.9,
+	SaturationLow:  0.75,
+
+	BeforeDropRetain: 3,
 }
 
 // sanitize checks the provided user configurations and changes anything that's
@@ -152,6 +415,33 @@ func (config *TxPoolConfig) sanitize() TxPoolConfig {
 		logger.Warn("Sanitizing invalid txpool journal time", "provided", conf.Rejournal, "updated", time.Second)
 		conf.Rejournal = time.Second
 	}
+	if conf.AccountSlots < 1 {
+		logger.Warn("Sanitizing invalid txpool account slots", "provided", conf.AccountSlots, "updated", 1)
+		conf.AccountSlots = 1
+	}
+	if conf.GlobalSlots < conf.AccountSlots {
+		logger.Warn("Sanitizing invalid txpool global slots", "provided", conf.GlobalSlots, "updated", conf.AccountSlots)
+		conf.GlobalSlots = conf.AccountSlots
+	}
+	if conf.MaxTxSize == 0 {
+		logger.Warn("Sanitizing invalid txpool transaction size limit", "provided", conf.MaxTxSize, "updated", DefaultTxPoolConfig.MaxTxSize)
+		conf.MaxTxSize = DefaultTxPoolConfig.MaxTxSize
+	}
+	if conf.MaxCreationSize < conf.MaxTxSize {
+		logger.Warn("Sanitizing invalid txpool contract creation size limit", "provided", conf.MaxCreationSize, "updated", conf.MaxTxSize)
+		conf.MaxCreationSize = conf.MaxTxSize
+	}
+	if conf.ReportBackoff < 1 {
+		logger.Warn("Sanitizing invalid txpool report backoff", "provided", conf.ReportBackoff, "updated", 1)
+		conf.ReportBackoff = 1
+	}
+	if conf.ReportBackoffCap < statsReportInterval {
+		conf.ReportBackoffCap = statsReportInterval
+	}
+	if conf.SaturationLow > conf.SaturationHigh {
+		logger.Warn("Sanitizing invalid txpool saturation watermarks", "high", conf.SaturationHigh, "low", conf.SaturationLow, "updated", conf.SaturationHigh)
+		conf.SaturationLow = conf.SaturationHigh
+	}
 
 	return conf
 }
@@ -164,27 +454,57 @@ func (config *TxPoolConfig) sanitize() TxPoolConfig {
 // current state) and future transactions. Transactions move between those
 // two states over time as they are received and processed.
 type TxPool struct {
-	config       TxPoolConfig
-	chainconfig  *params.ChainConfig
-	chain        blockChain
-	txFeed       event.Feed
-	scope        event.SubscriptionScope
-	chainHeadCh  chan core.ChainHeadEvent
-	chainHeadSub event.Subscription
-	signer       transaction.Signer
-	mu           sync.RWMutex
+	resetStart int64 // Unix nanoseconds the running reset started at, 0 if idle (atomic, kept first for alignment)
+
+	config         TxPoolConfig
+	chainconfig    *params.ChainConfig
+	chain          blockChain
+	txFeed         event.Feed
+	replaceFeed    event.Feed
+	pendingFeed    event.Feed
+	saturationFeed event.Feed
+	scope          event.SubscriptionScope
+	chainHeadCh    chan core.ChainHeadEvent
+	promoteCh      chan struct{}
+	chainHeadSub   event.Subscription
+	signer         transaction.Signer
+	mu             sync.RWMutex
 
 	currentState  *state.StateDB      // Current state in the blockchain head
 	pendingState  *state.ManagedState // Pending state tracking virtual nonces
 
 	locals  *accountSet // Set of local transaction to exempt from eviction rules
 	journal *txJournal  // Journal of local transaction to back up to disk
+	audit   *txAudit    // Audit log of transaction lifecycle events, nil if disabled
+	mirror  io.Writer   // Secondary sink receiving every accepted transaction, nil if disabled
+
+	journalFailures  int  // Number of consecutive failed journal writes
+	journalSuspended bool // Whether journaling stopped after too many failed writes, until the next rotation
+
+	pending  map[types.Address]*txList               // All currently processable transactions
+	queue    map[types.Address]*txList               // Queued but non-processable transactions
+	beats    map[types.Address]time.Time             // Last heartbeat from each known account
+	limits   map[types.Address]accountLimits         // Per account overrides of the slot allowances
+	reserved map[types.Address][]*nonceRange         // Outstanding nonce reservations of each account, in order
+	all      map[types.Hash]*transaction.Transaction // All transactions to allow lookups
+	seen     map[types.Hash]time.Time                // Time each known transaction was first seen
+	tags     map[types.Hash]string                   // Opaque labels attached to local transactions
+	mined    *lru.Cache                              // Hashes of transactions recently removed as included
+
+	recipients *recipientRates // Decaying arrival rates of transactions per recipient, nil if disabled
+
+	snapshot *PendingSnapshot // Flattened pending set shared until the next reset, nil if not yet taken
+
+	deferred map[types.Address]struct{} // Accounts with executable transactions left over by a capped promotion
 
-	pending map[types.Address]*txList         // All currently processable transactions
-	queue   map[types.Address]*txList         // Queued but non-processable transactions
-	beats   map[types.Address]time.Time       // Last heartbeat from each known account
-	all     map[types.Hash]*transaction.Transaction // All transactions to allow lookups
+	rejections map[string]uint64 // Number of transactions refused by add, by rejection reason
+	spared     map[types.Hash]int // Number of eviction passes each transaction was spared from by BeforeDrop
 
+	paused    bool // Whether new transactions are rejected and eviction suspended
+	saturated bool // Whether the pool is above its saturation high watermark
+	closed    bool // Whether the pool is being stopped and must ignore chain head events
+	unlimited bool // Test hook disabling the global pending and queue trimming
+	synced bool // Whether the state of the current head was successfully retrieved
 
 	wg sync.WaitGroup // for shutdown sync
 
@@ -196,6 +516,15 @@ type TxPool struct {
 func NewTxPool(config TxPoolConfig, chainconfig *params.ChainConfig, chain blockChain) *TxPool {
 
 	config = (&config).sanitize()
+	mined, _ := lru.New(minedCacheLimit)
+
+	// Size the lookup tables for a full pool upfront, sparing the rehashes of
+	// growing them while the pool is filling up
+	capacity := config.GlobalSlots + config.GlobalQueue
+	if capacity < config.GlobalSlots || capacity > maxPresize {
+		capacity = maxPresize
+	}
+
 	// Create the transaction pool with its initial settings
 	pool := &TxPool{
 		config:      config,
@@ -205,20 +534,43 @@ func NewTxPool(config TxPoolConfig, chainconfig *params.ChainConfig, chain block
 		pending:     make(map[types.Address]*txList),
 		queue:       make(map[types.Address]*txList),
 		beats:       make(map[types.Address]time.Time),
-		all:         make(map[types.Hash]*transaction.Transaction),
+		limits:      make(map[types.Address]accountLimits),
+		reserved:    make(map[types.Address][]*nonceRange),
+		all:         make(map[types.Hash]*transaction.Transaction, int(capacity)),
+		seen:        make(map[types.Hash]time.Time, int(capacity)),
+		tags:        make(map[types.Hash]string),
+		mined:       mined,
 		chainHeadCh: make(chan core.ChainHeadEvent, chainHeadChanSize),
+		promoteCh:   make(chan struct{}, 1),
+		deferred:    make(map[types.Address]struct{}),
+		rejections:  make(map[string]uint64),
+		spared:      make(map[types.Hash]int),
 	}
 	pool.locals = newAccountSet(pool.signer)
+	pool.recipients = newRecipientRates(config.RecipientRateWindow, config.RecipientRateLimit)
+	if config.AuditLog != "" {
+		audit, err := newTxAudit(config.AuditLog, pool.signer)
+		if err != nil {
+			logger.Warn("Failed to open transaction audit log", "err", err)
+		} else {
+			pool.audit = audit
+		}
+	}
 	pool.reset(nil, chain.CurrentBlock().Header())
+	if pool.pendingState == nil {
+		// Keep going, the next chain head event may still bring the pool up
+		logger.Error("Transaction pool started without chain state, rejecting transactions", "err", ErrPoolNotReady)
+	}
 
 	// If local transactions and journaling is enabled, load from disk
 	if !config.NoLocals && config.Journal != "" {
-		pool.journal = newTxJournal(config.Journal)
+		pool.journal = newTxJournal(config.Journal, true)
+		pool.journal.sequenced = config.JournalSequence
 
-		if err := pool.journal.load(pool.AddLocal); err != nil {
+		if err := pool.journal.load(pool.addJournaled); err != nil {
 			logger.Warn("Failed to load transaction journal", "err", err)
 		}
-		if err := pool.journal.rotate(pool.local()); err != nil {
+		if err := pool.rotateJournal(); err != nil {
 			logger.Warn("Failed to rotate transaction journal", "err", err)
 		}
 	}
@@ -241,7 +593,8 @@ func (pool *TxPool) loop() {
 	// Start the stats reporting and transaction eviction tickers
 	var prevPending, prevQueued int
 
-	report := time.NewTicker(statsReportInterval)
+	backoff := newReportBackoff(statsReportInterval, pool.config.ReportBackoffCap, pool.config.ReportBackoff)
+	report := time.NewTimer(backoff.next(false))
 	defer report.Stop()
 
 	evict := time.NewTicker(evictionInterval)
@@ -258,50 +611,45 @@ func (pool *TxPool) loop() {
 		select {
 		// Handle ChainHeadEvent
 		case ev := <-pool.chainHeadCh:
-			if ev.Block != nil {
-				pool.mu.Lock()
-				pool.reset(head.Header(), ev.Block.Header())
-				head = ev.Block
+			head = pool.chainHead(head, ev)
 
-				pool.mu.Unlock()
-			}
 		// Be unsubscribed due to system stopped
 		case <-pool.chainHeadSub.Err():
 			return
 
+		// Handle promotions deferred by the promotion batch size
+		case <-pool.promoteCh:
+			pool.promoteDeferred()
+
 		// Handle stats reporting ticks
 		case <-report.C:
 			pool.mu.RLock()
 			pending, queued := pool.stats()
 			pool.mu.RUnlock()
 
-			if pending != prevPending || queued != prevQueued  {
+			changed := pending != prevPending || queued != prevQueued
+			if changed {
 				logger.Debug("Transaction pool status report", "executable", pending, "queued", queued)
 				prevPending, prevQueued = pending, queued
 			}
+			// Report less often while the pool is churning
+			report.Reset(backoff.next(changed))
 
 		// Handle inactive account transaction eviction
 		case <-evict.C:
 			pool.mu.Lock()
-			for addr := range pool.queue {
-				// Skip local transactions from the eviction mechanism
-				if pool.locals.contains(addr) {
-					continue
-				}
-				// Any non-locals old enough should be removed
-				if time.Since(pool.beats[addr]) > pool.config.Lifetime {
-					for _, tx := range pool.queue[addr].Flatten() {
-						pool.removeTx(tx.Hash())
-					}
-				}
+			if pool.paused {
+				pool.mu.Unlock()
+				continue
 			}
+			pool.evictStale()
 			pool.mu.Unlock()
 
 		// Handle local transaction journal rotation
 		case <-journal.C:
 			if pool.journal != nil {
 				pool.mu.Lock()
-				if err := pool.journal.rotate(pool.local()); err != nil {
+				if err := pool.rotateJournal(); err != nil {
 					logger.Warn("Failed to rotate local tx journal", "err", err)
 				}
 				pool.mu.Unlock()
@@ -310,6 +658,83 @@ func (pool *TxPool) loop() {
 	}
 }
 
+// chainHead resets the pool from the current head onto the one announced by ev,
+// returning the head the pool is at afterwards. Events arriving after Stop began
+// are ignored, the pool is being torn down, as are repeated announcements of the
+// head the pool is already at.
+func (pool *TxPool) chainHead(head *block.Block, ev core.ChainHeadEvent) *block.Block {
+	if ev.Block == nil {
+		return head
+	}
+	if head != nil && ev.Block.Hash() == head.Hash() {
+		logger.Debug("Skipping reset onto the current head", "hash", head.Hash())
+		return head
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.closed {
+		return head
+	}
+	pool.reset(head.Header(), ev.Block.Header())
+	return ev.Block
+}
+
+// deferPromotion schedules another promotion pass for an account which still
+// has executable transactions queued after a capped pass.
+func (pool *TxPool) deferPromotion(addr types.Address) {
+	pool.deferred[addr] = struct{}{}
+	select {
+	case pool.promoteCh <- struct{}{}:
+	default:
+	}
+}
+
+// promoteDeferred runs a promotion pass over the accounts deferred since the
+// last one. Accounts still left with executable transactions defer themselves
+// again, so large queues are promoted over several passes, releasing the lock
+// in between. Paused pools keep the deferred accounts until resumed.
+func (pool *TxPool) promoteDeferred() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.closed || pool.paused || len(pool.deferred) == 0 {
+		return
+	}
+	accounts := make([]types.Address, 0, len(pool.deferred))
+	for addr := range pool.deferred {
+		accounts = append(accounts, addr)
+	}
+	pool.deferred = make(map[types.Address]struct{})
+	pool.promoteExecutables(accounts)
+}
+
+// reportBackoff paces the stats reports, stretching the interval between them
+// while the pool keeps changing and snapping back once it settles.
+type reportBackoff struct {
+	base     time.Duration // Interval to report at while the pool is stable
+	cap      time.Duration // Maximum interval to back off to
+	factor   float64       // Factor to stretch the interval by on each change
+	interval time.Duration // Current interval before jitter
+}
+
+// newReportBackoff creates a report pacer starting at the base interval.
+func newReportBackoff(base, cap time.Duration, factor float64) *reportBackoff {
+	return &reportBackoff{base: base, cap: cap, factor: factor, interval: base}
+}
+
+// next returns the time to wait for the next report, given whether the pool
+// changed since the last one. Some jitter is added to avoid lockstep reports.
+func (b *reportBackoff) next(changed bool) time.Duration {
+	if !changed {
+		b.interval = b.base
+	} else if b.interval = time.Duration(float64(b.interval) * b.factor); b.interval > b.cap {
+		b.interval = b.cap
+	}
+	jitter := time.Duration((rand.Float64()*2 - 1) * statsReportJitter * float64(b.interval))
+	return b.interval + jitter
+}
+
 // lockedReset is a wrapper around reset to allow calling it in a thread safe
 // manner. This method is only ever used in the tester!
 func (pool *TxPool) lockedReset(oldHead, newHead *block.Header) {
@@ -322,6 +747,9 @@ func (pool *TxPool) lockedReset(oldHead, newHead *block.Header) {
 // reset retrieves the current state of the blockchain and ensures the content
 // of the transaction pool is valid with regard to the chain state.
 func (pool *TxPool) reset(oldHead, newHead *block.Header) {
+	atomic.StoreInt64(&pool.resetStart, time.Now().UnixNano())
+	defer atomic.StoreInt64(&pool.resetStart, 0)
+
 	// If we're reorging an old state, reinject all dropped transactions
 	var reinject transaction.Transactions
 
@@ -330,7 +758,7 @@ func (pool *TxPool) reset(oldHead, newHead *block.Header) {
 		oldNum := oldHead.Number.IntVal.Uint64()
 		newNum := newHead.Number.IntVal.Uint64()
 
-		if depth := uint64(math.Abs(float64(oldNum) - float64(newNum))); depth > 64 {
+		if depth := reorgDepth(oldNum, newNum); depth > 64 {
 			logger.Debug("Skipping deep transaction reorg", "depth", depth)
 		} else {
 			// Reorg seems shallow enough to pull in all transactions into memory
@@ -367,6 +795,12 @@ func (pool *TxPool) reset(oldHead, newHead *block.Header) {
 				}
 			}
 			reinject = transaction.TxDifference(discarded, included)
+			if limit := pool.config.MaxReinject; limit > 0 && len(reinject) > limit {
+				reinject = pool.limitReinject(reinject, limit)
+			}
+			for _, tx := range reinject {
+				pool.mined.Remove(tx.Hash())
+			}
 		}
 	}
 	// Initialize the internal state to the current head
@@ -374,17 +808,25 @@ func (pool *TxPool) reset(oldHead, newHead *block.Header) {
 		newHead = pool.chain.CurrentBlock().Header() // Special case during testing
 	}
 	statedb, err := pool.chain.StateAt(newHead.StateHash)
+	for attempt := 1; err != nil && attempt < stateRetries; attempt++ {
+		logger.Debug("Retrying txpool state retrieval", "attempt", attempt, "err", err)
+		time.Sleep(time.Duration(attempt) * stateRetryDelay)
+		statedb, err = pool.chain.StateAt(newHead.StateHash)
+	}
 	if err != nil {
+		// Reject new transactions instead of validating them against stale state
 		logger.Error("Failed to reset txpool state", "err", err)
+		pool.synced = false
 		return
 	}
+	pool.synced = true
 	pool.currentState = statedb
 	pool.pendingState = state.ManageState(statedb)
 
 
 	// Inject any transactions discarded due to reorgs
 	logger.Debug("Reinjecting stale transactions", "count", len(reinject))
-	pool.addTxsLocked(reinject, false)
+	pool.addTxsLocked(reinject, false, true)
 
 	// validate the pool of pending transactions, this will remove
 	// any transactions that have been included in the block or
@@ -399,10 +841,96 @@ func (pool *TxPool) reset(oldHead, newHead *block.Header) {
 	// Check the queue and move transactions over to the pending if possible
 	// or remove those that have become invalid
 	pool.promoteExecutables(nil)
+
+	// Invalidate the pending snapshot, the next builder cycle needs a fresh one
+	if pool.snapshot != nil {
+		pool.snapshot.invalidate()
+		pool.snapshot = nil
+	}
+	// Nudge anyone pulling pending transactions that the executable set shifted
+	go pool.pendingFeed.Send(struct{}{})
+}
+
+// limitReinject bounds the transactions discarded by a reorg to the limit most
+// worth reinjecting: local ones first, then the lowest nonces, as the later ones
+// of an account can't execute without them. The rest is dropped.
+func (pool *TxPool) limitReinject(txs transaction.Transactions, limit int) transaction.Transactions {
+	local := make(map[*transaction.Transaction]bool, len(txs))
+	for _, tx := range txs {
+		from, _ := transaction.Sender(pool.signer, tx) // cached for the reinjection
+		local[tx] = pool.locals.contains(from)
+	}
+	sort.SliceStable(txs, func(i, j int) bool {
+		if local[txs[i]] != local[txs[j]] {
+			return local[txs[i]]
+		}
+		return txs[i].Nonce() < txs[j].Nonce()
+	})
+	logger.Debug("Dropping excess reorged transactions", "discarded", len(txs), "limit", limit)
+	reinjectDropCounter.Inc(int64(len(txs) - limit))
+
+	return txs[:limit]
+}
+
+// evictStale drops the transactions of non-local accounts that lingered in the
+// pool for too long: queued ones of inactive accounts after Lifetime, pending
+// ones after PendingLifetime since they were first seen, if configured.
+//
+// The caller must hold the pool lock.
+func (pool *TxPool) evictStale() {
+	for addr := range pool.queue {
+		// Skip local transactions from the eviction mechanism
+		if pool.locals.contains(addr) {
+			continue
+		}
+		// Any non-locals old enough should be removed
+		if time.Since(pool.beats[addr]) > pool.config.Lifetime {
+			for _, tx := range pool.queue[addr].Flatten() {
+				if pool.spare(tx, dropEvicted) {
+					continue
+				}
+				pool.removeTx(tx.Hash(), dropEvicted)
+			}
+		}
+	}
+	if pool.config.PendingLifetime == 0 {
+		return
+	}
+	for addr, list := range pool.pending {
+		if pool.locals.contains(addr) {
+			continue
+		}
+		for _, tx := range list.Flatten() {
+			hash := tx.Hash()
+			if seen, ok := pool.seen[hash]; ok && time.Since(seen) > pool.config.PendingLifetime {
+				if pool.spare(tx, dropEvicted) {
+					continue
+				}
+				if logger.Level() <= log.LevelTrace {
+					logger.Tracef("Evicting stale pending transaction hash:0x%x", hash)
+				}
+				pool.removeTx(hash, dropEvicted)
+			}
+		}
+	}
+}
+
+// reorgDepth returns the absolute difference between two block numbers, exact
+// across the whole uint64 range.
+func reorgDepth(oldNum, newNum uint64) uint64 {
+	if oldNum > newNum {
+		return oldNum - newNum
+	}
+	return newNum - oldNum
 }
 
 // Stop terminates the transaction pool.
 func (pool *TxPool) Stop() {
+	// Refuse any chain head event still in flight
+	pool.mu.Lock()
+	pool.closed = true
+	pool.mu.Unlock()
+
 	// Unsubscribe all subscriptions registered from txpool
 	pool.scope.Close()
 
@@ -413,185 +941,1201 @@ func (pool *TxPool) Stop() {
 	if pool.journal != nil {
 		pool.journal.close()
 	}
+	if pool.audit != nil {
+		pool.audit.close()
+	}
 	logger.Info("Transaction pool stopped")
 }
 
+// Pause stops the pool from accepting new transactions and suspends the
+// eviction of stale ones and the deferred promotion passes, keeping all existing
+// state, the journal and any subscriptions intact.
+func (pool *TxPool) Pause() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.paused = true
+}
+
+// Resume lifts a previous Pause and promotes any queued transactions that
+// became executable in the mean time, including the deferred ones.
+func (pool *TxPool) Resume() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if !pool.paused {
+		return
+	}
+	pool.paused = false
+
+	// The catch-up pass covers all queued accounts, accounts with executable
+	// transactions left over defer themselves again
+	pool.deferred = make(map[types.Address]struct{})
+	pool.promoteExecutables(nil)
+}
+
 // SubscribeTxPreEvent registers a subscription of TxPreEvent and
 // starts sending event to the given channel.
 func (pool *TxPool) SubscribeTxPreEvent(ch chan<- core.TxPreEvent) event.Subscription {
 	return pool.scope.Track(pool.txFeed.Subscribe(ch))
 }
 
+// SubscribeTxReplaceEvent registers a subscription of TxReplaceEvent, posted
+// whenever a pooled transaction is replaced by another one at the same nonce,
+// so clients can tell which of their transactions is live.
+func (pool *TxPool) SubscribeTxReplaceEvent(ch chan<- core.TxReplaceEvent) event.Subscription {
+	return pool.scope.Track(pool.replaceFeed.Subscribe(ch))
+}
 
+// SubscribePendingChanged registers a subscription notified each time the
+// pending set was revalidated against a new chain head.
+func (pool *TxPool) SubscribePendingChanged(ch chan<- struct{}) event.Subscription {
+	return pool.scope.Track(pool.pendingFeed.Subscribe(ch))
+}
 
-// State returns the virtual managed state of the transaction pool.
-func (pool *TxPool) State() *state.ManagedState {
-	pool.mu.RLock()
-	defer pool.mu.RUnlock()
-
-	return pool.pendingState
+// SubscribeSaturation registers a subscription for pool saturation changes. True
+// is sent once the pool fills past the high watermark and false once it drains
+// below the low one, letting peers stop relaying transactions to a full pool.
+func (pool *TxPool) SubscribeSaturation(ch chan<- bool) event.Subscription {
+	return pool.scope.Track(pool.saturationFeed.Subscribe(ch))
 }
 
-// Stats retrieves the current pool stats, namely the number of pending and the
-// number of queued (non-executable) transactions.
-func (pool *TxPool) Stats() (int, int) {
-	pool.mu.RLock()
-	defer pool.mu.RUnlock()
 
-	return pool.stats()
+
+// SetMirror sets a secondary sink every transaction accepted by the pool is
+// copied to, msgp encoded one after the other. Unlike the journal, the mirror
+// covers remote transactions too and is never rotated or read back. Writing is
+// best effort, failures are logged but leave the pool unaffected. A nil writer
+// disables mirroring.
+func (pool *TxPool) SetMirror(w io.Writer) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.mirror = w
 }
 
-// stats retrieves the current pool stats, namely the number of pending and the
-// number of queued (non-executable) transactions.
-func (pool *TxPool) stats() (int, int) {
-	pending := 0
-	for _, list := range pool.pending {
-		pending += list.Len()
+// mirrorTx copies an accepted transaction to the mirror sink, if one is set.
+func (pool *TxPool) mirrorTx(tx *transaction.Transaction) {
+	if pool.mirror == nil {
+		return
 	}
-	queued := 0
-	for _, list := range pool.queue {
-		queued += list.Len()
+	if err := msgp.Encode(pool.mirror, tx); err != nil {
+		logger.Warn("Failed to mirror accepted transaction", "hash", tx.Hash(), "err", err)
 	}
-	return pending, queued
 }
 
-// Content retrieves the data content of the transaction pool, returning all the
-// pending as well as queued transactions, grouped by account and sorted by nonce.
-func (pool *TxPool) Content() (map[types.Address]transaction.Transactions, map[types.Address]transaction.Transactions) {
+// accountLimits overrides the global per account slot allowances for a single
+// account. A zero value falls back to the global configuration.
+type accountLimits struct {
+	slots uint64 // Executable transaction slots guaranteed to the account
+	queue uint64 // Non-executable transaction slots permitted to the account
+}
+
+// SetAccountLimits overrides the pending and queued allowances of a specific
+// account, granting it a different share of the pool without marking it local.
+// A zero value for either limit restores the global default.
+func (pool *TxPool) SetAccountLimits(addr types.Address, slots, queue uint64) {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	pending := make(map[types.Address]transaction.Transactions)
-	for addr, list := range pool.pending {
-		pending[addr] = list.Flatten()
+	if slots == 0 && queue == 0 {
+		delete(pool.limits, addr)
+		return
 	}
-	queued := make(map[types.Address]transaction.Transactions)
-	for addr, list := range pool.queue {
-		queued[addr] = list.Flatten()
+	pool.limits[addr] = accountLimits{slots: slots, queue: queue}
+}
+
+// accountSlots returns the number of executable slots guaranteed to an account.
+func (pool *TxPool) accountSlots(addr types.Address) uint64 {
+	if limit := pool.limits[addr].slots; limit != 0 {
+		return limit
 	}
-	return pending, queued
+	return pool.config.AccountSlots
 }
 
-// Pending retrieves all currently processable transactions, groupped by origin
-// account and sorted by nonce. The returned transaction set is a copy and can be
-// freely modified by calling code.
-func (pool *TxPool) Pending() (map[types.Address]transaction.Transactions, error) {
+// accountQueue returns the number of non-executable slots permitted to an account.
+func (pool *TxPool) accountQueue(addr types.Address) uint64 {
+	if limit := pool.limits[addr].queue; limit != 0 {
+		return limit
+	}
+	return pool.config.AccountQueue
+}
+
+// Signer returns the signer the pool derives transaction senders with, so that
+// outside code can do the same without rebuilding one from the chain config.
+func (pool *TxPool) Signer() transaction.Signer {
+	return pool.signer
+}
+
+// State returns the virtual managed state of the transaction pool, or nil if
+// the pool is not ready yet.
+func (pool *TxPool) State() *state.ManagedState {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.pendingState
+}
+
+// CurrentNonce returns the nonce of an account in the state of the current head,
+// unlike the virtual nonce of State not counting any pending transactions. It
+// is zero if the pool is not ready yet.
+func (pool *TxPool) CurrentNonce(addr types.Address) uint64 {
+	// Nonce lookups may fill the state object cache, hence the write lock
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	pending := make(map[types.Address]transaction.Transactions)
-	for addr, list := range pool.pending {
-		pending[addr] = list.Flatten()
+	if pool.currentState == nil {
+		return 0
 	}
-	return pending, nil
+	return pool.currentState.GetNonce(addr)
 }
 
-// local retrieves all currently known local transactions, groupped by origin
-// account and sorted by nonce. The returned transaction set is a copy and can be
-// freely modified by calling code.
-func (pool *TxPool) local() map[types.Address]transaction.Transactions {
-	txs := make(map[types.Address]transaction.Transactions)
-	for addr := range pool.locals.accounts {
-		if pending := pool.pending[addr]; pending != nil {
-			txs[addr] = append(txs[addr], pending.Flatten()...)
-		}
-		if queued := pool.queue[addr]; queued != nil {
-			txs[addr] = append(txs[addr], queued.Flatten()...)
+// nonceRange is a range of nonces reserved via ReserveNonces.
+type nonceRange struct {
+	start, end uint64 // First nonce of the range and the one past its last
+	released   bool   // Whether the reservation was given back but still blocks the ones before it
+}
+
+// ReserveNonces reserves a contiguous range of count nonces of an account for a
+// caller building dependent transactions, starting at the account's next pending
+// nonce or past any outstanding reservation. Concurrent callers get disjoint
+// ranges. The returned release function gives the reservation back once the
+// caller is done, freeing the nonces pooled transactions didn't use. As long as
+// a later reservation is outstanding, released ones stay taken to avoid leaving
+// a gap in front of it.
+func (pool *TxPool) ReserveNonces(addr types.Address, count uint64) (start uint64, release func()) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.pendingState != nil {
+		start = pool.pendingState.GetNonce(addr)
+	}
+	ranges := pool.reserved[addr]
+	if n := len(ranges); n > 0 && ranges[n-1].end > start {
+		start = ranges[n-1].end
+	}
+	reservation := &nonceRange{start: start, end: start + count}
+	pool.reserved[addr] = append(ranges, reservation)
+
+	release = func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		reservation.released = true
+
+		// Drop all the trailing released reservations
+		ranges := pool.reserved[addr]
+		for len(ranges) > 0 && ranges[len(ranges)-1].released {
+			ranges = ranges[:len(ranges)-1]
+		}
+		if len(ranges) == 0 {
+			delete(pool.reserved, addr)
+		} else {
+			pool.reserved[addr] = ranges
+		}
+	}
+	return start, release
+}
+
+// SetAccountNonce advances the pending nonce of an account that moved on outside
+// of the usual chain head processing (e.g. during local block assembly), dropping
+// any transactions made obsolete by it. Nonces below the one in the current
+// state are ignored.
+func (pool *TxPool) SetAccountNonce(addr types.Address, nonce uint64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.pendingState == nil {
+		return
+	}
+	if current := pool.currentState.GetNonce(addr); nonce < current {
+		if logger.Level() <= log.LevelDebug {
+			logger.Debug("Ignoring nonce below current state", "account", addr, "nonce", nonce, "current", current)
+		}
+		return
+	}
+	// Drop all transactions rendered obsolete by the new nonce
+	if list := pool.pending[addr]; list != nil {
+		for _, tx := range list.Forward(nonce) {
+			hash := tx.Hash()
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Removed obsolete pending transaction hash:0x%x", hash)
+			}
+			pool.forgetMined(hash)
+		}
+		if list.Empty() {
+			delete(pool.pending, addr)
+			delete(pool.beats, addr)
+		}
+	}
+	if list := pool.queue[addr]; list != nil {
+		for _, tx := range list.Forward(nonce) {
+			hash := tx.Hash()
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Removed obsolete queued transaction hash:0x%x", hash)
+			}
+			pool.forgetMined(hash)
+		}
+		if list.Empty() {
+			delete(pool.queue, addr)
+		}
+	}
+	if pool.pendingState.GetNonce(addr) < nonce {
+		pool.pendingState.SetNonce(addr, nonce)
+	}
+	// Anything queued right at the new nonce may be executable now
+	pool.promoteExecutables([]types.Address{addr})
+}
+
+// Cancel atomically swaps the pending or queued transaction of an account at the
+// given nonce for a replacement from the same sender at the same nonce, usually
+// a zero value transfer to self, letting clients cancel a specific transaction.
+func (pool *TxPool) Cancel(addr types.Address, nonce uint64, replacement *transaction.Transaction) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if err := pool.accepting(); err != nil {
+		return err
+	}
+	// Make sure the replacement is valid and really matches the cancelled one
+	from, err := pool.validateTx(replacement, pool.locals.contains(addr))
+	if err != nil {
+		return err
+	}
+	if from != addr || replacement.Nonce() != nonce {
+		return ErrCancelMismatch
+	}
+	hash := replacement.Hash()
+	if pool.all[hash] != nil {
+		return fmt.Errorf("%w: 0x%x", ErrKnownTransaction, hash)
+	}
+	list, pending := pool.pending[addr], true
+	if list == nil || list.txs.Get(nonce) == nil {
+		list, pending = pool.queue[addr], false
+	}
+	if list == nil || list.txs.Get(nonce) == nil {
+		return ErrCancelUnknown
+	}
+	// Swap the transactions in the list and the lookup tables
+	old := list.Replace(replacement)
+	pool.forget(old.Hash(), dropCancelled)
+
+	pool.all[hash] = replacement
+	pool.markSeen(hash)
+	pool.journalTx(addr, replacement)
+	pool.flushJournal()
+	pool.audit.accepted(replacement, pool.tags[hash])
+
+	if logger.Level() <= log.LevelTrace {
+		logger.Tracef("Cancelled transaction hash:0x%x , replacement:0x%x", old.Hash(), hash)
+	}
+	go pool.replaceFeed.Send(core.TxReplaceEvent{Old: old, New: replacement})
+	if pending {
+		go pool.txFeed.Send(core.TxPreEvent{Tx: replacement})
+	}
+	return nil
+}
+
+// ReplaceAccountPending atomically swaps the pending transactions of an account
+// for the given set, which must be sent from the account and form a contiguous
+// nonce sequence starting at its current nonce. Queued transactions at nonces
+// covered by the new set are dropped, later ones stay queued. Each transaction
+// swapped for a different one at its nonce is announced as replaced. This lets outside
+// sources, e.g. a sequencer, rebuild the pending set of an account without the
+// pool passing through intermediate states.
+//
+// The whole set is validated first and if any transaction fails, nothing is
+// replaced. The returned errors are positional: nil entries are valid on their
+// own and only applied if all entries are nil.
+func (pool *TxPool) ReplaceAccountPending(addr types.Address, txs transaction.Transactions) []error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	errs := make([]error, len(txs))
+	if err := pool.accepting(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	// Validate the entire set before touching the pool
+	var (
+		local  = pool.locals.contains(addr)
+		nonce  = pool.currentState.GetNonce(addr)
+		failed = false
+	)
+	for i, tx := range txs {
+		from, err := pool.validateTx(tx, local)
+		switch {
+		case err != nil:
+		case from != addr:
+			err = ErrSenderMismatch
+		case tx.Nonce() != nonce+uint64(i):
+			err = ErrNonceGap
+		}
+		if err != nil {
+			errs[i], failed = err, true
+		}
+	}
+	if failed {
+		return errs
+	}
+	// Drop the old pending set and the queued transactions the new one covers,
+	// retaining the metadata of transactions that are part of both
+	keep := make(map[types.Hash]bool, len(txs))
+	for _, tx := range txs {
+		keep[tx.Hash()] = true
+	}
+	var replaced []core.TxReplaceEvent
+	if list := pool.pending[addr]; list != nil {
+		for _, tx := range list.Flatten() {
+			if !keep[tx.Hash()] {
+				pool.forget(tx.Hash(), dropSuperseded)
+				if n := tx.Nonce(); n >= nonce && n < nonce+uint64(len(txs)) {
+					replaced = append(replaced, core.TxReplaceEvent{Old: tx, New: txs[n-nonce]})
+				}
+			}
+		}
+		delete(pool.pending, addr)
+	}
+	if list := pool.queue[addr]; list != nil {
+		for _, tx := range txs {
+			if old := list.txs.Get(tx.Nonce()); old != nil {
+				list.Remove(old)
+				if !keep[old.Hash()] {
+					pool.forget(old.Hash(), dropSuperseded)
+					replaced = append(replaced, core.TxReplaceEvent{Old: old, New: tx})
+				}
+			}
+		}
+		if list.Empty() {
+			delete(pool.queue, addr)
+		}
+	}
+	// Install the new set and pull in anything queued right behind it
+	pool.pendingState.SetNonce(addr, nonce)
+	for _, tx := range txs {
+		hash := tx.Hash()
+		known := pool.all[hash] != nil
+
+		pool.promoteTx(addr, hash, tx)
+		if !known {
+			pool.journalTx(addr, tx)
+			pool.audit.accepted(tx, pool.tags[hash])
+		}
+	}
+	pool.flushJournal()
+	pool.promoteExecutables([]types.Address{addr})
+
+	if len(replaced) > 0 {
+		go func() {
+			for _, ev := range replaced {
+				pool.replaceFeed.Send(ev)
+			}
+		}()
+	}
+	return errs
+}
+
+// TransactionAt returns the transaction an account has in the pool at the given
+// nonce along with whether it is pending or queued. If there is none, nil and
+// TxStatusUnknown are returned.
+func (pool *TxPool) TransactionAt(addr types.Address, nonce uint64) (*transaction.Transaction, TxStatus) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	if list := pool.pending[addr]; list != nil {
+		if tx := list.txs.Get(nonce); tx != nil {
+			return tx, TxStatusPending
+		}
+	}
+	if list := pool.queue[addr]; list != nil {
+		if tx := list.txs.Get(nonce); tx != nil {
+			return tx, TxStatusQueued
+		}
+	}
+	return nil, TxStatusUnknown
+}
+
+// AccountSequence returns the sorted nonces of all the transactions the pool
+// holds for an account, pending and queued alike, letting clients spot the gaps
+// holding back a wallet's transactions.
+func (pool *TxPool) AccountSequence(addr types.Address) []uint64 {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	var nonces []uint64
+	if list := pool.pending[addr]; list != nil {
+		nonces = append(nonces, *list.txs.index...)
+	}
+	if list := pool.queue[addr]; list != nil {
+		nonces = append(nonces, *list.txs.index...)
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces
+}
+
+// ShrinkTo immediately drops non-local transactions, the longest known ones
+// first, until the pool holds at most maxTransactions. Local transactions are
+// never dropped, so the pool may remain above the target. It returns the number
+// of transactions dropped, including any dependents dropped along the way.
+func (pool *TxPool) ShrinkTo(maxTransactions int) int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(pool.all) <= maxTransactions {
+		return 0
+	}
+	var remotes []*transaction.Transaction
+	for _, tx := range pool.all {
+		if from, _ := transaction.Sender(pool.signer, tx); !pool.locals.contains(from) {
+			remotes = append(remotes, tx)
+		}
+	}
+	sort.Slice(remotes, func(i, j int) bool {
+		return pool.seen[remotes[i].Hash()].Before(pool.seen[remotes[j].Hash()])
+	})
+	before := len(pool.all)
+	for _, tx := range remotes {
+		if len(pool.all) <= maxTransactions {
+			break
+		}
+		// Skip dependents already dropped with an earlier removal
+		if pool.all[tx.Hash()] == nil || pool.spare(tx, dropEvicted) {
+			continue
+		}
+		pool.removeTx(tx.Hash(), dropEvicted)
+	}
+	return before - len(pool.all)
+}
+
+// PreviewPromotable returns the queued transactions of an account that the next
+// promotion would move to the pending set given the current state. The pool is
+// left untouched, the promotion steps run on a copy of the account's queue.
+func (pool *TxPool) PreviewPromotable(addr types.Address) transaction.Transactions {
+	// The nonce and balance lookups fill the state object cache, hence the write lock
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	queued := pool.queue[addr]
+	if queued == nil || pool.pendingState == nil {
+		return nil
+	}
+	list := newTxList(false)
+	for _, tx := range queued.Flatten() {
+		list.Add(tx, 0)
+	}
+	list.Forward(pool.currentState.GetNonce(addr))
+	list.Filter(pool.spendable(addr), 0)
+
+	return list.Ready(pool.pendingState.GetNonce(addr), 0)
+}
+
+// Prune sweeps every account in the pool, dropping all pending and queued
+// transactions with a nonce below the one in the current state. It returns the
+// number of transactions removed.
+func (pool *TxPool) Prune() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pruned := 0
+	if pool.pendingState == nil {
+		return pruned
+	}
+	for addr, list := range pool.pending {
+		for _, tx := range list.Forward(pool.currentState.GetNonce(addr)) {
+			hash := tx.Hash()
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Pruned old pending transaction hash:0x%x", hash)
+			}
+			pool.forgetMined(hash)
+			pruned++
+		}
+		if list.Empty() {
+			delete(pool.pending, addr)
+			delete(pool.beats, addr)
+		}
+	}
+	for addr, list := range pool.queue {
+		for _, tx := range list.Forward(pool.currentState.GetNonce(addr)) {
+			hash := tx.Hash()
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Pruned old queued transaction hash:0x%x", hash)
+			}
+			pool.forgetMined(hash)
+			pruned++
+		}
+		if list.Empty() {
+			delete(pool.queue, addr)
+		}
+	}
+	return pruned
+}
+
+// Stats retrieves the current pool stats, namely the number of pending and the
+// number of queued (non-executable) transactions.
+func (pool *TxPool) Stats() (int, int) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.stats()
+}
+
+// stats retrieves the current pool stats, namely the number of pending and the
+// number of queued (non-executable) transactions.
+func (pool *TxPool) stats() (int, int) {
+	pending := 0
+	for _, list := range pool.pending {
+		pending += list.Len()
+	}
+	queued := 0
+	for _, list := range pool.queue {
+		queued += list.Len()
+	}
+	return pending, queued
+}
+
+// Content retrieves the data content of the transaction pool, returning all the
+// pending as well as queued transactions, grouped by account and sorted by nonce.
+func (pool *TxPool) Content() (map[types.Address]transaction.Transactions, map[types.Address]transaction.Transactions) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	pending := make(map[types.Address]transaction.Transactions)
+	for addr, list := range pool.pending {
+		pending[addr] = list.Flatten()
+	}
+	queued := make(map[types.Address]transaction.Transactions)
+	for addr, list := range pool.queue {
+		queued[addr] = list.Flatten()
+	}
+	return pending, queued
+}
+
+// Inspect retrieves a displayable summary of the transaction pool contents, the
+// way the txpool_content RPC reports them: keyed by account, then by "pending"
+// or "queued", each bucket sorted by nonce.
+func (pool *TxPool) Inspect() map[string]map[string][]TxSummary {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	content := make(map[string]map[string][]TxSummary)
+	summarize := func(bucket string, lists map[types.Address]*txList) {
+		for addr, list := range lists {
+			txs := list.Flatten()
+			if len(txs) == 0 {
+				continue
+			}
+			account := addr.Hex()
+			if content[account] == nil {
+				content[account] = make(map[string][]TxSummary)
+			}
+			summaries := make([]TxSummary, len(txs))
+			for i, tx := range txs {
+				summaries[i] = TxSummary{
+					Nonce: tx.Nonce(),
+					Hash:  tx.Hash(),
+					From:  addr,
+					To:    tx.To(),
+					Value: tx.Value(),
+				}
+			}
+			content[account][bucket] = summaries
+		}
+	}
+	summarize("pending", pool.pending)
+	summarize("queued", pool.queue)
+
+	return content
+}
+
+// rejectionReasons maps the errors add refuses transactions with to the reasons
+// they are counted under in the rejection stats.
+var rejectionReasons = []struct {
+	err    error
+	reason string
+}{
+	{ErrKnownTransaction, "known"},
+	{ErrKnownMined, "known-mined"},
+	{ErrNonceOverlap, "nonce-overlap"},
+	{ErrOversizedData, "oversized"},
+	{ErrWrongTransactionAmount, "wrong-amount"},
+	{ErrNegativeValue, "negative-value"},
+	{ErrWrongChainID, "wrong-chain-id"},
+	{ErrUnsigned, "unsigned"},
+	{ErrBadSignature, "bad-signature"},
+	{ErrSenderNotWhitelisted, "not-whitelisted"},
+	{ErrAccountStateUnavailable, "no-state"},
+	{ErrNonceTooLow, "nonce-too-low"},
+	{ErrNoContractAtRecipient, "no-contract"},
+	{ErrInsufficientFunds, "insufficient-funds"},
+	{ErrTooManyAccounts, "too-many-accounts"},
+	{ErrPoolFull, "pool-full"},
+}
+
+// rejectionReason returns the reason a rejection error is counted under.
+func rejectionReason(err error) string {
+	for _, known := range rejectionReasons {
+		if errors.Is(err, known.err) {
+			return known.reason
+		}
+	}
+	return "other"
+}
+
+// RejectionStats retrieves the number of transactions the pool refused since it
+// was started, by rejection reason, e.g. "nonce-too-low" or "insufficient-funds".
+// Unlike the metrics it can be read in process, e.g. to back an admin RPC.
+func (pool *TxPool) RejectionStats() map[string]uint64 {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	stats := make(map[string]uint64, len(pool.rejections))
+	for reason, count := range pool.rejections {
+		stats[reason] = count
+	}
+	return stats
+}
+
+// RecipientCount is the number of pooled transactions sent to a single recipient.
+// A nil To groups all contract creations.
+type RecipientCount struct {
+	To    *types.Address
+	Count int
+}
+
+// RecipientRate retrieves the rate at which transactions sent to addr recently
+// entered the pool, in transactions per second, as an exponentially weighted
+// moving average over RecipientRateWindow. Unlike TopRecipients it surfaces a
+// sudden flood regardless of how many transactions already left the pool.
+func (pool *TxPool) RecipientRate(addr types.Address) float64 {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.recipients.rate(addr, time.Now())
+}
+
+// TopRecipients retrieves the n recipients with the most transactions in the
+// pool, counting both pending and queued ones, ordered by decreasing count.
+func (pool *TxPool) TopRecipients(n int) []RecipientCount {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	counts := make(map[types.Address]int)
+	creations := 0
+	for _, tx := range pool.all {
+		if to := tx.To(); to != nil {
+			counts[*to]++
+		} else {
+			creations++
+		}
+	}
+	recipients := make([]RecipientCount, 0, len(counts)+1)
+	for addr, count := range counts {
+		addr := addr
+		recipients = append(recipients, RecipientCount{To: &addr, Count: count})
+	}
+	if creations > 0 {
+		recipients = append(recipients, RecipientCount{Count: creations})
+	}
+	sort.Slice(recipients, func(i, j int) bool {
+		if recipients[i].Count != recipients[j].Count {
+			return recipients[i].Count > recipients[j].Count
+		}
+		// Break ties deterministically, creations last
+		if recipients[i].To == nil || recipients[j].To == nil {
+			return recipients[j].To == nil && recipients[i].To != nil
+		}
+		return bytes.Compare(recipients[i].To[:], recipients[j].To[:]) < 0
+	})
+	if n >= 0 && len(recipients) > n {
+		recipients = recipients[:n]
+	}
+	return recipients
+}
+
+// Pending retrieves all currently processable transactions, groupped by origin
+// account and sorted by nonce. The returned transaction set is a copy and can be
+// freely modified by calling code.
+func (pool *TxPool) Pending() (map[types.Address]transaction.Transactions, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pending := make(map[types.Address]transaction.Transactions)
+	for addr, list := range pool.pending {
+		pending[addr] = list.Flatten()
+	}
+	return pending, nil
+}
+
+// Executable retrieves the head of every account's pending transactions, the one
+// at the account's next nonce, which can be executed right away on top of the
+// current state. The rest of the pending set only becomes executable once the
+// heads are included, so producers needn't walk the full lists upfront.
+func (pool *TxPool) Executable() map[types.Address]transaction.Transactions {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	executable := make(map[types.Address]transaction.Transactions, len(pool.pending))
+	for addr, list := range pool.pending {
+		if list.Empty() {
+			continue
+		}
+		executable[addr] = transaction.Transactions{list.txs.Get((*list.txs.index)[0])}
+	}
+	return executable
+}
+
+// Drain retrieves all currently processable transactions, groupped by origin
+// account and sorted by nonce, and removes them from the pool in the same step,
+// so a sequencer building a block from the entire pending set never gets them
+// handed out twice. Queued transactions are left in place. The pending nonces
+// are kept, so queued transactions following the drained ones are promoted on
+// the next promotion as if the drained ones were still pending.
+func (pool *TxPool) Drain() map[types.Address]transaction.Transactions {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	drained := make(map[types.Address]transaction.Transactions, len(pool.pending))
+	for addr, list := range pool.pending {
+		txs := list.Flatten()
+		for _, tx := range txs {
+			pool.forget(tx.Hash(), dropDrained)
+		}
+		drained[addr] = txs
+		delete(pool.pending, addr)
+		if pool.queue[addr] == nil {
+			delete(pool.beats, addr)
+		}
+	}
+	// The pending snapshot holds the drained transactions, don't hand it out again
+	if pool.snapshot != nil {
+		pool.snapshot.invalidate()
+		pool.snapshot = nil
+	}
+	return drained
+}
+
+// PendingSnapshot retrieves a shared, immutable snapshot of all currently
+// processable transactions. The snapshot is flattened once and handed out to
+// every caller until the next pool reset, so block builders can query it many
+// times without repeating the work of Pending. Callers should Release it once
+// done.
+func (pool *TxPool) PendingSnapshot() *PendingSnapshot {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.snapshot == nil {
+		pool.snapshot = newPendingSnapshot(pool.pending)
+	}
+	return pool.snapshot.retain()
+}
+
+// IsLocal reports whether the given address is tracked as a local account,
+// exempt from the pool's eviction and pricing rules.
+func (pool *TxPool) IsLocal(addr types.Address) bool {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.locals.contains(addr)
+}
+
+// StuckTransactions retrieves the pending transactions first seen by the pool
+// longer ago than the given threshold, oldest first. Transactions staying
+// pending that long are likely stuck and worth alerting on.
+func (pool *TxPool) StuckTransactions(olderThan time.Duration) []*transaction.Transaction {
+	// Flattening fills the lists' caches, take the write lock like Pending
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var stuck []*transaction.Transaction
+	for _, list := range pool.pending {
+		for _, tx := range list.Flatten() {
+			if seen, ok := pool.seen[tx.Hash()]; ok && time.Since(seen) > olderThan {
+				stuck = append(stuck, tx)
+			}
+		}
+	}
+	sort.Slice(stuck, func(i, j int) bool {
+		return pool.seen[stuck[i].Hash()].Before(pool.seen[stuck[j].Hash()])
+	})
+	return stuck
+}
+
+// LocalTransactions retrieves a snapshot of all local transactions, grouped by
+// origin account and sorted by nonce. Unlike local it takes the pool lock itself
+// and the returned slices are copies, safe to use after further pool changes.
+func (pool *TxPool) LocalTransactions() map[types.Address]transaction.Transactions {
+	// Flattening fills the lists' caches, take the write lock like Pending
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.local()
+}
+
+// local retrieves all currently known local transactions, groupped by origin
+// account and sorted by nonce. The returned transaction set is a copy and can be
+// freely modified by calling code.
+func (pool *TxPool) local() map[types.Address]transaction.Transactions {
+	txs := make(map[types.Address]transaction.Transactions)
+	for addr := range pool.locals.accounts {
+		if pending := pool.pending[addr]; pending != nil {
+			txs[addr] = append(txs[addr], pending.Flatten()...)
+		}
+		if queued := pool.queue[addr]; queued != nil {
+			txs[addr] = append(txs[addr], queued.Flatten()...)
 		}
 	}
 	return txs
 }
 
 // validateTx checks whether a transaction is valid according to the consensus
-// rules and adheres to some heuristic limits of the local node .
-func (pool *TxPool) validateTx(tx *transaction.Transaction, local bool) error {
-	// Heuristic limit, reject transactions over 32KB to prevent DOS attacks
-	if tx.Size() > 32*1024 {
-		return ErrOversizedData
+// rules and adheres to some heuristic limits of the local node, returning its
+// sender if so.
+func (pool *TxPool) validateTx(tx *transaction.Transaction, local bool) (types.Address, error) {
+	return pool.validateTxAt(pool.currentState, tx, local)
+}
+
+// validateTxAt checks whether a transaction is valid like validateTx, but looks
+// up the account state in the given state database instead of the pool's.
+func (pool *TxPool) validateTxAt(statedb *state.StateDB, tx *transaction.Transaction, local bool) (types.Address, error) {
+	// Heuristic limit, reject oversized transactions to prevent DOS attacks.
+	// Contract creations legitimately carry large payloads and get more room
+	limit := pool.config.MaxTxSize
+	if tx.To() == nil {
+		limit = pool.config.MaxCreationSize
+	}
+	if uint64(tx.Size()) > limit {
+		return types.Address{}, ErrOversizedData
 	}
 	// Transactions can't be negative. This may never happen using MSGP decoded
 	// transactions but may occur if you create a transaction using the RPC.
 	if tx.Value() == nil {
-		logger.Errorf("!!!!!!!!!Tx.Amount == nil")
-		return ErrWrongTransactionAmount
+		return types.Address{}, ErrWrongTransactionAmount
 	}
 	if tx.Value().Sign() < 0 {
-		return ErrNegativeValue
+		return types.Address{}, ErrNegativeValue
 	}
 	// Make sure the transaction is signed properly
 	from, err := transaction.Sender(pool.signer, tx)
 	if err != nil {
-		logger.Error("Why invalidSender :",err)
-		return ErrInvalidSender
+		if logger.Level() <= log.LevelDebug {
+			logger.Debug("Failed to derive transaction sender", "err", err)
+		}
+		if err == transaction.ErrInvalidChainId {
+			wrongChainIdCounter.Inc(1)
+			return types.Address{}, ErrWrongChainID
+		}
+		if err == transaction.ErrUnsignedTransaction {
+			unsignedCounter.Inc(1)
+			return types.Address{}, ErrUnsigned
+		}
+		badSignatureCounter.Inc(1)
+		return types.Address{}, ErrBadSignature
+	}
+	if err := pool.validateState(statedb, tx, from, local); err != nil {
+		return types.Address{}, err
+	}
+	return from, nil
+}
+
+// validateReinjected checks whether a transaction dropped by a reorg may be put
+// back into the pool. These were validated moments ago, so if their sender is
+// still cached only the checks depending on the new state are rerun, skipping
+// the signature recovery and stateless sanity checks.
+func (pool *TxPool) validateReinjected(tx *transaction.Transaction) (types.Address, error) {
+	from, ok := transaction.CachedSender(pool.signer, tx)
+	if !ok {
+		return pool.validateTx(tx, false)
+	}
+	if err := pool.validateState(pool.currentState, tx, from, false); err != nil {
+		return types.Address{}, err
+	}
+	return from, nil
+}
+
+// validateState checks whether a transaction of an already verified sender is
+// acceptable against the given state and the pool's sender policy.
+func (pool *TxPool) validateState(statedb *state.StateDB, tx *transaction.Transaction, from types.Address, local bool) error {
+	// On permissioned deployments, only accept approved senders
+	if len(pool.config.SenderWhitelist) > 0 && !pool.config.SenderWhitelist[from] {
+		if !local || !pool.config.WhitelistBypassLocals {
+			return ErrSenderNotWhitelisted
+		}
+	}
+
+	// Don't validate against the empty account substituted for missing state
+	if err := statedb.AccountError(from); err != nil {
+		if logger.Level() <= log.LevelDebug {
+			logger.Debug("Failed to load sender state", "account", from, "err", err)
+		}
+		return ErrAccountStateUnavailable
+	}
+	// Ensure the transaction adheres to nonce ordering
+	if statedb.GetNonce(from) > tx.Nonce() {
+		return ErrNonceTooLow
+	}
+	// Calling an account without code always fails, refuse it if so configured
+	if pool.config.RequireContractCode && len(tx.Data.Payload) > 0 {
+		if to := tx.To(); to != nil && statedb.GetCodeSize(*to) == 0 {
+			return ErrNoContractAtRecipient
+		}
+	}
+	// Transactor should have enough funds to cover the costs
+	if have, need := pool.spendableOf(statedb.GetBalance(from)), tx.Cost(); have.Cmp(need) < 0 {
+		return &InsufficientFundsError{Have: have, Need: need}
+	}
+
+	return nil
+}
+
+// ValidateOnly runs the pool's validation rules against the given transaction
+// without inserting it, returning the same error a remote submission would get.
+func (pool *TxPool) ValidateOnly(tx *transaction.Transaction) error {
+	// State lookups fill the state object cache, so readers must not run concurrently
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.pendingState == nil {
+		return ErrPoolNotReady
+	}
+	_, err := pool.validateTx(tx, false)
+	return err
+}
+
+// simAccount is the view of a single account tracked while simulating a batch.
+type simAccount struct {
+	next    uint64 // Nonce which would be promoted to pending next
+	pending uint64 // Number of executable transactions of the account
+	queued  uint64 // Number of non-executable transactions of the account
+}
+
+// SimulateBatch reports for each of the given transactions whether the pool
+// would accept it if the batch was added in order, without modifying the pool.
+// Besides validation, the pool's capacity, account count and per account slot
+// limits are checked against the pool's contents plus the transactions of the
+// batch accepted before, so e.g. several transactions of a new account count
+// towards its allowance. A full pool evicting its oldest transactions is
+// assumed to always find one to make room with.
+func (pool *TxPool) SimulateBatch(txs []*transaction.Transaction) []error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	errs := make([]error, len(txs))
+	if err := pool.accepting(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	// Account lookups fill the state object cache, run them on a private copy
+	// so concurrent readers don't race on it
+	statedb := pool.currentState.Copy()
+
+	var (
+		accounts = make(map[types.Address]*simAccount)
+		known    = make(map[types.Hash]bool)
+		nonces   = make(map[types.Address]map[uint64]bool)
+
+		total   = uint64(len(pool.all))
+		pending uint64
+		tracked = pool.accounts()
+	)
+	for _, list := range pool.pending {
+		pending += uint64(list.Len())
+	}
+	for i, tx := range txs {
+		hash := tx.Hash()
+		if pool.all[hash] != nil || known[hash] {
+			errs[i] = fmt.Errorf("%w: 0x%x", ErrKnownTransaction, hash)
+			continue
+		}
+		if pool.mined.Contains(hash) {
+			errs[i] = ErrKnownMined
+			continue
+		}
+		from, err := pool.validateTxAt(statedb, tx, false)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		local := pool.locals.contains(from)
+
+		// Load the account the first time it's seen in the batch
+		account := accounts[from]
+		if account == nil {
+			if !pool.knownAccount(from) {
+				if pool.config.MaxAccounts > 0 && !local && tracked >= pool.config.MaxAccounts {
+					errs[i] = ErrTooManyAccounts
+					continue
+				}
+				tracked++
+			}
+			account = &simAccount{next: statedb.GetNonce(from)}
+			if list := pool.pending[from]; list != nil {
+				account.pending = uint64(list.Len())
+				account.next += account.pending
+			}
+			if list := pool.queue[from]; list != nil {
+				account.queued = uint64(list.Len())
+			}
+			accounts[from] = account
+			nonces[from] = make(map[uint64]bool)
+		}
+		// Transactions at an occupied nonce don't take up any more room
+		if nonces[from][tx.Nonce()] || pool.overlaps(from, tx) {
+			known[hash] = true
+			continue
+		}
+		if total >= pool.config.GlobalSlots+pool.config.GlobalQueue && pool.config.FullPoolPolicy != FullPoolEvictOldest {
+			errs[i] = ErrPoolFull
+			continue
+		}
+		// Check the allowance of the account the transaction would end up in
+		if tx.Nonce() == account.next {
+			if !local && pending >= pool.config.GlobalSlots && account.pending >= pool.accountSlots(from) {
+				errs[i] = ErrAccountLimit
+				continue
+			}
+			account.pending++
+			account.next++
+			pending++
+		} else {
+			if account.queued >= pool.accountQueue(from) {
+				errs[i] = ErrAccountLimit
+				continue
+			}
+			account.queued++
+		}
+		if pool.config.FullPoolPolicy != FullPoolEvictOldest || total < pool.config.GlobalSlots+pool.config.GlobalQueue {
+			total++
+		}
+		known[hash] = true
+		nonces[from][tx.Nonce()] = true
 	}
+	return errs
+}
 
-	// Ensure the transaction adheres to nonce ordering
-	if pool.currentState.GetNonce(from) > tx.Nonce() {
-		logger.Errorf("Account :%x , stateNonce:%d   tx.Nonce:%d" , from , pool.currentState.GetNonce(from) , tx.Nonce())
-		return ErrNonceTooLow
-	}
-	// Transactor should have enough funds to cover the costs
-	if pool.currentState.GetBalance(from).Cmp(tx.Cost()) < 0 {
-		logger.Error("[validateTx] insufficient funds Cost")
-		return ErrInsufficientFunds
+// overlaps reports whether a transaction occupies the same nonce as one already
+// pending or queued for its sender.
+func (pool *TxPool) overlaps(from types.Address, tx *transaction.Transaction) bool {
+	if list := pool.pending[from]; list != nil && list.Overlaps(tx) {
+		return true
 	}
+	list := pool.queue[from]
+	return list != nil && list.Overlaps(tx)
+}
 
-	return nil
+// spendable returns the balance of an account available to cover transaction
+// costs, that is its current balance less the configured buffer.
+func (pool *TxPool) spendable(addr types.Address) *big.Int {
+	return pool.spendableOf(pool.currentState.GetBalance(addr))
+}
+
+// spendableOf returns the part of a balance available to cover transaction
+// costs, that is the balance less the configured buffer.
+func (pool *TxPool) spendableOf(balance *big.Int) *big.Int {
+	if pool.config.BalanceBuffer == nil || pool.config.BalanceBuffer.Sign() <= 0 {
+		return balance
+	}
+	return new(big.Int).Sub(balance, pool.config.BalanceBuffer)
 }
 
 // add validates a transaction and inserts it into the non-executable queue for
-// later pending promotion and execution. If the transaction is a replacement for
-// an already pending or queued one, it overwrites the previous and returns this
-// so outer code doesn't uselessly call promote.
+// later pending promotion and execution. A transaction at the nonce of an already
+// pending or queued one is rejected with ErrNonceOverlap, the pooled one is kept.
 //
 // If a newly added transaction is marked as local, its sending account will be
-// whitelisted
-func (pool *TxPool) add(tx *transaction.Transaction, local bool) (bool, error) {
+// whitelisted. The sender of an accepted transaction is returned so callers
+// don't need to derive it again. Transactions reinjected after a reorg are only
+// revalidated against the new state if their sender is still cached.
+func (pool *TxPool) add(tx *transaction.Transaction, local, reinjected bool) (from types.Address, replaced bool, err error) {
+	defer func() {
+		switch {
+		case err != nil:
+			pool.audit.rejected(tx, err, pool.tags[tx.Hash()])
+			pool.rejections[rejectionReason(err)]++
+		case pool.all[tx.Hash()] == tx:
+			pool.audit.accepted(tx, pool.tags[tx.Hash()])
+			pool.mirrorTx(tx)
+			if to := tx.To(); to != nil {
+				pool.recipients.hit(*to, time.Now())
+			}
+		default:
+			pool.audit.dropped(tx, dropSuperseded, pool.tags[tx.Hash()]) // lost against a known transaction at the same nonce
+		}
+	}()
 	// If the transaction is already known, discard it
 	hash := tx.Hash()
-	if pool.all[hash] != nil {
-		logger.Tracef("Discarding already known transaction hash:0x%x",  hash)
-		return false, fmt.Errorf("known transaction: 0x%x", hash)
+	if known := pool.all[hash]; known != nil {
+		if !sameTransaction(known, tx) {
+			logger.Warn("Discarding transaction colliding with a known hash", "hash", hash)
+			hashCollisionCounter.Inc(1)
+		}
+		if logger.Level() <= log.LevelTrace {
+			logger.Tracef("Discarding already known transaction hash:0x%x", hash)
+		}
+		return types.Address{}, false, fmt.Errorf("%w: 0x%x", ErrKnownTransaction, hash)
+	}
+	// If the transaction was just mined, don't waste a signature recovery on it
+	if pool.mined.Contains(hash) {
+		if logger.Level() <= log.LevelTrace {
+			logger.Tracef("Discarding recently mined transaction hash:0x%x", hash)
+		}
+		return types.Address{}, false, ErrKnownMined
 	}
-	// If the transaction fails basic validation, discard it
-	if err := pool.validateTx(tx, local); err != nil {
-		logger.Trace("Discarding invalid transaction hash:0x%x , err:%s",  hash, err.Error())
+	// If the transaction fails basic validation, discard it. The sender derived
+	// here is threaded through the rest of the insertion
+	if reinjected {
+		from, err = pool.validateReinjected(tx)
+	} else {
+		from, err = pool.validateTx(tx, local)
+	}
+	if err != nil {
+		if logger.Level() <= log.LevelTrace {
+			logger.Tracef("Discarding invalid transaction hash:0x%x , err:%s", hash, err.Error())
+		}
 		invalidTxCounter.Inc(1)
-		return false, err
+		return types.Address{}, false, err
 	}
 
+	// If the sender is new, make sure the pool isn't tracking too many accounts
+	if pool.config.MaxAccounts > 0 && !local && !pool.locals.contains(from) && !pool.knownAccount(from) {
+		if pool.accounts() >= pool.config.MaxAccounts {
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Discarding transaction of new account hash:0x%x , from:0x%x", hash, from)
+			}
+			return types.Address{}, false, ErrTooManyAccounts
+		}
+	}
 	if uint64(len(pool.all)) >= pool.config.GlobalSlots+pool.config.GlobalQueue {
-		//do not add more transactions
-		return false,fmt.Errorf("pool.all > config.GlobalQueue")
+		//do not add more transactions, unless configured to make room
+		if pool.config.FullPoolPolicy != FullPoolEvictOldest || !pool.evictOldestQueued() {
+			return types.Address{}, false, ErrPoolFull
+		}
 	}
-	// If the transaction is replacing an already pending one, do directly
-	from, _ := transaction.Sender(pool.signer, tx) // already validated
+	// A transaction can't replace a pending one at the same nonce, there's no fee
+	// to outbid it with, so the known one is kept
 	if list := pool.pending[from]; list != nil && list.Overlaps(tx) {
-
-		_, old := list.Add(tx, 0)
-
-		// if old != nil,the tx has been here before
-		if old != nil {
-
-		}else{
-		//old == nil,mean here is no the transaction in the pool before
-			pool.all[tx.Hash()] = tx
-			pool.journalTx(from, tx)
-
-			logger.Trace("Pooled new executable transaction hash:0x%x , from:0x%x , to:0x%x", hash,  from,tx.To())
-
-			// We've directly injected a replacement transaction, notify subsystems
-			logger.Debugf("!!!!!!!!!!!add  From:%x  Nonce:%d" , from,tx.Data.AccountNonce)
-			go pool.txFeed.Send(core.TxPreEvent{tx})
-
+		if logger.Level() <= log.LevelTrace {
+			logger.Tracef("Discarding transaction overlapping a pending one hash:0x%x , from:0x%x , nonce:%d", hash, from, tx.Nonce())
 		}
-		fmt.Println("add return here 1....")
-		return true, nil
+		pendingDiscardCounter.Inc(1)
+		return types.Address{}, false, ErrNonceOverlap
+	}
+	// The same goes for queued transactions, e.g. ones demoted by a reorg. The
+	// known one is kept, so don't mark or journal the discarded newcomer
+	if list := pool.queue[from]; list != nil && list.Overlaps(tx) {
+		if logger.Level() <= log.LevelTrace {
+			logger.Tracef("Discarding transaction overlapping a queued one hash:0x%x , from:0x%x , nonce:%d", hash, from, tx.Nonce())
+		}
+		queuedDiscardCounter.Inc(1)
+		return types.Address{}, false, ErrNonceOverlap
 	}
 	// New transaction isn't replacing a pending one, push into queue
-	replace, err := pool.enqueueTx(hash, tx)
+	replace, err := pool.enqueueTx(from, hash, tx)
 	if err != nil {
-		return false, err
+		return types.Address{}, false, err
 	}
 	// Mark local addresses and journal local transactions
 	if local {
@@ -599,22 +2143,17 @@ func (pool *TxPool) add(tx *transaction.Transaction, local bool) (bool, error) {
 	}
 	pool.journalTx(from, tx)
 
-	logger.Tracef("Pooled new future transaction hash:0x%x  from:0x%x  to:0x%x",  hash,  from,  tx.To())
-	if replace {
-		fmt.Println("add--replace a old one")
-	}else{
-		//fmt.Println("add--a new one")
+	if logger.Level() <= log.LevelTrace {
+		logger.Tracef("Pooled new future transaction hash:0x%x , from:0x%x , to:%v , replace:%v", hash, from, tx.To(), replace)
 	}
-
-	return replace, nil
+	return from, replace, nil
 }
 
 // enqueueTx inserts a new transaction into the non-executable transaction queue.
 //
 // Note, this method assumes the pool lock is held!
-func (pool *TxPool) enqueueTx(hash types.Hash, tx *transaction.Transaction) (bool, error) {
+func (pool *TxPool) enqueueTx(from types.Address, hash types.Hash, tx *transaction.Transaction) (bool, error) {
 	// Try to insert the transaction into the future queue
-	from, _ := transaction.Sender(pool.signer, tx) // already validated
 	if pool.queue[from] == nil {
 		pool.queue[from] = newTxList(false)
 	}
@@ -629,19 +2168,206 @@ func (pool *TxPool) enqueueTx(hash types.Hash, tx *transaction.Transaction) (boo
 	//old == nil,no same tx before
 
 	pool.all[hash] = tx
+	pool.markSeen(hash)
+	pool.checkSaturation()
 	return false, nil
 }
 
+// markSeen records the current time as the arrival time of a transaction,
+// unless the pool already knows when it was first seen.
+func (pool *TxPool) markSeen(hash types.Hash) {
+	if _, ok := pool.seen[hash]; !ok {
+		pool.seen[hash] = time.Now()
+	}
+}
+
+// knownAccount reports whether the pool holds any transaction from addr.
+func (pool *TxPool) knownAccount(addr types.Address) bool {
+	return pool.pending[addr] != nil || pool.queue[addr] != nil
+}
+
+// accounts returns the number of distinct senders with transactions in the pool.
+func (pool *TxPool) accounts() uint64 {
+	count := uint64(len(pool.pending))
+	for addr := range pool.queue {
+		if pool.pending[addr] == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// evictOldestQueued drops the queued transaction of a non-local account that was
+// first seen the longest time ago, reporting whether anything was evicted.
+func (pool *TxPool) evictOldestQueued() bool {
+	var candidates []*transaction.Transaction
+	for addr, list := range pool.queue {
+		if pool.locals.contains(addr) {
+			continue
+		}
+		candidates = append(candidates, list.Flatten()...)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return pool.seen[candidates[i].Hash()].Before(pool.seen[candidates[j].Hash()])
+	})
+	for _, tx := range candidates {
+		if pool.spare(tx, dropEvicted) {
+			continue
+		}
+		if logger.Level() <= log.LevelTrace {
+			logger.Tracef("Evicting oldest queued transaction hash:0x%x", tx.Hash())
+		}
+		pool.removeTx(tx.Hash(), dropEvicted)
+		queuedDiscardCounter.Inc(1)
+		return true
+	}
+	return false
+}
+
+// spare consults the BeforeDrop hook about a transaction about to be evicted,
+// reporting whether it is spared from the current eviction pass. Once spared
+// BeforeDropRetain times, the hook is still notified but can't veto anymore.
+func (pool *TxPool) spare(tx *transaction.Transaction, reason string) bool {
+	if pool.config.BeforeDrop == nil || pool.config.BeforeDrop(tx, reason) {
+		return false
+	}
+	hash := tx.Hash()
+	if pool.spared[hash] >= pool.config.BeforeDropRetain {
+		return false
+	}
+	pool.spared[hash]++
+	sparedCounter.Inc(1)
+	return true
+}
+
+// sameTransaction reports whether two transactions sharing a hash also have the
+// same encoded content.
+func sameTransaction(a, b *transaction.Transaction) bool {
+	if a == b {
+		return true
+	}
+	encA, errA := a.MarshalMsg(nil)
+	encB, errB := b.MarshalMsg(nil)
+	return errA == nil && errB == nil && bytes.Equal(encA, encB)
+}
+
+// knownLocal reports whether the exact same transaction is already pooled from
+// a local account. Hash collisions and remote transactions don't count.
+func (pool *TxPool) knownLocal(tx *transaction.Transaction) bool {
+	known := pool.all[tx.Hash()]
+	if known == nil || !sameTransaction(known, tx) {
+		return false
+	}
+	from, err := transaction.Sender(pool.signer, known)
+	return err == nil && pool.locals.contains(from)
+}
+
+// forget drops a transaction from the pool's lookup tables, auditing the reason.
+// It does not touch the pending or queued lists, callers are expected to handle
+// those.
+func (pool *TxPool) forget(hash types.Hash, reason string) {
+	if tx := pool.all[hash]; tx != nil {
+		pool.audit.dropped(tx, reason, pool.tags[hash])
+	}
+	delete(pool.all, hash)
+	delete(pool.seen, hash)
+	delete(pool.tags, hash)
+	delete(pool.spared, hash)
+	pool.checkSaturation()
+}
+
+// checkSaturation notifies the saturation subscribers if the number of known
+// transactions crossed the watermark on the side opposite to the last report.
+func (pool *TxPool) checkSaturation() {
+	if pool.config.SaturationHigh == 0 {
+		return
+	}
+	capacity, count := float64(pool.config.GlobalSlots+pool.config.GlobalQueue), float64(len(pool.all))
+	switch {
+	case !pool.saturated && count >= pool.config.SaturationHigh*capacity:
+		pool.saturated = true
+	case pool.saturated && count < pool.config.SaturationLow*capacity:
+		pool.saturated = false
+	default:
+		return
+	}
+	go pool.saturationFeed.Send(pool.saturated)
+}
+
+// forgetMined removes a transaction that was dropped due to its nonce being
+// already used on chain, remembering its hash to reject re-announcements.
+func (pool *TxPool) forgetMined(hash types.Hash) {
+	pool.forget(hash, dropMined)
+	pool.mined.Add(hash, struct{}{})
+}
+
+// flushJournal writes the local transactions journaled so far out to disk. It
+// is called once a whole batch of transactions has been added.
+func (pool *TxPool) flushJournal() {
+	if pool.journal == nil || pool.journal.buffer == nil || pool.journalSuspended {
+		return
+	}
+	pool.journalWritten(pool.journal.flush(), "Failed to flush local tx journal")
+}
+
 // journalTx adds the specified transaction to the local disk journal if it is
 // deemed to have been sent from a local account.
 func (pool *TxPool) journalTx(from types.Address, tx *transaction.Transaction) {
 	// Only journal if it's enabled and the transaction is local
-	if pool.journal == nil || !pool.locals.contains(from) {
+	if pool.journal == nil || pool.journalSuspended || !pool.locals.contains(from) {
+		return
+	}
+	pool.journalWritten(pool.journal.insert(tx, from, pool.seen[tx.Hash()], pool.beats[from]), "Failed to journal local transaction")
+}
+
+// journalWritten tracks the outcome of a journal write. Once the configured
+// number of writes failed in a row, e.g. due to a full disk, journaling is
+// suspended until the journal is successfully rotated again, instead of every
+// local transaction warning about the same failure.
+func (pool *TxPool) journalWritten(err error, msg string) {
+	switch {
+	case err == nil:
+		pool.journalFailures = 0
+		return
+	case err == errNoActiveJournal:
+		// Nothing was written, the journal isn't open yet while loading it
+		logger.Warn(msg, "err", err)
+		return
+	}
+	pool.journalFailures++
+	if limit := pool.config.JournalFailures; limit > 0 && pool.journalFailures >= limit {
+		logger.Error("Suspending local transaction journal after repeated write failures", "failures", pool.journalFailures, "err", err)
+		journalSuspendCounter.Inc(1)
+		pool.journalSuspended = true
 		return
 	}
-	if err := pool.journal.insert(tx); err != nil {
-		logger.Warn("Failed to journal local transaction", "err", err)
+	logger.Warn(msg, "err", err)
+}
+
+// rotateJournal regenerates the journal from the local transactions currently
+// in the pool, resuming journaling if it was suspended.
+func (pool *TxPool) rotateJournal() error {
+	if err := pool.journal.rotate(pool.local(), pool.seen, pool.beats); err != nil {
+		return err
+	}
+	if pool.journalSuspended {
+		logger.Info("Resuming local transaction journal")
+	}
+	pool.journalFailures, pool.journalSuspended = 0, false
+	return nil
+}
+
+// RotateJournal regenerates the local transaction journal right away instead
+// of waiting for the next periodic rotation. If journaling was suspended due to
+// repeated write failures, a successful rotation resumes it.
+func (pool *TxPool) RotateJournal() error {
+	if pool.journal == nil {
+		return errNoActiveJournal
 	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.rotateJournal()
 }
 
 // promoteTx adds a transaction to the pending (processable) list of transactions.
@@ -657,7 +2383,7 @@ func (pool *TxPool) promoteTx(addr types.Address, hash types.Hash, tx *transacti
 	inserted, old := list.Add(tx, 0)
 	if !inserted {
 		// An older transaction was better, discard this
-		delete(pool.all, hash)
+		pool.forget(hash, dropSuperseded)
 
 		pendingDiscardCounter.Inc(1)
 		return
@@ -670,20 +2396,114 @@ func (pool *TxPool) promoteTx(addr types.Address, hash types.Hash, tx *transacti
 	// Failsafe to work around direct pending inserts (tests)
 	if pool.all[hash] == nil {
 		pool.all[hash] = tx
+		pool.markSeen(hash)
+		pool.checkSaturation()
 	}
 	// Set the potentially new pending nonce and notify any subsystems of the new tx
 	pool.beats[addr] = time.Now()
 	pool.pendingState.SetNonce(addr, tx.Nonce()+1)
-	logger.Debugf("!!!!!!!!!!!promoteTx From:%x  Nonce:%d" , addr,tx.Nonce())
+	if logger.Level() <= log.LevelTrace {
+		logger.Tracef("Promoted executable transaction from:0x%x , nonce:%d", addr, tx.Nonce())
+	}
 	go pool.txFeed.Send(core.TxPreEvent{tx})
 }
 
+// ForcePromote moves a queued transaction into the pending set regardless of any
+// nonce gap in front of it, so white-box tests can exercise the pending paths
+// without building contiguous nonce sequences. It leaves the pool in a state the
+// regular promotion never would and is only available if AllowForcePromote is
+// configured.
+func (pool *TxPool) ForcePromote(hash types.Hash) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if !pool.config.AllowForcePromote {
+		return ErrForcePromoteDisabled
+	}
+	tx := pool.all[hash]
+	if tx == nil {
+		return ErrNotQueued
+	}
+	from, _ := transaction.Sender(pool.signer, tx) // already validated
+	list := pool.queue[from]
+	if list == nil || list.txs.Get(tx.Nonce()) != tx {
+		return ErrNotQueued
+	}
+	list.Remove(tx)
+	if list.Empty() {
+		delete(pool.queue, from)
+	}
+	pool.promoteTx(from, hash, tx)
+	return nil
+}
+
 // AddLocal enqueues a single transaction into the pool if it is valid, marking
 // the sender as a local one in the mean time
 func (pool *TxPool) AddLocal(tx *transaction.Transaction) error {
 	return pool.addTx(tx, !pool.config.NoLocals)
 }
 
+// AddLocalTagged enqueues a single local transaction like AddLocal, attaching an
+// opaque tag to it, e.g. the batch it was submitted in. The tag is recorded with
+// the transaction's audit log events, including the one of it being mined or
+// dropped, and can be read back via Tag until the transaction leaves the pool.
+func (pool *TxPool) AddLocalTagged(tx *transaction.Transaction, tag string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	// Don't retag transactions already known, they're rejected anyway
+	hash := tx.Hash()
+	if tag == "" || pool.all[hash] != nil {
+		return pool.addTxLocked(tx, !pool.config.NoLocals)
+	}
+	pool.tags[hash] = tag
+	err := pool.addTxLocked(tx, !pool.config.NoLocals)
+	if pool.all[hash] != tx {
+		delete(pool.tags, hash) // rejected or superseded, nothing to clear it later
+	}
+	return err
+}
+
+// Tag returns the tag attached to a pooled transaction via AddLocalTagged, or
+// an empty string if it has none or isn't in the pool.
+func (pool *TxPool) Tag(hash types.Hash) string {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.tags[hash]
+}
+
+// addJournaled injects a local transaction loaded from the journal, restoring
+// the time it was first seen and its sender's heartbeat before the node was
+// restarted, so the eviction clocks keep running across restarts. The journaled
+// sender is trusted, as the node wrote it itself, sparing the startup ecrecover.
+func (pool *TxPool) addJournaled(tx *transaction.Transaction, from types.Address, seen, beat time.Time) error {
+	if from != (types.Address{}) {
+		transaction.SetSender(pool.signer, tx, from)
+	}
+	if err := pool.AddLocal(tx); err != nil {
+		return err
+	}
+	if seen.IsZero() && beat.IsZero() {
+		return nil
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.all[tx.Hash()] == nil {
+		return nil
+	}
+	if !seen.IsZero() {
+		pool.seen[tx.Hash()] = seen
+	}
+	if !beat.IsZero() {
+		if from, err := transaction.Sender(pool.signer, tx); err == nil {
+			pool.beats[from] = beat
+		}
+	}
+	return nil
+}
+
 // AddRemote enqueues a single transaction into the pool if it is valid.
 func (pool *TxPool) AddRemote(tx *transaction.Transaction) error {
 	return pool.addTx(tx, false)
@@ -694,24 +2514,127 @@ func (pool *TxPool) AddLocals(txs []*transaction.Transaction) []error {
 	return pool.addTxs(txs, !pool.config.NoLocals)
 }
 
+// AddLocalsFailFast enqueues a batch of local transactions, stopping at the first
+// one that is rejected and returning its error.
+//
+// Note, the batch is not applied atomically: transactions preceding the failed
+// one remain in the pool, while the ones following it are never attempted.
+func (pool *TxPool) AddLocalsFailFast(txs []*transaction.Transaction) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if err := pool.accepting(); err != nil {
+		return err
+	}
+	var (
+		dirty   []types.Address
+		failure error
+	)
+	for _, tx := range txs {
+		from, replace, err := pool.add(tx, !pool.config.NoLocals, false)
+		if err != nil {
+			failure = err
+			break
+		}
+		if !replace {
+			dirty = append(dirty, from)
+		}
+	}
+	pool.flushJournal()
+
+	// Promote whatever made it in before the failure
+	if len(dirty) > 0 {
+		pool.promoteExecutables(dirty)
+	}
+	return failure
+}
+
 // AddRemotes enqueues a batch of transactions into the pool if they are valid.
 func (pool *TxPool) AddRemotes(txs []*transaction.Transaction) []error {
 	return pool.addTxs(txs, false)
 }
 
+// reorgBusy reports whether a reset has been running for longer than remote
+// additions are configured to wait for, in which case they should be rejected
+// instead of piling up behind the pool lock. It doesn't take the lock itself.
+func (pool *TxPool) reorgBusy() bool {
+	if pool.config.ReorgRejectDelay <= 0 {
+		return false
+	}
+	start := atomic.LoadInt64(&pool.resetStart)
+	return start != 0 && time.Since(time.Unix(0, start)) > pool.config.ReorgRejectDelay
+}
+
+// accepting checks whether the pool currently admits new transactions, returning
+// the reason if it does not.
+func (pool *TxPool) accepting() error {
+	if pool.pendingState == nil {
+		return ErrPoolNotReady
+	}
+	if pool.paused {
+		return ErrPoolPaused
+	}
+	if !pool.synced {
+		return ErrPoolNotSynced
+	}
+	return nil
+}
+
 // addTx enqueues a single transaction into the pool if it is valid.
 func (pool *TxPool) addTx(tx *transaction.Transaction, local bool) error {
+	if !local && pool.reorgBusy() {
+		return ErrReorgInProgress
+	}
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
+	return pool.addTxLocked(tx, local)
+}
+
+// AddLocalTimeout enqueues a single local transaction like AddLocal, but gives up
+// with ErrPoolBusy if the pool lock can't be acquired within d, e.g. while a deep
+// reorg is being processed. This keeps RPC handlers responsive.
+func (pool *TxPool) AddLocalTimeout(tx *transaction.Transaction, d time.Duration) error {
+	if !pool.lockTimeout(d) {
+		return ErrPoolBusy
+	}
+	defer pool.mu.Unlock()
+
+	return pool.addTxLocked(tx, !pool.config.NoLocals)
+}
+
+// lockTimeout tries to acquire the pool lock until the deadline d expires,
+// reporting whether it succeeded.
+func (pool *TxPool) lockTimeout(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for !pool.mu.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(lockRetryDelay)
+	}
+	return true
+}
+
+// addTxLocked enqueues a single transaction into the pool if it is valid. The
+// pool lock must be held.
+func (pool *TxPool) addTxLocked(tx *transaction.Transaction, local bool) error {
+	if err := pool.accepting(); err != nil {
+		return err
+	}
+	// Local resubmissions of an identical local transaction are no-ops, so that
+	// clients retrying deliveries don't see spurious errors
+	if local && pool.knownLocal(tx) {
+		return nil
+	}
 	// Try to inject the transaction and update any state
-	replace, err := pool.add(tx, local)
+	from, replace, err := pool.add(tx, local, false)
+	pool.flushJournal()
 	if err != nil {
 		return err
 	}
 	// If we added a new transaction, run promotion checks and return
 	if !replace {
-		from, _ := transaction.Sender(pool.signer, tx) // already validated
 		pool.promoteExecutables([]types.Address{from})
 	}
 	return nil
@@ -719,32 +2642,77 @@ func (pool *TxPool) addTx(tx *transaction.Transaction, local bool) error {
 
 // addTxs attempts to queue a batch of transactions if they are valid.
 func (pool *TxPool) addTxs(txs []*transaction.Transaction, local bool) []error {
+	if !local && pool.reorgBusy() {
+		errs := make([]error, len(txs))
+		for i := range errs {
+			errs[i] = ErrReorgInProgress
+		}
+		return errs
+	}
+	// Recover the senders upfront so the ecrecovers don't run under the lock
+	pool.recoverSenders(txs)
+
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	return pool.addTxsLocked(txs, local)
+	if err := pool.accepting(); err != nil {
+		errs := make([]error, len(txs))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	return pool.addTxsLocked(txs, local, false)
+}
+
+// recoverSenders derives the senders of a batch of transactions concurrently
+// using up to SenderWorkers goroutines, populating the sender cache of each one.
+// Recovery failures are ignored here, they are reported by the validation.
+func (pool *TxPool) recoverSenders(txs []*transaction.Transaction) {
+	workers := pool.config.SenderWorkers
+	if workers > len(txs) {
+		workers = len(txs)
+	}
+	if workers <= 1 {
+		return
+	}
+	tasks := make(chan *transaction.Transaction, len(txs))
+	for _, tx := range txs {
+		tasks <- tx
+	}
+	close(tasks)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for tx := range tasks {
+				transaction.Sender(pool.signer, tx)
+			}
+		}()
+	}
+	wg.Wait()
 }
 
 // addTxsLocked attempts to queue a batch of transactions if they are valid,
 // whilst assuming the transaction pool lock is already held.
-func (pool *TxPool) addTxsLocked(txs []*transaction.Transaction, local bool) []error {
+func (pool *TxPool) addTxsLocked(txs []*transaction.Transaction, local, reinjected bool) []error {
 	// Add the batch of transaction, tracking the accepted ones
 	dirty := make(map[types.Address]struct{})
 	errs := make([]error, len(txs))
 
 	for i, tx := range txs {
 
-		var replace bool
-		if replace, errs[i] = pool.add(tx, local); errs[i] == nil {
+		from, replace, err := pool.add(tx, local, reinjected)
+		if errs[i] = err; err == nil {
 
 			if !replace {
-				from, _ := transaction.Sender(pool.signer, tx) // already validated
 				dirty[from] = struct{}{}
 			}
-		}else{
-			logger.Errorf("errs[%d]=%v" , i , errs[i])
 		}
 	}
+	pool.flushJournal()
 
 	// Only reprocess the internal state if something was actually added
 	if len(dirty) > 0 {
@@ -752,9 +2720,6 @@ func (pool *TxPool) addTxsLocked(txs []*transaction.Transaction, local bool) []e
 		for addr := range dirty {
 			addrs = append(addrs, addr)
 		}
-		_ , queLen := pool.stats()
-
-		logger.Infof("[addTxsLocked] Get:%d",queLen)
 		pool.promoteExecutables(addrs)
 	}
 
@@ -781,6 +2746,26 @@ func (pool *TxPool) Status(hashes []types.Hash) []TxStatus {
 	return status
 }
 
+// StatusDetailed returns the status of a batch of transactions like Status, also
+// looking up the ones unknown to the pool in the chain. Included transactions
+// are reported with the number of their block and their index within it.
+func (pool *TxPool) StatusDetailed(hashes []types.Hash) []TxStatusInfo {
+	status := pool.Status(hashes)
+
+	infos := make([]TxStatusInfo, len(hashes))
+	lookup, _ := pool.chain.(txLookup)
+	for i, hash := range hashes {
+		infos[i].Status = status[i]
+		if status[i] != TxStatusUnknown || lookup == nil {
+			continue
+		}
+		if blockHash, number, index := lookup.GetTxLookupEntry(hash); blockHash != (types.Hash{}) {
+			infos[i] = TxStatusInfo{Status: TxStatusIncluded, BlockNumber: &number, Index: &index}
+		}
+	}
+	return infos
+}
+
 // Get returns a transaction if it is contained in the pool
 // and nil otherwise.
 func (pool *TxPool) Get(hash types.Hash) *transaction.Transaction {
@@ -792,7 +2777,7 @@ func (pool *TxPool) Get(hash types.Hash) *transaction.Transaction {
 
 // removeTx removes a single transaction from the queue, moving all subsequent
 // transactions back to the future queue.
-func (pool *TxPool) removeTx(hash types.Hash) {
+func (pool *TxPool) removeTx(hash types.Hash, reason string) {
 	// Fetch the transaction we wish to delete
 	tx, ok := pool.all[hash]
 	if !ok {
@@ -801,7 +2786,7 @@ func (pool *TxPool) removeTx(hash types.Hash) {
 	addr, _ := transaction.Sender(pool.signer, tx) // already validated during insertion
 
 	// Remove it from the list of known transactions
-	delete(pool.all, hash)
+	pool.forget(hash, reason)
 
 	// Remove the transaction from the pending lists and reset the account nonce
 	if pending := pool.pending[addr]; pending != nil {
@@ -810,10 +2795,18 @@ func (pool *TxPool) removeTx(hash types.Hash) {
 			if pending.Empty() {
 				delete(pool.pending, addr)
 				delete(pool.beats, addr)
+			}
+			// The pool never queues a transaction at a pending nonce, so nothing can
+			// fill the freed one yet. Drop the stuck transactions if so configured,
+			// otherwise postpone them
+			if pool.config.DropDependents {
+				for _, tx := range invalids {
+					pool.forget(tx.Hash(), dropGap)
+				}
+				pendingGapCounter.Inc(int64(len(invalids)))
 			} else {
-				// Otherwise postpone any invalidated transactions
 				for _, tx := range invalids {
-					pool.enqueueTx(tx.Hash(), tx)
+					pool.enqueueTx(addr, tx.Hash(), tx)
 				}
 			}
 			// Update the account nonce if needed
@@ -842,6 +2835,8 @@ func (pool *TxPool) promoteExecutables(accounts []types.Address) {
 		for addr := range pool.queue {
 			accounts = append(accounts, addr)
 		}
+	} else {
+		accounts = uniqueAccounts(accounts)
 	}
 	// Iterate over all accounts and promote any executable transactions
 	for _, addr := range accounts {
@@ -849,61 +2844,84 @@ func (pool *TxPool) promoteExecutables(accounts []types.Address) {
 		if list == nil {
 			continue // Just in case someone calls with a non existing account
 		}
-		//fmt.Println("[promoteExecutables]List Len Before:Forward:" , len(list.txs.items))
+		// Drop the account if its state is unavailable, it can't be judged
+		if pool.dropMissingState(addr) {
+			continue
+		}
 		// Drop all transactions that are deemed too old (low nonce)
 		for _, tx := range list.Forward(pool.currentState.GetNonce(addr)) {
 			hash := tx.Hash()
 
-			logger.Tracef("Removed old queued transaction hash:0x%x",  hash)
-			delete(pool.all, hash)
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Removed old queued transaction hash:0x%x", hash)
+			}
+			pool.forgetMined(hash)
 		}
-		//fmt.Println("[promoteExecutables]List Len Before:Filter:" , len(list.txs.items))
 		// Drop all transactions that are too costly (low balance )
-		drops, _ := list.Filter(pool.currentState.GetBalance(addr), 0)
+		drops, _ := list.Filter(pool.spendable(addr), 0)
 		for _, tx := range drops {
 			hash := tx.Hash()
-			logger.Tracef("Removed unpayable queued transaction hash:0x%x", hash)
-			delete(pool.all, hash)
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Removed unpayable queued transaction hash:0x%x", hash)
+			}
+			pool.forget(hash, dropNoFunds)
 			queuedNofundsCounter.Inc(1)
 		}
-		//fmt.Println("[promoteExecutables]List Len Before:Ready:" , len(list.txs.items))
-		// Gather all executable transactions and promote them
-		for _, tx := range list.Ready(pool.pendingState.GetNonce(addr)) {
+		// Gather executable transactions and promote them, at most a batch per
+		// pass. The rest is deferred to a pass after the lock was released
+		limit := pool.config.PromoteBatchSize
+		ready := list.Ready(pool.pendingState.GetNonce(addr), limit)
+		for _, tx := range ready {
 			hash := tx.Hash()
-			logger.Trace("Promoting queued transaction hash:", hash.String())
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Promoting queued transaction hash:0x%x", hash)
+			}
 
 			pool.promoteTx(addr, hash, tx)
 		}
-		// Drop all transactions over the allowed limit
-		//fmt.Println("[promoteExecutables]List Len Before:Cap:" , len(list.txs.items))
+		deferred := limit > 0 && len(ready) == limit && list.txs.Get(pool.pendingState.GetNonce(addr)) != nil
+		if deferred {
+			pool.deferPromotion(addr)
+		}
+		// Drop all transactions over the allowed limit. The next batch of a
+		// deferred promotion is executable and only waits for the next pass, so
+		// it's spared, everything queued behind it counts against the allowance
 		if !pool.locals.contains(addr) {
-			for _, tx := range list.Cap(int(pool.config.AccountQueue)) {
+			allowance := int(pool.accountQueue(addr))
+			if deferred {
+				allowance += limit
+			}
+			for _, tx := range list.Cap(allowance) {
 				hash := tx.Hash()
-				delete(pool.all, hash)
+				pool.forget(hash, dropRateLimit)
 				queuedRateLimitCounter.Inc(1)
-				logger.Tracef("Removed cap-exceeding queued transaction hash:0x%x", hash)
+				if logger.Level() <= log.LevelTrace {
+					logger.Tracef("Removed cap-exceeding queued transaction hash:0x%x", hash)
+				}
 			}
 		}
 		// Delete the entire queue entry if it became empty.
 		if list.Empty() {
 			delete(pool.queue, addr)
 		}
-		//fmt.Println("[promoteExecutables]List Len AT Range End:" , len(list.txs.items))
 	}
 
+	// Tests may disable the global limits to assert exact pool contents
+	if pool.unlimited {
+		return
+	}
 	// If the pending limit is overflown, start equalizing allowances
 	pending := uint64(0)
 	for _, list := range pool.pending {
 		pending += uint64(list.Len())
 	}
-	//fmt.Println("[promoteExecutables]Pending+++ :" , pending)
 	if pending > pool.config.GlobalSlots {
 		pendingBeforeCap := pending
 		// Assemble a spam order to penalize large transactors first
 		spammers := prque.New()
 		for addr, list := range pool.pending {
 			// Only evict transactions from high rollers
-			if !pool.locals.contains(addr) && uint64(list.Len()) > pool.config.AccountSlots {
+			if !pool.locals.contains(addr) && uint64(list.Len()) > pool.accountSlots(addr) {
 				spammers.Push(addr, float32(list.Len()))
 			}
 		}
@@ -926,13 +2944,15 @@ func (pool *TxPool) promoteExecutables(accounts []types.Address) {
 						for _, tx := range list.Cap(list.Len() - 1) {
 							// Drop the transaction from the global pools too
 							hash := tx.Hash()
-							delete(pool.all, hash)
+							pool.forget(hash, dropRateLimit)
 
 							// Update the account nonce to the dropped transaction
 							if nonce := tx.Nonce(); pool.pendingState.GetNonce(offenders[i]) > nonce {
 								pool.pendingState.SetNonce(offenders[i], nonce)
 							}
-							logger.Trace("Removed fairness-exceeding pending transaction hash:0x%x", hash)
+							if logger.Level() <= log.LevelTrace {
+								logger.Tracef("Removed fairness-exceeding pending transaction hash:0x%x", hash)
+							}
 						}
 						pending--
 					}
@@ -941,19 +2961,25 @@ func (pool *TxPool) promoteExecutables(accounts []types.Address) {
 		}
 		// If still above threshold, reduce to limit or min allowance
 		if pending > pool.config.GlobalSlots && len(offenders) > 0 {
-			for pending > pool.config.GlobalSlots && uint64(pool.pending[offenders[len(offenders)-1]].Len()) > pool.config.AccountSlots {
+			last := offenders[len(offenders)-1]
+			for pending > pool.config.GlobalSlots && uint64(pool.pending[last].Len()) > pool.accountSlots(last) {
 				for _, addr := range offenders {
 					list := pool.pending[addr]
+					if uint64(list.Len()) <= pool.accountSlots(addr) {
+						continue
+					}
 					for _, tx := range list.Cap(list.Len() - 1) {
 						// Drop the transaction from the global pools too
 						hash := tx.Hash()
-						delete(pool.all, hash)
+						pool.forget(hash, dropRateLimit)
 
 						// Update the account nonce to the dropped transaction
 						if nonce := tx.Nonce(); pool.pendingState.GetNonce(addr) > nonce {
 							pool.pendingState.SetNonce(addr, nonce)
 						}
-						logger.Trace("Removed fairness-exceeding pending transaction hash:0x%x", hash)
+						if logger.Level() <= log.LevelTrace {
+							logger.Tracef("Removed fairness-exceeding pending transaction hash:0x%x", hash)
+						}
 					}
 					pending--
 				}
@@ -967,14 +2993,11 @@ func (pool *TxPool) promoteExecutables(accounts []types.Address) {
 	for _, list := range pool.queue {
 		queued += uint64(list.Len())
 	}
-
-	//fmt.Println("[promoteExecutables]Queued+++:" , queued , "  GlobalQueue:" , pool.config.GlobalQueue)
 	if queued > pool.config.GlobalQueue {
 		// Sort all accounts with queued transactions by heartbeat
 		addresses := make(addresssByHeartbeat, 0, len(pool.queue))
 		for addr := range pool.queue {
 			if !pool.locals.contains(addr) { // don't drop locals
-				logger.Info("[promoteExecutables]Beats :" , pool.beats[addr].String())
 				addresses = append(addresses, addressByHeartbeat{addr, pool.beats[addr]})
 			}
 		}
@@ -982,26 +3005,30 @@ func (pool *TxPool) promoteExecutables(accounts []types.Address) {
 
 		// Drop transactions until the total is below the limit or only locals remain
 		for drop := queued - pool.config.GlobalQueue; drop > 0 && len(addresses) > 0; {
-			logger.Info("[promoteExecutables]drop:",drop )
 			addr := addresses[len(addresses)-1]
 			list := pool.queue[addr.address]
 
 			addresses = addresses[:len(addresses)-1]
 
 			// Drop all transactions if they are less than the overflow
-			logger.Info("[promoteExecutables] Will Drop size:" , list.Len())
 			if size := uint64(list.Len()); size <= drop {
 				for _, tx := range list.Flatten() {
-					pool.removeTx(tx.Hash())
+					if pool.spare(tx, dropRateLimit) {
+						continue
+					}
+					pool.removeTx(tx.Hash(), dropRateLimit)
+					drop--
+					queuedRateLimitCounter.Inc(1)
 				}
-				drop -= size
-				queuedRateLimitCounter.Inc(int64(size))
 				continue
 			}
 			// Otherwise drop only last few transactions
 			txs := list.Flatten()
 			for i := len(txs) - 1; i >= 0 && drop > 0; i-- {
-				pool.removeTx(txs[i].Hash())
+				if pool.spare(txs[i], dropRateLimit) {
+					continue
+				}
+				pool.removeTx(txs[i].Hash(), dropRateLimit)
 				drop--
 				queuedRateLimitCounter.Inc(1)
 			}
@@ -1009,39 +3036,74 @@ func (pool *TxPool) promoteExecutables(accounts []types.Address) {
 	}
 }
 
+// uniqueAccounts returns the accounts with duplicates removed, keeping the order
+// of their first occurrence. The input slice is left untouched.
+func uniqueAccounts(accounts []types.Address) []types.Address {
+	seen := make(map[types.Address]struct{}, len(accounts))
+	unique := make([]types.Address, 0, len(accounts))
+	for _, addr := range accounts {
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		unique = append(unique, addr)
+	}
+	return unique
+}
+
 // demoteUnexecutables removes invalid and processed transactions from the pools
 // executable/pending queue and any subsequent transactions that become unexecutable
 // are moved back into the future queue.
 func (pool *TxPool) demoteUnexecutables() {
+	// Load the states of all pending accounts up front, concurrently if allowed
+	addrs := make([]types.Address, 0, len(pool.pending))
+	for addr := range pool.pending {
+		addrs = append(addrs, addr)
+	}
+	states := pool.loadAccountStates(addrs)
+
 	// Iterate over all accounts and demote any non-executable transactions
-	for addr, list := range pool.pending {
-		nonce := pool.currentState.GetNonce(addr)
+	for i, addr := range addrs {
+		list := pool.pending[addr]
+		if states[i].err != nil {
+			pool.dropAccount(addr, states[i].err)
+			continue
+		}
+		nonce := states[i].nonce
 
 		// Drop all transactions that are deemed too old (low nonce)
 		for _, tx := range list.Forward(nonce) {
 			hash := tx.Hash()
-			logger.Tracef("Removed old pending transaction hash:0x%x", hash)
-			delete(pool.all, hash)
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Removed old pending transaction hash:0x%x", hash)
+			}
+			pool.forgetMined(hash)
 		}
 		// Drop all transactions that are too costly (low balance ), and queue any invalids back for later
-		drops, invalids := list.Filter(pool.currentState.GetBalance(addr), 0)
+		drops, invalids := list.Filter(pool.spendableOf(states[i].balance), 0)
 		for _, tx := range drops {
 			hash := tx.Hash()
-			logger.Tracef("Removed unpayable pending transaction hash:0x%x", hash)
-			delete(pool.all, hash)
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Removed unpayable pending transaction hash:0x%x", hash)
+			}
+			pool.forget(hash, dropNoFunds)
 			pendingNofundsCounter.Inc(1)
 		}
 		for _, tx := range invalids {
 			hash := tx.Hash()
-			logger.Tracef("Demoting pending transaction  hash:0x%x", hash)
-			pool.enqueueTx(hash, tx)
+			if logger.Level() <= log.LevelTrace {
+				logger.Tracef("Demoting pending transaction  hash:0x%x", hash)
+			}
+			pool.enqueueTx(addr, hash, tx)
 		}
 		// If there's a gap in front, warn (should never happen) and postpone all transactions
 		if list.Len() > 0 && list.txs.Get(nonce) == nil {
 			for _, tx := range list.Cap(0) {
 				hash := tx.Hash()
-				logger.Errorf("Demoting invalidated transaction hash:0x%x", hash)
-				pool.enqueueTx(hash, tx)
+				if logger.Level() <= log.LevelTrace {
+					logger.Tracef("Demoting invalidated transaction hash:0x%x", hash)
+				}
+				pool.enqueueTx(addr, hash, tx)
 			}
 		}
 		// Delete the entire queue entry if it became empty.
@@ -1052,17 +3114,82 @@ func (pool *TxPool) demoteUnexecutables() {
 	}
 }
 
+// dropMissingState drops all transactions of an account whose state can't be
+// loaded, instead of judging them against an empty account. It reports whether
+// the account was dropped.
+func (pool *TxPool) dropMissingState(addr types.Address) bool {
+	err := pool.currentState.AccountError(addr)
+	if err == nil {
+		return false
+	}
+	pool.dropAccount(addr, err)
+	return true
+}
+
+// dropAccount drops all transactions of an account whose state failed to load
+// with the given error.
+func (pool *TxPool) dropAccount(addr types.Address, err error) {
+	logger.Warn("Dropping transactions of account with missing state", "account", addr, "err", err)
+	if list := pool.pending[addr]; list != nil {
+		for _, tx := range list.Flatten() {
+			pool.forget(tx.Hash(), dropNoState)
+		}
+		delete(pool.pending, addr)
+		delete(pool.beats, addr)
+	}
+	if list := pool.queue[addr]; list != nil {
+		for _, tx := range list.Flatten() {
+			pool.forget(tx.Hash(), dropNoState)
+		}
+		delete(pool.queue, addr)
+	}
+}
+
+// accountState is the chain state of an account its pooled transactions are
+// checked against.
+type accountState struct {
+	nonce   uint64   // Nonce of the account in the current state
+	balance *big.Int // Balance of the account in the current state
+	err     error    // Error if the account state couldn't be loaded
+}
+
+// loadAccountStates reads the states of the given accounts from the current
+// state. The accounts not cached yet are first resolved from the state trie on
+// up to DemoteWorkers goroutines, without copying the state, then read serially.
+func (pool *TxPool) loadAccountStates(addrs []types.Address) []accountState {
+	if workers := pool.config.DemoteWorkers; workers > 1 {
+		pool.currentState.Prefetch(addrs, workers)
+	}
+	states := make([]accountState, len(addrs))
+	for i, addr := range addrs {
+		if err := pool.currentState.AccountError(addr); err != nil {
+			states[i].err = err
+			continue
+		}
+		states[i].nonce = pool.currentState.GetNonce(addr)
+		states[i].balance = pool.currentState.GetBalance(addr)
+	}
+	return states
+}
+
 // addressByHeartbeat is an account address tagged with its last activity timestamp.
 type addressByHeartbeat struct {
 	address   types.Address
 	heartbeat time.Time
 }
 
+// addresssByHeartbeat sorts accounts by their last activity, ties broken by the
+// address bytes so the eviction order is reproducible.
 type addresssByHeartbeat []addressByHeartbeat
 
-func (a addresssByHeartbeat) Len() int           { return len(a) }
-func (a addresssByHeartbeat) Less(i, j int) bool { return a[i].heartbeat.Before(a[j].heartbeat) }
-func (a addresssByHeartbeat) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a addresssByHeartbeat) Len() int { return len(a) }
+func (a addresssByHeartbeat) Less(i, j int) bool {
+	if !a[i].heartbeat.Equal(a[j].heartbeat) {
+		return a[i].heartbeat.Before(a[j].heartbeat)
+	}
+	return bytes.Compare(a[i].address[:], a[j].address[:]) < 0
+}
+func (a addresssByHeartbeat) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
 // accountSet is simply a set of addresses to check for existence, and a signer
 // capable of deriving addresses from transactions.
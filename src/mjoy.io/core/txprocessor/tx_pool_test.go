@@ -21,6 +21,10 @@
 package txprocessor
 
 import (
+	"bufio"
+	"bytes"
+	"sync"
+	"sync/atomic"
 	"mjoy.io/core/state"
 	"mjoy.io/utils/event"
 	"mjoy.io/core/blockchain/block"
@@ -32,10 +36,20 @@ import (
 	"mjoy.io/utils/database"
 	"mjoy.io/utils/crypto"
 	"mjoy.io/params"
+	"mjoy.io/utils/metrics"
 	"fmt"
 	"time"
 	"testing"
 	"math/rand"
+	"errors"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"runtime"
+	"os"
+	"github.com/tinylib/msgp/msgp"
 )
 
 // Tests that transactions can be added to strict lists and list contents and
@@ -93,12 +107,16 @@ var (
 
 )
 func setupTxPool()(*TxPool , *ecdsa.PrivateKey){
+	return setupTxPoolWithConfig(testTxPoolConfig)
+}
+
+func setupTxPoolWithConfig(config TxPoolConfig)(*TxPool , *ecdsa.PrivateKey){
 	db,_:=database.OpenMemDB()
 	statedb ,_ := state.New(types.Hash{},state.NewDatabase(db))
 	blockchain := &testBlockChain{statedb  , new(event.Feed)}
 
 	key,_ := crypto.GenerateKey()
-	pool := NewTxPool(testTxPoolConfig , TestChainConfig , blockchain)
+	pool := NewTxPool(config , TestChainConfig , blockchain)
 
 	return pool,key
 
@@ -264,7 +282,7 @@ func TestTransactionQueue(t *testing.T){
 
 	pool.currentState.AddBalance(from,big.NewInt(1000))
 	pool.lockedReset(nil,nil)
-	pool.enqueueTx(tx.Hash() , tx)
+	pool.enqueueTx(from, tx.Hash() , tx)
 
 	pool.promoteExecutables([]types.Address{from})
 
@@ -277,7 +295,7 @@ func TestTransactionQueue(t *testing.T){
 
 	pool.currentState.SetNonce(from,2)
 
-	_, err :=pool.enqueueTx(tx.Hash() , tx)
+	_, err :=pool.enqueueTx(from, tx.Hash() , tx)
 	if err != nil{
 		fmt.Println("EnqueueTx:" , err)
 	}
@@ -306,9 +324,9 @@ func TestTransactionQueue(t *testing.T){
 	pool.lockedReset(nil, nil)
 
 	fmt.Println("QueueLen before = " , len(pool.queue))
-	pool.enqueueTx(tx1.Hash() , tx1)
-	pool.enqueueTx(tx2.Hash() , tx2)
-	pool.enqueueTx(tx3.Hash() , tx3)
+	pool.enqueueTx(from, tx1.Hash() , tx1)
+	pool.enqueueTx(from, tx2.Hash() , tx2)
+	pool.enqueueTx(from, tx3.Hash() , tx3)
 	fmt.Println("QueueLen after = " , len(pool.queue[from].txs.items))
 
 	pool.promoteExecutables([]types.Address{from})
@@ -354,13 +372,13 @@ func TestTransactionChainFork(t *testing.T){
 	resetState()
 
 	tx := xtransaction(0 , 0 , key)
-	if _,err := pool.add(tx , false);err!= nil{
+	if _, _,err := pool.add(tx, false, false);err!= nil{
 		fmt.Println("didn't expect error:" , err)
 	}
 
 	fmt.Println("pending Len:" , len(pool.pending))
 	fmt.Println("queue Len:" , len(pool.queue))
-	pool.removeTx(tx.Hash())
+	pool.removeTx(tx.Hash(), dropEvicted)
 
 	//reset the pool's internal state
 	resetState()
@@ -368,7 +386,7 @@ func TestTransactionChainFork(t *testing.T){
 	fmt.Println("pending Len:" , len(pool.pending))
 	fmt.Println("queue Len:" , len(pool.queue))
 
-	if _ , err := pool.add(tx , false);err != nil{
+	if _, _ , err := pool.add(tx, false, false);err != nil{
 		fmt.Println("didn't expect error:",err)
 	}
 	fmt.Println("pending Len:" , len(pool.pending))
@@ -402,11 +420,11 @@ func TestTransactionDoubleNonce(t *testing.T) {
 	tx2,_:=transaction.SignTx(transaction.NewTransaction(0,types.Address{},big.NewInt(100),0,big.NewInt(0),nil),mSigner,key)
 	tx3,_:=transaction.SignTx(transaction.NewTransaction(0,types.Address{},big.NewInt(100),0,big.NewInt(0),nil),mSigner,key)
 
-	if replace,err:=pool.add(tx1,false);err != nil || replace{
+	if _, replace,err:=pool.add(tx1, false, false);err != nil || replace{
 		fmt.Printf("Error:first transaction\n ")
 	}
 
-	if replace,err := pool.add(tx2,false);err != nil || !replace{
+	if _, replace,err := pool.add(tx2, false, false);err != nil || !replace{
 		fmt.Printf("Error:second transaction insert failed (%v) or not reported replacement (%v)\n",err, replace)
 	}
 
@@ -416,7 +434,7 @@ func TestTransactionDoubleNonce(t *testing.T) {
 		fmt.Printf("Error:transaction mismatch:have %x , wat %x\n",tx.Hash() , tx2.Hash())
 	}
 
-	pool.add(tx3 , false)
+	pool.add(tx3, false, false)
 
 	pool.promoteExecutables([]types.Address{addr})
 
@@ -448,7 +466,7 @@ func TestTransactionMissingNonce(t *testing.T){
 	pool.currentState.AddBalance(addr , big.NewInt(100000000000000))
 
 	tx := xtransaction(1 ,0, key)
-	if _,err := pool.add(tx , false);err != nil{
+	if _, _,err := pool.add(tx, false, false);err != nil{
 		fmt.Printf("didn't expect error:%v",err)
 	}
 
@@ -490,9 +508,9 @@ func TestTransactionDroppng(t *testing.T){
 	pool.promoteTx(account , tx1.Hash() ,tx1)
 	pool.promoteTx(account , tx2.Hash() , tx2)
 
-	pool.enqueueTx(tx10.Hash() , tx10)
-	pool.enqueueTx(tx11.Hash() , tx11)
-	pool.enqueueTx(tx12.Hash() , tx12)
+	pool.enqueueTx(account, tx10.Hash() , tx10)
+	pool.enqueueTx(account, tx11.Hash() , tx11)
+	pool.enqueueTx(account, tx12.Hash() , tx12)
 
 	if pool.pending[account].Len() != 3{
 		t.Errorf("pending transaction mismatch:have %d ,want %d" , pool.pending[account].Len(), 3)
@@ -574,15 +592,15 @@ func TestPendingState(t *testing.T){
 		tx1 = newxtransaction(1 , 200 , key)
 		tx2 = newxtransaction(2 , 300 , key)
 	)
-	pool.enqueueTx(tx1.Hash(),tx1)
+	pool.enqueueTx(account, tx1.Hash(),tx1)
 	pool.promoteExecutables([]types.Address{account})
 	fmt.Println("pendingState:" , pool.pendingState.GetNonce(account))
 
-	pool.enqueueTx(tx0.Hash(),tx0)
+	pool.enqueueTx(account, tx0.Hash(),tx0)
 	pool.promoteExecutables([]types.Address{account})
 	fmt.Println("pendingState:" , pool.pendingState.GetNonce(account))
 
-	pool.enqueueTx(tx2.Hash(),tx2)
+	pool.enqueueTx(account, tx2.Hash(),tx2)
 	pool.promoteExecutables([]types.Address{account})
 	fmt.Println("pendingState:" , pool.pendingState.GetNonce(account))
 
@@ -926,86 +944,3543 @@ func testTransactionQueueGlobalLimiting(t *testing.T , nolocals bool) {
 
 }
 
+// Tests that ValidateOnly reports the same rejection as a real submission for
+// every validation rule, without inserting anything into the pool.
+func TestValidateOnly(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000))
+	pool.currentState.SetNonce(from, 1)
+
+	oversized, _ := transaction.SignTx(transaction.NewTransaction(1, types.Address{}, big.NewInt(100), 0, big.NewInt(0), make([]byte, 33*1024)), mSigner, key)
+
+	noAmount := newxtransaction(1, 100, key)
+	noAmount.Data.Amount = nil
+
+	negative := newxtransaction(1, -1, key)
+
+	foreign, _ := transaction.SignTx(transaction.NewTransaction(1, types.Address{}, big.NewInt(100), 0, big.NewInt(0), nil), transaction.NewMSigner(big.NewInt(2)), key)
+
+	tests := []struct {
+		tx  *transaction.Transaction
+		err error
+	}{
+		{oversized, ErrOversizedData},
+		{noAmount, ErrWrongTransactionAmount},
+		{negative, ErrNegativeValue},
+		{foreign, ErrWrongChainID},
+		{newxtransaction(0, 100, key), ErrNonceTooLow},
+		{newxtransaction(1, 1001, key), ErrInsufficientFunds},
+		{newxtransaction(1, 100, key), nil},
+	}
+	for i, tt := range tests {
+		if err := pool.ValidateOnly(tt.tx); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: validation error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	if pending, queued := pool.Stats(); pending != 0 || queued != 0 {
+		t.Errorf("pool mutated by validation: have %d pending, %d queued", pending, queued)
+	}
+	if len(pool.all) != 0 {
+		t.Errorf("pool mutated by validation: have %d known transactions", len(pool.all))
+	}
+}
+
+// Tests that a paused pool rejects new transactions and accepts them again
+// once resumed.
+func TestTransactionPoolPauseResume(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000))
+
+	pool.Pause()
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err != ErrPoolPaused {
+		t.Fatalf("single add error mismatch: have %v, want %v", err, ErrPoolPaused)
+	}
+	for i, err := range pool.AddRemotes(transaction.Transactions{newxtransaction(1, 100, key), newxtransaction(2, 100, key)}) {
+		if err != ErrPoolPaused {
+			t.Fatalf("batch add %d error mismatch: have %v, want %v", i, err, ErrPoolPaused)
+		}
+	}
+	if pending, queued := pool.Stats(); pending != 0 || queued != 0 {
+		t.Fatalf("paused pool accepted transactions: have %d pending, %d queued", pending, queued)
+	}
+	pool.Resume()
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction after resume: %v", err)
+	}
+	if pending, _ := pool.Stats(); pending != 1 {
+		t.Fatalf("pending transactions mismatched: have %d, want %d", pending, 1)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that a paused pool suspends deferred promotion passes and that resuming
+// it promotes the deferred transactions.
+func TestTransactionPoolPauseDeferred(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.PromoteBatchSize = 2
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	// Queue up an executable sequence while paused and promote a first batch
+	const count = 6
+	pool.Pause()
+	pool.mu.Lock()
+	for i := uint64(0); i < count; i++ {
+		tx := newxtransaction(i, 100, key)
+		if _, err := pool.enqueueTx(from, tx.Hash(), tx); err != nil {
+			pool.mu.Unlock()
+			t.Fatalf("transaction %d: failed to enqueue: %v", i, err)
+		}
+	}
+	pool.promoteExecutables([]types.Address{from})
+	pool.mu.Unlock()
+
+	// Give the loop a chance to run the deferred passes, it mustn't
+	time.Sleep(100 * time.Millisecond)
+	if pending, queued := pool.Stats(); pending != config.PromoteBatchSize || queued != count-config.PromoteBatchSize {
+		t.Fatalf("paused pool promoted deferred transactions: have %d pending, %d queued", pending, queued)
+	}
+	// Resume the pool and wait for the deferred passes to promote the rest
+	pool.Resume()
+	for deadline := time.Now().Add(time.Second); ; {
+		pending, _ := pool.Stats()
+		if pending == count {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deferred promotions stalled after resume: have %d pending, want %d", pending, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that a configured balance buffer keeps transactions which would drain
+// the account exactly out of both the validation and the promotion paths.
+func TestTransactionBalanceBuffer(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.BalanceBuffer = big.NewInt(50)
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	// An account holding exactly the cost is rejected and never promoted
+	pool.currentState.SetBalance(from, big.NewInt(100))
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("exact balance add error mismatch: have %v, want %v", err, ErrInsufficientFunds)
+	}
+	tx := newxtransaction(0, 100, key)
+	pool.enqueueTx(from, tx.Hash(), tx)
+	pool.promoteExecutables([]types.Address{from})
+	if pending, queued := pool.stats(); pending != 0 || queued != 0 {
+		t.Fatalf("exact balance transaction retained: have %d pending, %d queued", pending, queued)
+	}
+	// An account holding the cost plus the buffer is accepted and promoted
+	pool.currentState.SetBalance(from, big.NewInt(150))
+	if err := pool.AddRemote(tx); err != nil {
+		t.Fatalf("buffered balance add failed: %v", err)
+	}
+	if pending, _ := pool.stats(); pending != 1 {
+		t.Fatalf("pending transactions mismatched: have %d, want %d", pending, 1)
+	}
+	// Dropping the balance under the buffer demotes the transaction on reset
+	pool.currentState.SetBalance(from, big.NewInt(149))
+	pool.lockedReset(nil, nil)
+	if pending, queued := pool.stats(); pending != 0 || queued != 0 {
+		t.Fatalf("underfunded transaction retained: have %d pending, %d queued", pending, queued)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that the pooled transactions are counted per recipient and ranked by
+// decreasing popularity.
+func TestTransactionTopRecipients(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	recipients := []types.Address{{0x01}, {0x02}, {0x03}}
+	counts := []int{2, 3, 1}
+
+	nonce := uint64(0)
+	for i, to := range recipients {
+		for j := 0; j < counts[i]; j++ {
+			tx, _ := transaction.SignTx(transaction.NewTransaction(nonce, to, big.NewInt(100), 0, big.NewInt(0), nil), mSigner, key)
+			if err := pool.AddRemote(tx); err != nil {
+				t.Fatalf("failed to add transaction %d: %v", nonce, err)
+			}
+			nonce++
+		}
+	}
+	// Leave a gap so some of the transactions stay queued
+	creation, _ := transaction.SignTx(transaction.NewContractCreation(nonce+1, big.NewInt(100), 0, big.NewInt(0), nil), mSigner, key)
+	if err := pool.AddRemote(creation); err != nil {
+		t.Fatalf("failed to add contract creation: %v", err)
+	}
+	top := pool.TopRecipients(3)
+	if len(top) != 3 {
+		t.Fatalf("recipient count mismatch: have %d, want %d", len(top), 3)
+	}
+	want := []RecipientCount{{&recipients[1], 3}, {&recipients[0], 2}, {&recipients[2], 1}}
+	for i := range want {
+		if top[i].To == nil || *top[i].To != *want[i].To || top[i].Count != want[i].Count {
+			t.Errorf("rank %d: mismatch: have %v/%d, want %x/%d", i, top[i].To, top[i].Count, *want[i].To, want[i].Count)
+		}
+	}
+	all := pool.TopRecipients(10)
+	if len(all) != 4 {
+		t.Fatalf("recipient count mismatch: have %d, want %d", len(all), 4)
+	}
+	if last := all[3]; last.To != nil || last.Count != 1 {
+		t.Errorf("contract creations mismatch: have %v/%d, want nil/1", last.To, last.Count)
+	}
+}
+
+// Tests that a fail-fast local batch stops at the first rejected transaction,
+// keeping the ones before it and never attempting the ones after.
+func TestTransactionAddLocalsFailFast(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000))
+
+	txs := transaction.Transactions{
+		newxtransaction(0, 100, key),
+		newxtransaction(1, -1, key),
+		newxtransaction(2, 100, key),
+	}
+	if err := pool.AddLocalsFailFast(txs); err != ErrNegativeValue {
+		t.Fatalf("batch error mismatch: have %v, want %v", err, ErrNegativeValue)
+	}
+	if pool.Get(txs[0].Hash()) == nil {
+		t.Errorf("transaction preceding the failure missing from pool")
+	}
+	if pool.Get(txs[2].Hash()) != nil {
+		t.Errorf("transaction following the failure present in pool")
+	}
+	if pending, queued := pool.Stats(); pending != 1 || queued != 0 {
+		t.Errorf("pool size mismatch: have %d pending, %d queued, want 1/0", pending, queued)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// flakyBlockChain is a test chain whose state retrieval fails a given number of
+// times before succeeding. The failure budget is guarded, as the pool's loop may
+// retrieve the state while a test adjusts it.
+type flakyBlockChain struct {
+	*testBlockChain
+	lock     sync.Mutex
+	failures int
+}
+
+func (bc *flakyBlockChain) StateAt(hash types.Hash) (*state.StateDB, error) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	if bc.failures > 0 {
+		bc.failures--
+		return nil, errors.New("state unavailable")
+	}
+	return bc.testBlockChain.StateAt(hash)
+}
+
+// setFailures sets the number of upcoming state retrievals to fail.
+func (bc *flakyBlockChain) setFailures(failures int) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 
+	bc.failures = failures
+}
+
+// failuresLeft returns the number of upcoming state retrievals still failing.
+func (bc *flakyBlockChain) failuresLeft() int {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 
+	return bc.failures
+}
 
+// Tests that transient state retrieval failures during a reset are retried, and
+// that persistent ones make the pool reject transactions instead of validating
+// them against stale state.
+func TestTransactionResetStateRetry(t *testing.T) {
+	t.Parallel()
 
+	// Create the flaky chain upfront, swapping it in under the running loop races
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	chain := &flakyBlockChain{testBlockChain: &testBlockChain{statedb, new(event.Feed)}}
 
+	pool := NewTxPool(testTxPoolConfig, TestChainConfig, chain)
+	defer pool.Stop()
 
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	statedb.AddBalance(from, big.NewInt(1000))
 
+	chain.setFailures(stateRetries - 1)
+	pool.lockedReset(nil, nil)
+	if left := chain.failuresLeft(); left != 0 {
+		t.Fatalf("state retrieval not retried: %d failures left", left)
+	}
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction after recovered reset: %v", err)
+	}
+	chain.setFailures(stateRetries)
+	pool.lockedReset(nil, nil)
+	if err := pool.AddRemote(newxtransaction(1, 100, key)); err != ErrPoolNotSynced {
+		t.Fatalf("add error mismatch after failed reset: have %v, want %v", err, ErrPoolNotSynced)
+	}
+	pool.lockedReset(nil, nil)
+	if err := pool.AddRemote(newxtransaction(1, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction after resync: %v", err)
+	}
+}
 
+// Tests that a pool whose initial state retrieval fails rejects every operation
+// needing the state instead of panicking, and comes up once a reset succeeds.
+func TestTransactionPoolNotReady(t *testing.T) {
+	t.Parallel()
 
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	chain := &flakyBlockChain{testBlockChain: &testBlockChain{statedb, new(event.Feed)}, failures: stateRetries}
 
+	pool := NewTxPool(testTxPoolConfig, TestChainConfig, chain)
+	defer pool.Stop()
 
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	statedb.AddBalance(from, big.NewInt(1000))
 
+	tx := newxtransaction(0, 100, key)
+	if err := pool.AddRemote(tx); err != ErrPoolNotReady {
+		t.Errorf("remote add error mismatch: have %v, want %v", err, ErrPoolNotReady)
+	}
+	if err := pool.AddLocal(tx); err != ErrPoolNotReady {
+		t.Errorf("local add error mismatch: have %v, want %v", err, ErrPoolNotReady)
+	}
+	if errs := pool.AddRemotes([]*transaction.Transaction{tx}); errs[0] != ErrPoolNotReady {
+		t.Errorf("batch add error mismatch: have %v, want %v", errs[0], ErrPoolNotReady)
+	}
+	if err := pool.ValidateOnly(tx); err != ErrPoolNotReady {
+		t.Errorf("validation error mismatch: have %v, want %v", err, ErrPoolNotReady)
+	}
+	if err := pool.Cancel(from, 0, tx); err != ErrPoolNotReady {
+		t.Errorf("cancel error mismatch: have %v, want %v", err, ErrPoolNotReady)
+	}
+	if managed := pool.State(); managed != nil {
+		t.Errorf("state available before ready: %v", managed)
+	}
+	pool.SetAccountNonce(from, 1)
+	if txs := pool.PreviewPromotable(from); txs != nil {
+		t.Errorf("promotable transactions before ready: %v", txs)
+	}
+	if pruned := pool.Prune(); pruned != 0 {
+		t.Errorf("pruned transactions before ready: %d", pruned)
+	}
+	if pending, _ := pool.Pending(); len(pending) != 0 {
+		t.Errorf("pending transactions before ready: %v", pending)
+	}
+	// Once the chain state becomes available, the pool should accept transactions
+	pool.lockedReset(nil, nil)
+	if err := pool.AddRemote(tx); err != nil {
+		t.Fatalf("failed to add transaction after becoming ready: %v", err)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
 
+// Tests that an account with overridden limits may hold more transactions than
+// the global per account allowances, while other accounts remain capped.
+func TestTransactionAccountLimitOverride(t *testing.T) {
+	t.Parallel()
 
+	config := testTxPoolConfig
+	config.AccountSlots = 2
+	config.GlobalSlots = 4
+	config.AccountQueue = 2
 
+	pool, _ := setupTxPoolWithConfig(config)
+	defer pool.Stop()
 
+	trusted, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	trustedAddr := crypto.PubkeyToAddress(trusted.PublicKey)
+	otherAddr := crypto.PubkeyToAddress(other.PublicKey)
 
+	pool.currentState.AddBalance(trustedAddr, big.NewInt(1000000))
+	pool.currentState.AddBalance(otherAddr, big.NewInt(1000000))
+	pool.SetAccountLimits(trustedAddr, 6, 4)
 
+	for i := uint64(0); i < 6; i++ {
+		pool.AddRemote(newxtransaction(i, 100, trusted))
+		pool.AddRemote(newxtransaction(i, 100, other))
+	}
+	for i := uint64(10); i < 14; i++ {
+		pool.AddRemote(newxtransaction(i, 100, trusted))
+		pool.AddRemote(newxtransaction(i, 100, other))
+	}
+	if have := pool.pending[trustedAddr].Len(); have != 6 {
+		t.Errorf("overridden account pending mismatch: have %d, want %d", have, 6)
+	}
+	if have := pool.pending[otherAddr].Len(); have != int(config.AccountSlots) {
+		t.Errorf("capped account pending mismatch: have %d, want %d", have, config.AccountSlots)
+	}
+	if have := pool.queue[trustedAddr].Len(); have != 4 {
+		t.Errorf("overridden account queue mismatch: have %d, want %d", have, 4)
+	}
+	if have := pool.queue[otherAddr].Len(); have != int(config.AccountQueue) {
+		t.Errorf("capped account queue mismatch: have %d, want %d", have, config.AccountQueue)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
 
+// Tests that adding and promoting transactions in the usual way does not leak
+// any debug output to stdout with the default log level, nor allocates for the
+// disabled trace logging.
+func TestTransactionAddNoStdout(t *testing.T) {
+	pool, key := setupTxPool()
+	defer pool.Stop()
 
+	from, _ := deriveSender(newxtransaction(0, 100, key))
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
 
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	known := newxtransaction(0, 100, key)
+	errs := []error{
+		pool.AddRemote(known),
+		pool.AddRemote(newxtransaction(2, 100, key)),
+		pool.AddRemote(newxtransaction(1, 100, key)),
+	}
+	os.Stdout = stdout
+	writer.Close()
 
+	output, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read captured output: %v", err)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	if len(output) != 0 {
+		t.Errorf("unexpected stdout output during add: %q", output)
+	}
+	if pending, _ := pool.Stats(); pending != 3 {
+		t.Errorf("pending transactions mismatch: have %d, want %d", pending, 3)
+	}
+	// Rejecting a known transaction allocates only the wrapped error and its
+	// audit record, anything on top comes from boxing disabled log arguments
+	hash := known.Hash()
+	want := testing.AllocsPerRun(100, func() {
+		pool.audit.rejected(known, fmt.Errorf("%w: 0x%x", ErrKnownTransaction, hash), pool.tags[hash])
+	})
+	if have := testing.AllocsPerRun(100, func() { pool.AddRemote(known) }); have > want {
+		t.Errorf("known transaction rejection allocations mismatch: have %v, want at most %v", have, want)
+	}
+}
 
+// countingSigner is a transaction signer counting the sender recoveries.
+type countingSigner struct {
+	transaction.Signer
+	recoveries int
+}
 
+func (s *countingSigner) Sender(tx *transaction.Transaction) (types.Address, error) {
+	s.recoveries++
+	return s.Signer.Sender(tx)
+}
 
+// Tests that re-announcing a transaction right after it was mined is rejected
+// cheaply, without recovering its sender again.
+func TestTransactionKnownMined(t *testing.T) {
+	t.Parallel()
 
+	pool, key := setupTxPool()
+	defer pool.Stop()
 
+	signer := &countingSigner{Signer: pool.signer}
+	pool.signer = signer
 
+	tx := newxtransaction(0, 100, key)
+	from, _ := deriveSender(tx)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
 
+	if err := pool.AddRemote(tx); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	// Mine the transaction and make sure it's dropped from the pool
+	pool.currentState.SetNonce(from, 1)
+	pool.lockedReset(nil, nil)
 
+	if pool.Get(tx.Hash()) != nil {
+		t.Fatalf("mined transaction still in pool")
+	}
+	recoveries := signer.recoveries
+	if err := pool.AddRemote(tx); err != ErrKnownMined {
+		t.Fatalf("re-announced transaction error mismatch: have %v, want %v", err, ErrKnownMined)
+	}
+	if signer.recoveries != recoveries {
+		t.Errorf("sender recovered for mined transaction: have %d recoveries, want %d", signer.recoveries, recoveries)
+	}
+	// Fresh transactions from the same account must still be accepted
+	if err := pool.AddRemote(newxtransaction(1, 100, key)); err != nil {
+		t.Fatalf("failed to add next transaction: %v", err)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
 
+// Benchmarks the speed of batch transaction insertion with the senders being
+// recovered serially or concurrently ahead of the insertion.
+func BenchmarkPoolBatchInsertSerialSenders(b *testing.B) { benchmarkPoolBatchInsertSenders(b, 1) }
+func BenchmarkPoolBatchInsertConcurrentSenders(b *testing.B) {
+	benchmarkPoolBatchInsertSenders(b, runtime.NumCPU())
+}
 
+func benchmarkPoolBatchInsertSenders(b *testing.B, workers int) {
+	config := testTxPoolConfig
+	config.SenderWorkers = workers
 
+	key, _ := crypto.GenerateKey()
+	batch := make(transaction.Transactions, 512)
+	for i := range batch {
+		batch[i] = newxtransaction(uint64(i), 100, key)
+	}
+	from, _ := deriveSender(batch[0])
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pool, _ := setupTxPoolWithConfig(config)
+		pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+		// Strip the cached senders so every iteration recovers them
+		txs := make(transaction.Transactions, len(batch))
+		for j, tx := range batch {
+			txs[j] = &transaction.Transaction{Data: tx.Data}
+		}
+		b.StartTimer()
 
+		pool.AddRemotes(txs)
 
+		b.StopTimer()
+		pool.Stop()
+		b.StartTimer()
+	}
+}
 
+// Benchmarks filling the pool with transactions and draining it again, with the
+// lookup tables sized for a full pool upfront or grown on demand.
+func BenchmarkPoolChurnPresized(b *testing.B) { benchmarkPoolChurn(b, true) }
+func BenchmarkPoolChurnGrowing(b *testing.B)  { benchmarkPoolChurn(b, false) }
 
+func benchmarkPoolChurn(b *testing.B, presized bool) {
+	pool, _ := setupTxPool()
+	defer pool.Stop()
 
+	// Sign enough transactions to fill the pool from a bunch of accounts
+	var txs transaction.Transactions
+	for i := 0; i < int(pool.config.GlobalSlots+pool.config.GlobalQueue)/16; i++ {
+		key, _ := crypto.GenerateKey()
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+		for j := uint64(0); j < 16; j++ {
+			txs = append(txs, newxtransaction(j, 100, key))
+		}
+	}
+	capacity := int(pool.config.GlobalSlots + pool.config.GlobalQueue)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Start every cycle from fresh tables, as Go maps never shrink
+		pool.mu.Lock()
+		if presized {
+			pool.all = make(map[types.Hash]*transaction.Transaction, capacity)
+			pool.seen = make(map[types.Hash]time.Time, capacity)
+		} else {
+			pool.all = make(map[types.Hash]*transaction.Transaction)
+			pool.seen = make(map[types.Hash]time.Time)
+		}
+		pool.mu.Unlock()
 
+		pool.AddRemotes(txs)
 
+		pool.mu.Lock()
+		for j := len(txs) - 1; j >= 0; j-- {
+			pool.removeTx(txs[j].Hash(), dropEvicted)
+		}
+		pool.mu.Unlock()
+	}
+}
 
+// Tests that advancing an account's nonce from outside the chain head flow
+// drops the obsolete transactions and ignores attempts to go backwards.
+func TestTransactionSetAccountNonce(t *testing.T) {
+	t.Parallel()
 
+	pool, key := setupTxPool()
+	defer pool.Stop()
 
+	txs := make([]*transaction.Transaction, 5)
+	for i := range txs {
+		txs[i] = newxtransaction(uint64(i), 100, key)
+	}
+	from, _ := deriveSender(txs[0])
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
 
+	for i, tx := range txs {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	pool.SetAccountNonce(from, 3)
 
+	for i, tx := range txs {
+		if known := pool.Get(tx.Hash()) != nil; known != (i >= 3) {
+			t.Errorf("transaction %d: presence mismatch: have %v, want %v", i, known, i >= 3)
+		}
+	}
+	if nonce := pool.State().GetNonce(from); nonce != 5 {
+		t.Errorf("pending nonce mismatch: have %d, want %d", nonce, 5)
+	}
+	// Lowering the nonce below the current state must be a no-op
+	pool.currentState.SetNonce(from, 2)
+	pool.SetAccountNonce(from, 1)
 
+	if pending := pool.pending[from].Len(); pending != 2 {
+		t.Errorf("pending transactions mismatch: have %d, want %d", pending, 2)
+	}
+	if nonce := pool.State().GetNonce(from); nonce != 5 {
+		t.Errorf("pending nonce mismatch after lowering: have %d, want %d", nonce, 5)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
 
+// Tests that pending transactions of remote accounts expire after the pending
+// lifetime, whereas local ones are kept.
+func TestTransactionPendingLifetime(t *testing.T) {
+	t.Parallel()
 
+	config := testTxPoolConfig
+	config.PendingLifetime = time.Minute
 
+	pool, remote := setupTxPoolWithConfig(config)
+	defer pool.Stop()
 
+	local, _ := crypto.GenerateKey()
+	remoteAddr := crypto.PubkeyToAddress(remote.PublicKey)
+	localAddr := crypto.PubkeyToAddress(local.PublicKey)
+	pool.currentState.AddBalance(remoteAddr, big.NewInt(1000000))
+	pool.currentState.AddBalance(localAddr, big.NewInt(1000000))
 
+	first, second := newxtransaction(0, 100, remote), newxtransaction(1, 100, remote)
+	if errs := pool.AddRemotes([]*transaction.Transaction{first, second}); errs[0] != nil || errs[1] != nil {
+		t.Fatalf("failed to add remote transactions: %v", errs)
+	}
+	if err := pool.AddLocal(newxtransaction(0, 100, local)); err != nil {
+		t.Fatalf("failed to add local transaction: %v", err)
+	}
+	// Age every transaction beyond the lifetime and run an eviction round
+	pool.mu.Lock()
+	for hash := range pool.seen {
+		pool.seen[hash] = time.Now().Add(-2 * config.PendingLifetime)
+	}
+	pool.evictStale()
+	pool.mu.Unlock()
 
+	if pool.Get(first.Hash()) != nil || pool.Get(second.Hash()) != nil {
+		t.Errorf("stale remote transactions not evicted")
+	}
+	if pending := pool.pending[localAddr].Len(); pending != 1 {
+		t.Errorf("local pending transactions mismatch: have %d, want %d", pending, 1)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
 
+// Tests that pruning drops exactly the transactions below their account's
+// current nonce, both from the pending and the queued sets.
+func TestTransactionPrune(t *testing.T) {
+	t.Parallel()
 
+	pool, key := setupTxPool()
+	defer pool.Stop()
 
+	other, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	otherAddr := crypto.PubkeyToAddress(other.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+	pool.currentState.AddBalance(otherAddr, big.NewInt(1000000))
 
+	// Pending 0..3 for the first account, queued 5..7 for the second
+	for i := uint64(0); i < 4; i++ {
+		if err := pool.AddRemote(newxtransaction(i, 100, key)); err != nil {
+			t.Fatalf("pending transaction %d: failed to add: %v", i, err)
+		}
+	}
+	for i := uint64(5); i < 8; i++ {
+		if err := pool.AddRemote(newxtransaction(i, 100, other)); err != nil {
+			t.Fatalf("queued transaction %d: failed to add: %v", i, err)
+		}
+	}
+	// Advance both accounts behind the pool's back and prune
+	pool.currentState.SetNonce(from, 2)
+	pool.currentState.SetNonce(otherAddr, 7)
 
+	if pruned := pool.Prune(); pruned != 4 {
+		t.Errorf("pruned transaction count mismatch: have %d, want %d", pruned, 4)
+	}
+	if pending := pool.pending[from].Len(); pending != 2 {
+		t.Errorf("pending transactions mismatch: have %d, want %d", pending, 2)
+	}
+	if queued := pool.queue[otherAddr].Len(); queued != 1 {
+		t.Errorf("queued transactions mismatch: have %d, want %d", queued, 1)
+	}
+	if pruned := pool.Prune(); pruned != 0 {
+		t.Errorf("repeated prune removed %d transactions", pruned)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
 
+// Tests that the sender of a local transaction is reported as local, while
+// unrelated addresses are not.
+func TestTransactionIsLocal(t *testing.T) {
+	t.Parallel()
 
+	pool, key := setupTxPool()
+	defer pool.Stop()
 
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
 
+	if pool.IsLocal(from) {
+		t.Errorf("sender reported local before adding any transaction")
+	}
+	if err := pool.AddLocal(newxtransaction(0, 100, key)); err != nil {
+		t.Fatalf("failed to add local transaction: %v", err)
+	}
+	if !pool.IsLocal(from) {
+		t.Errorf("local sender not reported as local")
+	}
+	other, _ := crypto.GenerateKey()
+	if pool.IsLocal(crypto.PubkeyToAddress(other.PublicKey)) {
+		t.Errorf("random address reported as local")
+	}
+}
 
+// Tests that the reorg depth is computed exactly even for block numbers beyond
+// the precision of a float64.
+func TestReorgDepth(t *testing.T) {
+	t.Parallel()
 
+	tests := []struct {
+		old, new uint64
+		depth    uint64
+	}{
+		{0, 0, 0},
+		{10, 74, 64},
+		{74, 10, 64},
+		{1<<53 + 1, 1 << 53, 1},
+		{1 << 53, 1<<53 + 65, 65},
+		{1<<63 + 3, 1<<63 - 2, 5},
+		{0, 1<<64 - 1, 1<<64 - 1},
+	}
+	for i, tt := range tests {
+		if depth := reorgDepth(tt.old, tt.new); depth != tt.depth {
+			t.Errorf("test %d: depth mismatch: have %d, want %d", i, depth, tt.depth)
+		}
+	}
+}
 
+// Tests that the stats report interval backs off while the pool keeps changing
+// and snaps back to the base interval once it settles.
+func TestReportBackoff(t *testing.T) {
+	t.Parallel()
 
+	base, cap := time.Second, 10*time.Second
+	backoff := newReportBackoff(base, cap, 2)
 
+	within := func(have, want time.Duration) bool {
+		slack := time.Duration(statsReportJitter * float64(want))
+		return have >= want-slack && have <= want+slack
+	}
+	// Keep the pool churning and ensure the interval keeps growing up to the cap
+	prev := backoff.interval
+	for i := 0; i < 10; i++ {
+		wait := backoff.next(true)
+		if backoff.interval > cap {
+			t.Fatalf("churn %d: interval above cap: have %v, cap %v", i, backoff.interval, cap)
+		}
+		if backoff.interval < cap && backoff.interval <= prev {
+			t.Fatalf("churn %d: interval didn't grow: have %v, previous %v", i, backoff.interval, prev)
+		}
+		if !within(wait, backoff.interval) {
+			t.Fatalf("churn %d: wait outside jitter bounds: have %v, interval %v", i, wait, backoff.interval)
+		}
+		prev = backoff.interval
+	}
+	if backoff.interval != cap {
+		t.Fatalf("interval mismatch after churn: have %v, want %v", backoff.interval, cap)
+	}
+	// Stabilize the pool and ensure the interval shrinks back to the base
+	if wait := backoff.next(false); !within(wait, base) {
+		t.Fatalf("wait mismatch after settling: have %v, want %v±%v%%", wait, base, statsReportJitter*100)
+	}
+	if backoff.interval != base {
+		t.Fatalf("interval mismatch after settling: have %v, want %v", backoff.interval, base)
+	}
+}
 
+// Tests that resetting the pool to a new head notifies the pending change
+// subscribers.
+func TestTransactionPendingChangedEvent(t *testing.T) {
+	t.Parallel()
 
+	pool, _ := setupTxPool()
+	defer pool.Stop()
 
+	changes := make(chan struct{}, 1)
+	sub := pool.SubscribePendingChanged(changes)
+	defer sub.Unsubscribe()
 
+	pool.lockedReset(nil, nil)
 
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatalf("pending change notification not fired")
+	}
+}
 
+// Tests that a transaction whose hash collides with a different known one is
+// still discarded, but the collision is accounted for.
+func TestTransactionHashCollision(t *testing.T) {
+	collisions := hashCollisionCounter
+	hashCollisionCounter = new(metrics.StandardCounter)
+	defer func() { hashCollisionCounter = collisions }()
 
+	pool, key := setupTxPool()
+	defer pool.Stop()
 
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
 
+	tx := newxtransaction(0, 100, key)
+	if err := pool.AddRemote(tx); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	// Re-adding a copy of the same transaction is a plain duplicate
+	if err := pool.AddRemote(&transaction.Transaction{Data: tx.Data}); err == nil {
+		t.Fatalf("duplicate transaction accepted")
+	}
+	if count := hashCollisionCounter.Count(); count != 0 {
+		t.Fatalf("duplicate counted as collision: have %d, want %d", count, 0)
+	}
+	// Craft a collision by filing different content under the incoming hash
+	colliding := newxtransaction(1, 100, key)
+	pool.mu.Lock()
+	pool.all[colliding.Hash()] = newxtransaction(1, 200, key)
+	pool.mu.Unlock()
+
+	if err := pool.AddRemote(colliding); err == nil {
+		t.Fatalf("colliding transaction accepted")
+	}
+	if count := hashCollisionCounter.Count(); count != 1 {
+		t.Errorf("collision count mismatch: have %d, want %d", count, 1)
+	}
+}
 
+// fillTxPool fills a pool limited to four transactions with two pending ones
+// of a first account and two queued ones of a second, returning the queued
+// transactions. The second queued transaction is made the oldest in the pool.
+func fillTxPool(t *testing.T, pool *TxPool) transaction.Transactions {
+	pendingKey, _ := crypto.GenerateKey()
+	queuedKey, _ := crypto.GenerateKey()
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(pendingKey.PublicKey), big.NewInt(1000000))
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(queuedKey.PublicKey), big.NewInt(1000000))
+
+	queued := transaction.Transactions{newxtransaction(1, 100, queuedKey), newxtransaction(2, 100, queuedKey)}
+	txs := append(transaction.Transactions{newxtransaction(0, 100, pendingKey), newxtransaction(1, 100, pendingKey)}, queued...)
+	for i, tx := range txs {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	pool.mu.Lock()
+	pool.seen[queued[1].Hash()] = time.Now().Add(-time.Hour)
+	pool.mu.Unlock()
 
+	return queued
+}
 
+// Tests that a full pool rejects new transactions by default.
+func TestTransactionFullPoolReject(t *testing.T) {
+	t.Parallel()
 
+	config := testTxPoolConfig
+	config.AccountSlots = 2
+	config.GlobalSlots = 2
+	config.GlobalQueue = 2
 
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
 
+	fillTxPool(t, pool)
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
 
+	if err := pool.AddRemote(newxtransaction(1, 100, key)); err == nil {
+		t.Fatalf("transaction accepted into full pool")
+	}
+	if pending, queued := pool.Stats(); pending+queued != 4 {
+		t.Errorf("pool size mismatch: have %d, want %d", pending+queued, 4)
+	}
+}
 
+// Tests that a full pool configured to evict makes room by dropping its oldest
+// queued transaction.
+func TestTransactionFullPoolEvictOldest(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.AccountSlots = 2
+	config.GlobalSlots = 2
+	config.GlobalQueue = 2
+	config.FullPoolPolicy = FullPoolEvictOldest
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	queued := fillTxPool(t, pool)
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	tx := newxtransaction(1, 100, key)
+	if err := pool.AddRemote(tx); err != nil {
+		t.Fatalf("failed to add transaction into full pool: %v", err)
+	}
+	if pool.Get(tx.Hash()) == nil {
+		t.Errorf("new transaction missing from pool")
+	}
+	if pool.Get(queued[1].Hash()) != nil {
+		t.Errorf("oldest queued transaction not evicted")
+	}
+	if pool.Get(queued[0].Hash()) == nil {
+		t.Errorf("younger queued transaction evicted")
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that rejections for insufficient funds detail the shortfall while still
+// matching the sentinel error.
+func TestTransactionInsufficientFundsError(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.BalanceBuffer = big.NewInt(50)
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000))
+
+	err := pool.AddRemote(newxtransaction(0, 1200, key))
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrInsufficientFunds)
+	}
+	funds, ok := err.(*InsufficientFundsError)
+	if !ok {
+		t.Fatalf("error type mismatch: have %T, want %T", err, funds)
+	}
+	if funds.Have.Cmp(big.NewInt(950)) != 0 {
+		t.Errorf("available funds mismatch: have %v, want %v", funds.Have, 950)
+	}
+	if funds.Need.Cmp(big.NewInt(1200)) != 0 {
+		t.Errorf("needed funds mismatch: have %v, want %v", funds.Need, 1200)
+	}
+}
+
+// Tests that once the pool tracks the maximum number of accounts, transactions
+// from new remote senders are rejected while known and local ones still get in.
+func TestTransactionMaxAccounts(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.MaxAccounts = 3
+
+	pool, _ := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	keys := make([]*ecdsa.PrivateKey, 5)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(keys[i].PublicKey), big.NewInt(1000000))
+	}
+	for i, key := range keys[:3] {
+		if err := pool.AddRemote(newxtransaction(0, 100, key)); err != nil {
+			t.Fatalf("account %d: failed to add transaction: %v", i, err)
+		}
+	}
+	if err := pool.AddRemote(newxtransaction(0, 100, keys[3])); err != ErrTooManyAccounts {
+		t.Errorf("new account error mismatch: have %v, want %v", err, ErrTooManyAccounts)
+	}
+	if err := pool.AddRemote(newxtransaction(1, 100, keys[0])); err != nil {
+		t.Errorf("known account rejected: %v", err)
+	}
+	if err := pool.AddLocal(newxtransaction(0, 100, keys[4])); err != nil {
+		t.Errorf("local account rejected: %v", err)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that previewing the promotable transactions of an account reports what
+// a promotion would move without mutating the pool.
+func TestTransactionPreviewPromotable(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	// Queue up transactions behind a nonce gap, nothing is promotable
+	queued := transaction.Transactions{newxtransaction(1, 100, key), newxtransaction(2, 100, key), newxtransaction(3, 100, key)}
+	pool.mu.Lock()
+	for _, tx := range queued {
+		if _, err := pool.enqueueTx(from, tx.Hash(), tx); err != nil {
+			t.Fatalf("failed to enqueue transaction: %v", err)
+		}
+	}
+	pool.mu.Unlock()
+
+	if promotable := pool.PreviewPromotable(from); len(promotable) != 0 {
+		t.Errorf("promotable transactions behind gap: have %d, want %d", len(promotable), 0)
+	}
+	// Close the gap in the state, the whole queue becomes promotable
+	pool.currentState.SetNonce(from, 1)
+	pool.State().SetNonce(from, 1)
+
+	promotable := pool.PreviewPromotable(from)
+	if len(promotable) != len(queued) {
+		t.Fatalf("promotable transactions mismatch: have %d, want %d", len(promotable), len(queued))
+	}
+	for i, tx := range promotable {
+		if tx.Hash() != queued[i].Hash() {
+			t.Errorf("promotable transaction %d: hash mismatch: have %x, want %x", i, tx.Hash(), queued[i].Hash())
+		}
+	}
+	if pending, queue := pool.Stats(); pending != 0 || queue != len(queued) {
+		t.Errorf("pool mutated by preview: have %d pending, %d queued", pending, queue)
+	}
+}
+
+// Tests that transactions can be looked up by account nonce irrespective of
+// whether they are pending or queued.
+func TestTransactionAt(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	pending, queued := newxtransaction(0, 100, key), newxtransaction(2, 100, key)
+	if errs := pool.AddRemotes([]*transaction.Transaction{pending, queued}); errs[0] != nil || errs[1] != nil {
+		t.Fatalf("failed to add transactions: %v", errs)
+	}
+	tests := []struct {
+		nonce  uint64
+		tx     *transaction.Transaction
+		status TxStatus
+	}{
+		{0, pending, TxStatusPending},
+		{1, nil, TxStatusUnknown},
+		{2, queued, TxStatusQueued},
+	}
+	for _, tt := range tests {
+		tx, status := pool.TransactionAt(from, tt.nonce)
+		if status != tt.status {
+			t.Errorf("nonce %d: status mismatch: have %v, want %v", tt.nonce, status, tt.status)
+		}
+		if (tx == nil) != (tt.tx == nil) || (tx != nil && tx.Hash() != tt.tx.Hash()) {
+			t.Errorf("nonce %d: transaction mismatch: have %v, want %v", tt.nonce, tx, tt.tx)
+		}
+	}
+	if tx, status := pool.TransactionAt(types.Address{0x01}, 0); tx != nil || status != TxStatusUnknown {
+		t.Errorf("unknown account: have %v (%v), want nil (%v)", tx, status, TxStatusUnknown)
+	}
+}
+
+// Tests that accepted, rejected and dropped transactions each leave a record in
+// the audit log.
+func TestTransactionAuditLog(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txaudit")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testTxPoolConfig
+	config.AuditLog = filepath.Join(dir, "audit.log")
+	config.PendingLifetime = time.Minute
+
+	pool, key := setupTxPoolWithConfig(config)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000))
+
+	accepted := newxtransaction(0, 100, key)
+	if err := pool.AddRemote(accepted); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	rejected := newxtransaction(1, 10000, key)
+	if err := pool.AddRemote(rejected); err == nil {
+		t.Fatalf("unpayable transaction accepted")
+	}
+	pool.mu.Lock()
+	pool.seen[accepted.Hash()] = time.Now().Add(-time.Hour)
+	pool.evictStale()
+	pool.mu.Unlock()
+	pool.Stop()
+
+	blob, err := ioutil.ReadFile(config.AuditLog)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	var records []auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(blob)), "\n") {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("failed to parse audit record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	want := []struct {
+		hash  types.Hash
+		event string
+	}{
+		{accepted.Hash(), "accepted"},
+		{rejected.Hash(), "rejected:"},
+		{accepted.Hash(), "dropped:" + dropEvicted},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("audit record count mismatch: have %d, want %d", len(records), len(want))
+	}
+	for i, record := range records {
+		if record.Hash != want[i].hash || !strings.HasPrefix(record.Event, want[i].event) {
+			t.Errorf("record %d: have %x %q, want %x %q", i, record.Hash, record.Event, want[i].hash, want[i].event)
+		}
+		if record.From != from {
+			t.Errorf("record %d: sender mismatch: have %x, want %x", i, record.From, from)
+		}
+	}
+}
+
+// Tests that shrinking the pool drops the oldest remote transactions down to
+// the requested size, keeping all local ones.
+func TestTransactionShrinkTo(t *testing.T) {
+	t.Parallel()
+
+	pool, remote := setupTxPool()
+	defer pool.Stop()
+
+	local, _ := crypto.GenerateKey()
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(remote.PublicKey), big.NewInt(1000000))
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(local.PublicKey), big.NewInt(1000000))
+
+	var remotes, locals transaction.Transactions
+	for i := uint64(0); i < 6; i++ {
+		remotes = append(remotes, newxtransaction(i, 100, remote))
+		locals = append(locals, newxtransaction(i, 100, local))
+	}
+	pool.AddRemotes(remotes)
+	pool.AddLocals(locals)
+
+	// Make the remote transactions age in reverse nonce order
+	pool.mu.Lock()
+	for i, tx := range remotes {
+		pool.seen[tx.Hash()] = time.Now().Add(-time.Duration(i+1) * time.Minute)
+	}
+	pool.mu.Unlock()
+
+	if dropped := pool.ShrinkTo(8); dropped != 4 || len(pool.all) != 8 {
+		t.Errorf("dropped transaction count mismatch: have %d (%d left), want %d", dropped, len(pool.all), 4)
+	}
+	for i, tx := range remotes {
+		if kept := pool.Get(tx.Hash()) != nil; kept != (i < 2) {
+			t.Errorf("remote transaction %d: presence mismatch: have %v, want %v", i, kept, i < 2)
+		}
+	}
+	// Shrinking below the locals stops once no remotes are left
+	if dropped := pool.ShrinkTo(0); dropped != 2 || len(pool.all) != 6 {
+		t.Errorf("dropped transaction count mismatch: have %d (%d left), want %d", dropped, len(pool.all), 2)
+	}
+	for i, tx := range locals {
+		if pool.Get(tx.Hash()) == nil {
+			t.Errorf("local transaction %d dropped", i)
+		}
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that the number of transactions ShrinkTo reports as dropped includes the
+// dependents dropped together with a removed pending transaction.
+func TestTransactionShrinkToDependents(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.DropDependents = true
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	var txs transaction.Transactions
+	for i := uint64(0); i < 4; i++ {
+		txs = append(txs, newxtransaction(i, 100, key))
+	}
+	pool.AddRemotes(txs)
+
+	// Make the lowest nonce the oldest, dropping it takes all others along
+	pool.mu.Lock()
+	for i, tx := range txs {
+		pool.seen[tx.Hash()] = time.Now().Add(-time.Duration(len(txs)-i) * time.Minute)
+	}
+	pool.mu.Unlock()
+
+	before := len(pool.all)
+	if dropped := pool.ShrinkTo(3); dropped != before-len(pool.all) || dropped != 4 {
+		t.Errorf("dropped transaction count mismatch: have %d, want %d (pool shrunk by %d)", dropped, 4, before-len(pool.all))
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that the distinct reasons for failing to derive the sender of a
+// transaction are reported and accounted for separately.
+func TestTransactionSenderFailures(t *testing.T) {
+	chainIds, signatures := wrongChainIdCounter, badSignatureCounter
+	wrongChainIdCounter, badSignatureCounter = new(metrics.StandardCounter), new(metrics.StandardCounter)
+	defer func() { wrongChainIdCounter, badSignatureCounter = chainIds, signatures }()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	foreign, _ := transaction.SignTx(transaction.NewTransaction(0, types.Address{}, big.NewInt(100), 0, big.NewInt(0), nil), transaction.NewMSigner(big.NewInt(2)), key)
+
+	valid := newxtransaction(0, 100, key)
+	zeroR := &transaction.Transaction{Data: valid.Data}
+	zeroR.Data.R = new(types.BigInt)
+
+	highS := &transaction.Transaction{Data: valid.Data}
+	highS.Data.S = new(types.BigInt)
+	highS.Data.S.IntVal.Set(crypto.S256().Params().N)
+
+	tests := []struct {
+		tx  *transaction.Transaction
+		err error
+	}{
+		{foreign, ErrWrongChainID},
+		{zeroR, ErrBadSignature},
+		{highS, ErrBadSignature},
+	}
+	for i, tt := range tests {
+		err := pool.ValidateOnly(tt.tx)
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if !errors.Is(err, ErrInvalidSender) {
+			t.Errorf("test %d: error %v doesn't match %v", i, err, ErrInvalidSender)
+		}
+	}
+	if count := wrongChainIdCounter.Count(); count != 1 {
+		t.Errorf("wrong chain id count mismatch: have %d, want %d", count, 1)
+	}
+	if count := badSignatureCounter.Count(); count != 2 {
+		t.Errorf("bad signature count mismatch: have %d, want %d", count, 2)
+	}
+}
+
+// Tests that both pending and queued transactions can be cancelled by swapping
+// in a replacement at the same nonce, and that mismatching ones are refused.
+func TestTransactionCancel(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	pending, queued := newxtransaction(0, 100, key), newxtransaction(2, 100, key)
+	if errs := pool.AddRemotes([]*transaction.Transaction{pending, queued}); errs[0] != nil || errs[1] != nil {
+		t.Fatalf("failed to add transactions: %v", errs)
+	}
+	other, _ := crypto.GenerateKey()
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(other.PublicKey), big.NewInt(1000000))
+
+	if err := pool.Cancel(from, 0, newxtransaction(0, 0, other)); err != ErrCancelMismatch {
+		t.Errorf("foreign sender error mismatch: have %v, want %v", err, ErrCancelMismatch)
+	}
+	if err := pool.Cancel(from, 0, newxtransaction(2, 0, key)); err != ErrCancelMismatch {
+		t.Errorf("nonce mismatch error mismatch: have %v, want %v", err, ErrCancelMismatch)
+	}
+	if err := pool.Cancel(from, 1, newxtransaction(1, 0, key)); err != ErrCancelUnknown {
+		t.Errorf("missing transaction error mismatch: have %v, want %v", err, ErrCancelUnknown)
+	}
+	tests := []struct {
+		old    *transaction.Transaction
+		status TxStatus
+	}{
+		{pending, TxStatusPending},
+		{queued, TxStatusQueued},
+	}
+	for i, tt := range tests {
+		replacement := newxtransaction(tt.old.Nonce(), 0, key)
+		if err := pool.Cancel(from, tt.old.Nonce(), replacement); err != nil {
+			t.Fatalf("test %d: failed to cancel: %v", i, err)
+		}
+		if pool.Get(tt.old.Hash()) != nil {
+			t.Errorf("test %d: cancelled transaction still in pool", i)
+		}
+		tx, status := pool.TransactionAt(from, tt.old.Nonce())
+		if tx == nil || tx.Hash() != replacement.Hash() || status != tt.status {
+			t.Errorf("test %d: replacement mismatch: have %v (%v), want %x (%v)", i, tx, status, replacement.Hash(), tt.status)
+		}
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that the local transaction snapshot is unaffected by later changes to
+// the pool.
+func TestTransactionLocalTransactions(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key)}
+	for i, tx := range txs {
+		if err := pool.AddLocal(tx); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	locals := pool.LocalTransactions()
+	if len(locals) != 1 || len(locals[from]) != len(txs) {
+		t.Fatalf("local snapshot mismatch: have %v, want %d transactions of %x", locals, len(txs), from)
+	}
+	// Mutate the pool and ensure the snapshot stays intact
+	if err := pool.AddLocal(newxtransaction(2, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	pool.mu.Lock()
+	pool.removeTx(txs[1].Hash(), dropEvicted)
+	pool.mu.Unlock()
+
+	if len(locals[from]) != len(txs) {
+		t.Fatalf("local snapshot length changed: have %d, want %d", len(locals[from]), len(txs))
+	}
+	for i, tx := range locals[from] {
+		if tx.Hash() != txs[i].Hash() {
+			t.Errorf("snapshot transaction %d: hash mismatch: have %x, want %x", i, tx.Hash(), txs[i].Hash())
+		}
+	}
+}
+
+// prunedState creates a state holding funded accounts for both addresses, with
+// the trie nodes of the pruned account missing from the database.
+func prunedState(t *testing.T, healthy, pruned types.Address) *state.StateDB {
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	statedb.AddBalance(healthy, big.NewInt(1000000))
+	statedb.AddBalance(pruned, big.NewInt(1000000))
+	root, err := statedb.CommitTo(db, true)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	// Delete trie nodes one by one until only the pruned account is unreachable
+	for _, key := range db.Keys() {
+		if bytes.Equal(key, root[:]) {
+			continue
+		}
+		value, _ := db.Get(key)
+		db.Delete(key)
+
+		statedb, err := state.New(root, state.NewDatabase(db))
+		if err == nil && statedb.AccountError(healthy) == nil && statedb.AccountError(pruned) != nil {
+			return statedb
+		}
+		db.Put(key, value)
+	}
+	t.Fatalf("failed to prune account state")
+	return nil
+}
+
+// Tests that the transactions of an account whose state went missing are
+// dropped, instead of being judged against an empty account.
+func TestTransactionMissingAccountState(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	other, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	otherAddr := crypto.PubkeyToAddress(other.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+	pool.currentState.AddBalance(otherAddr, big.NewInt(1000000))
+
+	// Give both accounts pending and queued transactions
+	for _, nonce := range []uint64{0, 1, 3} {
+		if err := pool.AddRemote(newxtransaction(nonce, 100, key)); err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+		if err := pool.AddRemote(newxtransaction(nonce, 100, other)); err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	// Switch to a new head where the state of the first account is missing
+	pool.chain.(*testBlockChain).statedb = prunedState(t, otherAddr, from)
+	pool.lockedReset(nil, nil)
+
+	if pool.pending[from] != nil || pool.queue[from] != nil {
+		t.Errorf("transactions of account with missing state retained")
+	}
+	if pending, queued := pool.pending[otherAddr].Len(), pool.queue[otherAddr].Len(); pending != 2 || queued != 1 {
+		t.Errorf("healthy account transactions mismatch: have %d pending, %d queued, want 2, 1", pending, queued)
+	}
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err != ErrAccountStateUnavailable {
+		t.Errorf("missing state error mismatch: have %v, want %v", err, ErrAccountStateUnavailable)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that adding a local transaction with a deadline gives up while the pool
+// lock is held, and goes through once it is released.
+func TestTransactionAddLocalTimeout(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	tx := newxtransaction(0, 100, key)
+
+	pool.mu.Lock()
+	start := time.Now()
+	err := pool.AddLocalTimeout(tx, 50*time.Millisecond)
+	elapsed := time.Since(start)
+	pool.mu.Unlock()
+
+	if err != ErrPoolBusy {
+		t.Fatalf("busy pool error mismatch: have %v, want %v", err, ErrPoolBusy)
+	}
+	if elapsed < 50*time.Millisecond {
+		t.Fatalf("gave up before the deadline: waited %v", elapsed)
+	}
+	if pool.Get(tx.Hash()) != nil {
+		t.Fatalf("transaction added despite timing out")
+	}
+	if err := pool.AddLocalTimeout(tx, 50*time.Millisecond); err != nil {
+		t.Fatalf("failed to add transaction to idle pool: %v", err)
+	}
+	if pending, _ := pool.Stats(); pending != 1 {
+		t.Fatalf("pending transactions mismatched: have %d, want %d", pending, 1)
+	}
+}
+
+// Tests that removing a pending transaction drops its dependent transactions
+// instead of requeueing them, if so configured, also if they were all the rest
+// of the account's pending list.
+func TestTransactionDropDependents(t *testing.T) {
+	gaps := pendingGapCounter
+	pendingGapCounter = new(metrics.StandardCounter)
+	defer func() { pendingGapCounter = gaps }()
+
+	tests := []struct {
+		drop    bool // Whether to drop the dependents
+		removed int  // Index of the pending transaction to remove
+		pending int  // Number of transactions expected to stay pending
+		stuck   int  // Number of dependents expected to be dropped or queued
+	}{
+		{drop: false, removed: 1, pending: 1, stuck: 2},
+		{drop: true, removed: 1, pending: 1, stuck: 2},
+		{drop: false, removed: 0, pending: 0, stuck: 3},
+		{drop: true, removed: 0, pending: 0, stuck: 3},
+	}
+	for i, tt := range tests {
+		config := testTxPoolConfig
+		config.DropDependents = tt.drop
+
+		pool, key := setupTxPoolWithConfig(config)
+		from := crypto.PubkeyToAddress(key.PublicKey)
+		pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+		txs := make(transaction.Transactions, 4)
+		for j := range txs {
+			txs[j] = newxtransaction(uint64(j), 100, key)
+			if err := pool.AddRemote(txs[j]); err != nil {
+				t.Fatalf("test %d: transaction %d: failed to add: %v", i, j, err)
+			}
+		}
+		// Remove a pending transaction and check where its dependents went
+		before := pendingGapCounter.Count()
+		pool.mu.Lock()
+		pool.removeTx(txs[tt.removed].Hash(), dropEvicted)
+		pool.mu.Unlock()
+
+		pending, queued := pool.Stats()
+		if pending != tt.pending {
+			t.Errorf("test %d: pending transactions mismatched: have %d, want %d", i, pending, tt.pending)
+		}
+		if tt.drop {
+			if queued != 0 {
+				t.Errorf("test %d: queued transactions mismatched: have %d, want %d", i, queued, 0)
+			}
+			for _, tx := range txs[tt.removed+1:] {
+				if pool.Get(tx.Hash()) != nil {
+					t.Errorf("test %d: stuck transaction %d still known", i, tx.Nonce())
+				}
+			}
+			if count := pendingGapCounter.Count() - before; count != int64(tt.stuck) {
+				t.Errorf("test %d: gap drop count mismatch: have %d, want %d", i, count, tt.stuck)
+			}
+		} else if queued != tt.stuck {
+			t.Errorf("test %d: queued transactions mismatched: have %d, want %d", i, queued, tt.stuck)
+		}
+		if err := validateTxPoolInternals(pool); err != nil {
+			t.Errorf("test %d: pool internal state corrupted: %v", i, err)
+		}
+		pool.Stop()
+	}
+}
+
+// Tests the string and JSON forms of the transaction statuses.
+func TestTxStatusEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status TxStatus
+		name   string
+	}{
+		{TxStatusUnknown, "unknown"},
+		{TxStatusQueued, "queued"},
+		{TxStatusPending, "pending"},
+		{TxStatusIncluded, "included"},
+		{TxStatus(42), "unknown"},
+	}
+	for i, tt := range tests {
+		if name := tt.status.String(); name != tt.name {
+			t.Errorf("test %d: string mismatch: have %q, want %q", i, name, tt.name)
+		}
+		blob, err := json.Marshal(tt.status)
+		if err != nil {
+			t.Errorf("test %d: failed to encode: %v", i, err)
+			continue
+		}
+		if want := `"` + tt.name + `"`; string(blob) != want {
+			t.Errorf("test %d: json mismatch: have %s, want %s", i, blob, want)
+		}
+	}
+}
+
+// Tests that the saturation subscribers are notified once when the pool fills
+// past the high watermark and once when it drains below the low one.
+func TestTransactionSaturationEvents(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.AccountSlots, config.GlobalSlots, config.GlobalQueue = 8, 8, 8
+	config.SaturationHigh, config.SaturationLow = 0.5, 0.25
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	events := make(chan bool, 4)
+	sub := pool.SubscribeSaturation(events)
+	defer sub.Unsubscribe()
+
+	expect := func(want bool) {
+		select {
+		case have := <-events:
+			if have != want {
+				t.Fatalf("saturation event mismatch: have %v, want %v", have, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("saturation event %v not fired", want)
+		}
+	}
+	expectNone := func() {
+		select {
+		case have := <-events:
+			t.Fatalf("unexpected saturation event: %v", have)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	// Fill the pool up to the high watermark
+	txs := make(transaction.Transactions, 8)
+	for i := range txs {
+		txs[i] = newxtransaction(uint64(i), 100, key)
+		if err := pool.AddRemote(txs[i]); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	expect(true)
+
+	// Drain the pool into the hysteresis band, then below the low watermark
+	drop := func(tx *transaction.Transaction) {
+		pool.mu.Lock()
+		pool.removeTx(tx.Hash(), dropEvicted)
+		pool.mu.Unlock()
+	}
+	for i := 7; i >= 4; i-- {
+		drop(txs[i])
+	}
+	expectNone()
+
+	drop(txs[3])
+	expect(false)
+	expectNone()
+}
+
+// Tests that a chain head event arriving after the pool started stopping is
+// ignored instead of resetting a half torn down pool.
+func TestTransactionChainHeadAfterStop(t *testing.T) {
+	t.Parallel()
+
+	pool, _ := setupTxPool()
+
+	head := pool.chain.CurrentBlock()
+	next := block.NewBlock(&block.Header{ParentHash: head.Hash()}, nil, nil)
+
+	// Ensure a live pool does reset on the event, replacing its pending state
+	pending := pool.pendingState
+	if have := pool.chainHead(head, core.ChainHeadEvent{Block: next}); have != next {
+		t.Fatalf("live pool head mismatch: have %x, want %x", have.Hash(), next.Hash())
+	}
+	if pool.pendingState == pending {
+		t.Fatalf("live pool not reset by chain head event")
+	}
+	pool.Stop()
+
+	// Fire another event after Stop and ensure it's ignored
+	pending = pool.pendingState
+	late := block.NewBlock(&block.Header{ParentHash: next.Hash()}, nil, nil)
+	if have := pool.chainHead(next, core.ChainHeadEvent{Block: late}); have != next {
+		t.Fatalf("stopped pool head mismatch: have %x, want %x", have.Hash(), next.Hash())
+	}
+	if pool.pendingState != pending {
+		t.Fatalf("stopped pool reset by late chain head event")
+	}
+}
+
+// Benchmarks demoting the pending transactions of many accounts after a reset,
+// loading the account states serially or prefetching them through concurrent
+// workers. The worker count is fixed so single core machines measure the
+// prefetch overhead too.
+func BenchmarkDemoteSerial(b *testing.B)     { benchmarkDemote(b, 1) }
+func BenchmarkDemoteConcurrent(b *testing.B) { benchmarkDemote(b, 4) }
+
+func benchmarkDemote(b *testing.B, workers int) {
+	config := testTxPoolConfig
+	config.DemoteWorkers = workers
+
+	pool, _ := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	// Fund a lot of accounts in a committed state, so they're loaded from the trie
+	keys := make([]*ecdsa.PrivateKey, 1024)
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+		statedb.AddBalance(crypto.PubkeyToAddress(keys[i].PublicKey), big.NewInt(1000000))
+	}
+	root, err := statedb.CommitTo(db, true)
+	if err != nil {
+		b.Fatalf("failed to commit state: %v", err)
+	}
+	pool.chain.(*testBlockChain).statedb, _ = state.New(root, state.NewDatabase(db))
+	pool.lockedReset(nil, nil)
+
+	for i, key := range keys {
+		if err := pool.AddRemote(newxtransaction(0, 100, key)); err != nil {
+			b.Fatalf("account %d: failed to add transaction: %v", i, err)
+		}
+	}
+	// Benchmark demoting the pending set against a freshly reset, cold state
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pool.currentState, _ = state.New(root, state.NewDatabase(db))
+		b.StartTimer()
+
+		pool.mu.Lock()
+		pool.demoteUnexecutables()
+		pool.mu.Unlock()
+	}
+}
+
+// Tests that a sender whitelist restricts the accepted transactions to approved
+// senders, optionally letting local ones through, and that an empty one allows
+// all senders.
+func TestTransactionSenderWhitelist(t *testing.T) {
+	t.Parallel()
+
+	approved, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		whitelist bool // Whether to whitelist the approved sender
+		bypass    bool // Whether local transactions bypass the whitelist
+		local     bool // Whether to add the transactions as local ones
+		approved  error
+		other     error
+	}{
+		{false, false, false, nil, nil},
+		{true, false, false, nil, ErrSenderNotWhitelisted},
+		{true, false, true, nil, ErrSenderNotWhitelisted},
+		{true, true, false, nil, ErrSenderNotWhitelisted},
+		{true, true, true, nil, nil},
+	}
+	for i, tt := range tests {
+		config := testTxPoolConfig
+		if tt.whitelist {
+			config.SenderWhitelist = map[types.Address]bool{crypto.PubkeyToAddress(approved.PublicKey): true}
+		}
+		config.WhitelistBypassLocals = tt.bypass
+
+		pool, _ := setupTxPoolWithConfig(config)
+		for _, key := range []*ecdsa.PrivateKey{approved, other} {
+			pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+		}
+		add := pool.AddRemote
+		if tt.local {
+			add = pool.AddLocal
+		}
+		if err := add(newxtransaction(0, 100, approved)); err != tt.approved {
+			t.Errorf("test %d: approved sender error mismatch: have %v, want %v", i, err, tt.approved)
+		}
+		if err := add(newxtransaction(0, 100, other)); err != tt.other {
+			t.Errorf("test %d: other sender error mismatch: have %v, want %v", i, err, tt.other)
+		}
+		pool.Stop()
+	}
+}
+
+// Tests that a same nonce resubmission of a transaction demoted from pending to
+// the queue is rejected as overlapping it: the queued original is kept and the
+// discarded newcomer isn't journaled. The same goes for pending transactions.
+func TestTransactionQueuedOverlap(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txpool")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testTxPoolConfig
+	config.Journal = filepath.Join(dir, "transactions.msgp")
+
+	pool, key := setupTxPoolWithConfig(config)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key), newxtransaction(2, 100, key)}
+	for i, tx := range txs {
+		if err := pool.AddLocal(tx); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	// Drop the middle transaction, demoting the last one back into the queue
+	pool.mu.Lock()
+	pool.removeTx(txs[1].Hash(), dropEvicted)
+	pool.mu.Unlock()
+
+	if pending, queued := pool.Stats(); pending != 1 || queued != 1 {
+		t.Fatalf("pool stats mismatch after demotion: have %d/%d, want 1/1", pending, queued)
+	}
+	// Resubmit a different transaction at the demoted nonce
+	resubmit := newxtransaction(2, 200, key)
+	if err := pool.AddLocal(resubmit); err != ErrNonceOverlap {
+		t.Fatalf("queued overlap error mismatch: have %v, want %v", err, ErrNonceOverlap)
+	}
+	if pool.Get(resubmit.Hash()) != nil {
+		t.Errorf("overlapping resubmission stored")
+	}
+	// Resubmit a different transaction at the pending nonce
+	overlap := newxtransaction(0, 200, key)
+	if err := pool.AddRemote(overlap); err != ErrNonceOverlap {
+		t.Fatalf("pending overlap error mismatch: have %v, want %v", err, ErrNonceOverlap)
+	}
+	if have, status := pool.TransactionAt(from, 0); have != txs[0] || status != TxStatusPending {
+		t.Errorf("pending transaction mismatch: have %v (%v), want %x pending", have, status, txs[0].Hash())
+	}
+	if have, status := pool.TransactionAt(from, 2); have != txs[2] || status != TxStatusQueued {
+		t.Errorf("queued transaction mismatch: have %v (%v), want %x queued", have, status, txs[2].Hash())
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+	pool.Stop()
+
+	// Ensure only the original transactions were journaled
+	journaled := make(map[types.Hash]bool)
+	if err := newTxJournal(config.Journal, false).load(func(tx *transaction.Transaction, from types.Address, seen, _ time.Time) error {
+		journaled[tx.Hash()] = true
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if journaled[resubmit.Hash()] || journaled[overlap.Hash()] {
+		t.Errorf("overlapping resubmission journaled")
+	}
+	for i, tx := range txs {
+		if !journaled[tx.Hash()] {
+			t.Errorf("transaction %d: not journaled", i)
+		}
+	}
+}
+
+// Tests that only the pending transactions seen longer ago than the threshold
+// are reported as stuck, oldest first.
+func TestTransactionStuckTransactions(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key), newxtransaction(2, 100, key)}
+	for i, tx := range txs {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	queued := newxtransaction(4, 100, key)
+	if err := pool.AddRemote(queued); err != nil {
+		t.Fatalf("failed to add queued transaction: %v", err)
+	}
+	// Age the transactions by different amounts, the queued one the most
+	pool.mu.Lock()
+	pool.seen[txs[0].Hash()] = time.Now().Add(-2 * time.Hour)
+	pool.seen[txs[1].Hash()] = time.Now().Add(-3 * time.Hour)
+	pool.seen[queued.Hash()] = time.Now().Add(-4 * time.Hour)
+	pool.mu.Unlock()
+
+	stuck := pool.StuckTransactions(time.Hour)
+	if len(stuck) != 2 {
+		t.Fatalf("stuck transaction count mismatch: have %d, want %d", len(stuck), 2)
+	}
+	if stuck[0] != txs[1] || stuck[1] != txs[0] {
+		t.Errorf("stuck transactions mismatch: have nonces %d, %d, want 1, 0", stuck[0].Nonce(), stuck[1].Nonce())
+	}
+	if stuck := pool.StuckTransactions(5 * time.Hour); len(stuck) != 0 {
+		t.Errorf("transactions reported stuck below threshold: %v", stuck)
+	}
+}
+
+// Tests that disabling the global trimming keeps every transaction beyond the
+// global pending limit, whereas the default pool evicts the excess.
+func TestTransactionUnlimited(t *testing.T) {
+	t.Parallel()
+
+	for _, unlimited := range []bool{false, true} {
+		config := testTxPoolConfig
+		config.AccountSlots, config.GlobalSlots = 1, 4
+		config.GlobalQueue = 8
+
+		pool, key := setupTxPoolWithConfig(config)
+		pool.unlimited = unlimited
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+		// Fill the pool past the global pending limit
+		for i := uint64(0); i < 6; i++ {
+			if err := pool.AddRemote(newxtransaction(i, 100, key)); err != nil {
+				t.Fatalf("unlimited %v: transaction %d: failed to add: %v", unlimited, i, err)
+			}
+		}
+		pending, _ := pool.Stats()
+		if unlimited && pending != 6 {
+			t.Errorf("unlimited pool trimmed: have %d pending, want %d", pending, 6)
+		}
+		if !unlimited && pending > int(config.GlobalSlots) {
+			t.Errorf("limited pool not trimmed: have %d pending, want at most %d", pending, config.GlobalSlots)
+		}
+		if err := validateTxPoolInternals(pool); err != nil {
+			t.Errorf("unlimited %v: pool internal state corrupted: %v", unlimited, err)
+		}
+		pool.Stop()
+	}
+}
+
+// Benchmarks adding single transactions of a fresh account, reporting how many
+// times the sender is derived on the way in.
+func BenchmarkPoolSingleAddRecoveries(b *testing.B) {
+	pool, _ := setupTxPool()
+	defer pool.Stop()
+
+	signer := &countingSigner{Signer: pool.signer}
+	pool.signer = signer
+
+	txs := make(transaction.Transactions, b.N)
+	for i := range txs {
+		key, _ := crypto.GenerateKey()
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+		txs[i] = newxtransaction(0, 100, key)
+	}
+	b.ResetTimer()
+	for _, tx := range txs {
+		if err := pool.AddRemote(tx); err != nil {
+			b.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	b.ReportMetric(float64(signer.recoveries)/float64(b.N), "recoveries/op")
+}
+
+// Tests that transactions carrying a payload are only accepted towards contracts
+// if so configured, whereas plain transfers and contract creations always are.
+func TestTransactionRequireContractCode(t *testing.T) {
+	t.Parallel()
+
+	contract, account := types.Address{0x01}, types.Address{0x02}
+	sign := func(nonce uint64, to *types.Address, payload []byte, key *ecdsa.PrivateKey) *transaction.Transaction {
+		var tx *transaction.Transaction
+		if to == nil {
+			tx = transaction.NewContractCreation(nonce, big.NewInt(100), 0, big.NewInt(0), payload)
+		} else {
+			tx = transaction.NewTransaction(nonce, *to, big.NewInt(100), 0, big.NewInt(0), payload)
+		}
+		signed, _ := transaction.SignTx(tx, mSigner, key)
+		return signed
+	}
+	tests := []struct {
+		require bool
+		to      *types.Address
+		payload []byte
+		err     error
+	}{
+		{false, &account, []byte{0x01}, nil},
+		{true, &account, []byte{0x01}, ErrNoContractAtRecipient},
+		{true, &contract, []byte{0x01}, nil},
+		{true, &account, nil, nil},
+		{true, nil, []byte{0x01}, nil},
+	}
+	for i, tt := range tests {
+		config := testTxPoolConfig
+		config.RequireContractCode = tt.require
+
+		pool, key := setupTxPoolWithConfig(config)
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+		pool.currentState.SetCode(contract, []byte{0x60, 0x00})
+
+		if err := pool.AddRemote(sign(0, tt.to, tt.payload, key)); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		pool.Stop()
+	}
+}
+
+// failingWriter is an io.Writer rejecting every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("sink unavailable") }
+
+// Tests that every transaction accepted by the pool is copied to the mirror, and
+// that a failing mirror doesn't interfere with ingestion.
+func TestTransactionMirror(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	mirror := new(bytes.Buffer)
+	pool.SetMirror(mirror)
+
+	// Accept a few transactions and reject one, only the accepted ones must show up
+	for i := uint64(0); i < 3; i++ {
+		if err := pool.AddRemote(newxtransaction(i, 100, key)); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err == nil {
+		t.Fatalf("duplicate transaction accepted")
+	}
+	stream := msgp.NewReader(mirror)
+	for i := uint64(0); i < 3; i++ {
+		tx := new(transaction.Transaction)
+		if err := tx.DecodeMsg(stream); err != nil {
+			t.Fatalf("transaction %d: failed to decode mirror: %v", i, err)
+		}
+		if tx.Nonce() != i {
+			t.Fatalf("transaction %d: mirrored nonce mismatch: have %d, want %d", i, tx.Nonce(), i)
+		}
+	}
+	if mirror.Len() != 0 || stream.Buffered() != 0 {
+		t.Fatalf("unexpected data left in mirror")
+	}
+	// Swap in a broken sink and ensure transactions are still accepted
+	pool.SetMirror(failingWriter{})
+	if err := pool.AddRemote(newxtransaction(3, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction with failing mirror: %v", err)
+	}
+	if pending, _ := pool.Stats(); pending != 4 {
+		t.Fatalf("pending transactions mismatch: have %d, want %d", pending, 4)
+	}
+}
+
+// cachingCountingSigner is a counting signer which, unlike countingSigner, keeps
+// the sender cache of transactions working, equal only to itself.
+type cachingCountingSigner struct {
+	countingSigner
+}
+
+func (s *cachingCountingSigner) Equal(s2 transaction.Signer) bool {
+	other, ok := s2.(*cachingCountingSigner)
+	return ok && other == s
+}
+
+// Tests that transactions reinjected after a reorg skip the sender recovery if
+// their sender is cached, while still being checked against the new state.
+func TestTransactionReinjectCachedSender(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	signer := &cachingCountingSigner{countingSigner{Signer: pool.signer}}
+	pool.signer = signer
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+	pool.currentState.SetNonce(from, 1)
+
+	// Prime the sender caches of a valid and of a stale transaction
+	valid, stale := newxtransaction(1, 100, key), newxtransaction(0, 100, key)
+	transaction.Sender(pool.signer, valid)
+	transaction.Sender(pool.signer, stale)
+	signer.recoveries = 0
+
+	pool.mu.Lock()
+	errs := pool.addTxsLocked([]*transaction.Transaction{valid, stale}, false, true)
+	pool.mu.Unlock()
+
+	if errs[0] != nil {
+		t.Fatalf("failed to reinject valid transaction: %v", errs[0])
+	}
+	if errs[1] != ErrNonceTooLow {
+		t.Fatalf("stale reinjection error mismatch: have %v, want %v", errs[1], ErrNonceTooLow)
+	}
+	if signer.recoveries != 0 {
+		t.Fatalf("sender recovered for cached reinjections: %d times", signer.recoveries)
+	}
+	// Transactions without a cached sender must still be fully validated
+	pool.mu.Lock()
+	errs = pool.addTxsLocked([]*transaction.Transaction{newxtransaction(2, 100, key)}, false, true)
+	pool.mu.Unlock()
+
+	if errs[0] != nil {
+		t.Fatalf("failed to reinject uncached transaction: %v", errs[0])
+	}
+	if signer.recoveries != 1 {
+		t.Fatalf("sender recoveries mismatch: have %d, want %d", signer.recoveries, 1)
+	}
+}
+
+// Benchmarks reinjecting a large set of transactions after a reorg, with and
+// without their senders cached from the first time they entered the pool.
+func BenchmarkReinjectCached(b *testing.B)    { benchmarkReinject(b, true) }
+func BenchmarkReinjectRecovered(b *testing.B) { benchmarkReinject(b, false) }
+
+func benchmarkReinject(b *testing.B, cached bool) {
+	config := testTxPoolConfig
+	config.GlobalQueue = uint64(b.N)
+
+	pool, _ := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	signer := &cachingCountingSigner{countingSigner{Signer: pool.signer}}
+	pool.signer = signer
+
+	txs := make(transaction.Transactions, b.N)
+	for i := range txs {
+		key, _ := crypto.GenerateKey()
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+		txs[i] = newxtransaction(0, 100, key)
+		if cached {
+			transaction.Sender(pool.signer, txs[i])
+		}
+	}
+	signer.recoveries = 0
+
+	b.ResetTimer()
+	pool.mu.Lock()
+	pool.addTxsLocked(txs, false, true)
+	pool.mu.Unlock()
+	b.StopTimer()
+
+	if cached && signer.recoveries != 0 {
+		b.Fatalf("sender recovered for cached reinjections: %d times", signer.recoveries)
+	}
+	b.ReportMetric(float64(signer.recoveries)/float64(b.N), "recoveries/op")
+}
+
+// Tests that the account sequence reports exactly the nonces held by the pool,
+// gaps included, across the pending and queued transactions.
+func TestTransactionAccountSequence(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	if nonces := pool.AccountSequence(from); len(nonces) != 0 {
+		t.Fatalf("sequence of unknown account: %v", nonces)
+	}
+	for _, nonce := range []uint64{8, 1, 4, 0, 5, 2} {
+		if err := pool.AddRemote(newxtransaction(nonce, 100, key)); err != nil {
+			t.Fatalf("nonce %d: failed to add transaction: %v", nonce, err)
+		}
+	}
+	if pending, queued := pool.Stats(); pending != 3 || queued != 3 {
+		t.Fatalf("pool size mismatch: have %d/%d, want 3/3", pending, queued)
+	}
+	nonces := pool.AccountSequence(from)
+	if want := []uint64{0, 1, 2, 4, 5, 8}; fmt.Sprint(nonces) != fmt.Sprint(want) {
+		t.Fatalf("sequence mismatch: have %v, want %v", nonces, want)
+	}
+}
+
+// failingWriteCloser is an io.WriteCloser rejecting every write, as a journal
+// on a full disk would.
+type failingWriteCloser struct {
+	failingWriter
+}
+
+func (failingWriteCloser) Close() error { return nil }
+
+// Tests that journaling is suspended after repeated write failures without the
+// pool rejecting local transactions, and resumed by a successful rotation.
+func TestTransactionJournalSuspend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txpool")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testTxPoolConfig
+	config.Journal = filepath.Join(dir, "transactions.msgp")
+	config.JournalFailures = 3
+
+	pool, key := setupTxPoolWithConfig(config)
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	saved := journalSuspendCounter
+	journalSuspendCounter = new(metrics.StandardCounter)
+	defer func() { journalSuspendCounter = saved }()
+
+	// Break the journal as if its disk filled up
+	pool.mu.Lock()
+	pool.journal.writer = failingWriteCloser{}
+	pool.journal.buffer = bufio.NewWriterSize(pool.journal.writer, 16)
+	pool.mu.Unlock()
+
+	for i := uint64(0); i < 5; i++ {
+		if err := pool.AddLocal(newxtransaction(i, 100, key)); err != nil {
+			t.Fatalf("transaction %d: failed to add with broken journal: %v", i, err)
+		}
+		if i == 0 && pool.journalSuspended {
+			t.Fatalf("journal suspended before reaching the failure limit")
+		}
+	}
+	if !pool.journalSuspended {
+		t.Fatalf("journal not suspended after repeated failures")
+	}
+	if count := journalSuspendCounter.Count(); count != 1 {
+		t.Fatalf("suspension count mismatch: have %d, want %d", count, 1)
+	}
+	// Rotating onto a healthy file should resume journaling with everything
+	if err := pool.RotateJournal(); err != nil {
+		t.Fatalf("failed to rotate journal: %v", err)
+	}
+	if pool.journalSuspended || pool.journalFailures != 0 {
+		t.Fatalf("journal not resumed by rotation: suspended %v, failures %d", pool.journalSuspended, pool.journalFailures)
+	}
+	if err := pool.AddLocal(newxtransaction(5, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction after resume: %v", err)
+	}
+	pool.Stop()
+
+	loaded := 0
+	journal := newTxJournal(config.Journal, false)
+	if err := journal.load(func(*transaction.Transaction, types.Address, time.Time, time.Time) error { loaded++; return nil }); err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if loaded != 6 {
+		t.Fatalf("journaled transactions mismatch: have %d, want %d", loaded, 6)
+	}
+}
+
+// slowBlockChain is a test chain whose state retrieval, once stalled, blocks
+// until released, keeping the pool busy inside a reset.
+type slowBlockChain struct {
+	*testBlockChain
+	stall   int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (bc *slowBlockChain) StateAt(hash types.Hash) (*state.StateDB, error) {
+	if atomic.LoadInt32(&bc.stall) == 0 {
+		return bc.testBlockChain.StateAt(hash)
+	}
+	select {
+	case bc.entered <- struct{}{}:
+	default:
+	}
+	<-bc.release
+	return bc.testBlockChain.StateAt(hash)
+}
+
+// Tests that remote transactions are rejected while a reset runs for longer
+// than configured, whereas local ones wait for it to finish.
+func TestTransactionRejectDuringReorg(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.ReorgRejectDelay = 10 * time.Millisecond
+
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	chain := &slowBlockChain{
+		testBlockChain: &testBlockChain{statedb, new(event.Feed)},
+		entered:        make(chan struct{}, 1),
+		release:        make(chan struct{}),
+	}
+	pool := NewTxPool(config, TestChainConfig, chain)
+	defer pool.Stop()
+
+	key, _ := crypto.GenerateKey()
+	local, _ := crypto.GenerateKey()
+	statedb.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+	statedb.AddBalance(crypto.PubkeyToAddress(local.PublicKey), big.NewInt(1000000))
+
+	atomic.StoreInt32(&chain.stall, 1)
+
+	done := make(chan struct{})
+	go func() {
+		pool.lockedReset(nil, nil)
+		close(done)
+	}()
+	<-chain.entered
+
+	// Once the reset stalled past the delay, remote additions must bail out
+	time.Sleep(2 * config.ReorgRejectDelay)
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err != ErrReorgInProgress {
+		t.Fatalf("remote add error mismatch: have %v, want %v", err, ErrReorgInProgress)
+	}
+	if errs := pool.AddRemotes([]*transaction.Transaction{newxtransaction(0, 100, key)}); errs[0] != ErrReorgInProgress {
+		t.Fatalf("remote batch add error mismatch: have %v, want %v", errs[0], ErrReorgInProgress)
+	}
+	// Local additions must wait for the reset instead
+	added := make(chan error, 1)
+	go func() { added <- pool.AddLocal(newxtransaction(0, 100, local)) }()
+
+	select {
+	case err := <-added:
+		t.Fatalf("local add returned during reset: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(chain.release)
+	<-done
+
+	if err := <-added; err != nil {
+		t.Fatalf("failed to add local transaction after reset: %v", err)
+	}
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err != nil {
+		t.Fatalf("failed to add remote transaction after reset: %v", err)
+	}
+}
+
+// Tests that concurrent nonce reservations of an account get disjoint ranges
+// starting at its pending nonce, and that releasing them frees the unused ones.
+func TestTransactionReserveNonces(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+	if err := pool.AddRemote(newxtransaction(0, 100, key)); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	// Reserve two ranges concurrently and ensure they don't overlap
+	starts := make(chan uint64, 2)
+	releases := make(chan func(), 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			start, release := pool.ReserveNonces(from, 5)
+			starts <- start
+			releases <- release
+		}()
+	}
+	first, second := <-starts, <-starts
+	if first > second {
+		first, second = second, first
+	}
+	if first != 1 || second != 6 {
+		t.Fatalf("reserved ranges mismatch: have starts %d and %d, want 1 and 6", first, second)
+	}
+	release1, release2 := <-releases, <-releases
+
+	// Use part of the first range, releasing both should free the rest
+	for nonce := uint64(1); nonce < 3; nonce++ {
+		if err := pool.AddRemote(newxtransaction(nonce, 100, key)); err != nil {
+			t.Fatalf("nonce %d: failed to add reserved transaction: %v", nonce, err)
+		}
+	}
+	release1()
+	release2()
+	release2() // releasing twice must be harmless
+
+	if start, release := pool.ReserveNonces(from, 1); start != 3 {
+		t.Fatalf("reservation after release mismatch: have %d, want %d", start, 3)
+	} else {
+		release()
+	}
+	// An outstanding later reservation must keep an earlier released one taken
+	_, early := pool.ReserveNonces(from, 2)
+	late, _ := pool.ReserveNonces(from, 2)
+	early()
+	if start, _ := pool.ReserveNonces(from, 1); start != late+2 {
+		t.Fatalf("reservation behind outstanding one mismatch: have %d, want %d", start, late+2)
+	}
+}
+
+// Tests that tags attached to local transactions can be read back while they
+// are pooled, are recorded with their audit events and are cleared on removal.
+func TestTransactionTags(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txaudit")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testTxPoolConfig
+	config.AuditLog = filepath.Join(dir, "audit.log")
+
+	pool, key := setupTxPoolWithConfig(config)
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000))
+
+	tagged := newxtransaction(0, 100, key)
+	if err := pool.AddLocalTagged(tagged, "batch-7"); err != nil {
+		t.Fatalf("failed to add tagged transaction: %v", err)
+	}
+	if tag := pool.Tag(tagged.Hash()); tag != "batch-7" {
+		t.Fatalf("tag mismatch: have %q, want %q", tag, "batch-7")
+	}
+	// Retagging a known transaction or tagging a rejected one must not stick
+	if err := pool.AddLocalTagged(tagged, "batch-8"); err != nil {
+		t.Fatalf("identical local resubmission rejected: %v", err)
+	}
+	if tag := pool.Tag(tagged.Hash()); tag != "batch-7" {
+		t.Fatalf("tag overwritten by duplicate: have %q, want %q", tag, "batch-7")
+	}
+	rejected := newxtransaction(1, 10000, key)
+	if err := pool.AddLocalTagged(rejected, "batch-7"); err == nil {
+		t.Fatalf("unpayable transaction accepted")
+	}
+	if tag := pool.Tag(rejected.Hash()); tag != "" {
+		t.Fatalf("rejected transaction kept its tag: %q", tag)
+	}
+	// Mine the tagged transaction and ensure its tag is gone
+	pool.currentState.SetNonce(from, 1)
+	pool.lockedReset(nil, nil)
+
+	if pool.Get(tagged.Hash()) != nil {
+		t.Fatalf("mined transaction still pooled")
+	}
+	if tag := pool.Tag(tagged.Hash()); tag != "" {
+		t.Fatalf("mined transaction kept its tag: %q", tag)
+	}
+	pool.Stop()
+
+	// The drop of the mined transaction should have been audited with its tag
+	blob, err := ioutil.ReadFile(config.AuditLog)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(string(blob)), "\n") {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("failed to parse audit record %q: %v", line, err)
+		}
+		if record.Hash == tagged.Hash() && record.Event == "dropped:"+dropMined {
+			if record.Tag != "batch-7" {
+				t.Errorf("mined record tag mismatch: have %q, want %q", record.Tag, "batch-7")
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("no audit record of the mined transaction")
+	}
+}
+
+// reorgBlockChain is a test chain serving blocks by hash, allowing the pool to
+// walk the old and new branches of a reorg.
+type reorgBlockChain struct {
+	*testBlockChain
+	blocks map[types.Hash]*block.Block
+}
+
+func (bc *reorgBlockChain) GetBlock(hash types.Hash, num uint64) *block.Block {
+	return bc.blocks[hash]
+}
+
+// Tests that only MaxReinject of the transactions discarded by a reorg are put
+// back into the pool, local ones and lower nonces first.
+func TestTransactionMaxReinject(t *testing.T) {
+	config := testTxPoolConfig
+	config.MaxReinject = 4
+
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	chain := &reorgBlockChain{&testBlockChain{statedb, new(event.Feed)}, make(map[types.Hash]*block.Block)}
+
+	pool := NewTxPool(config, TestChainConfig, chain)
+	defer pool.Stop()
+
+	saved := reinjectDropCounter
+	reinjectDropCounter = new(metrics.StandardCounter)
+	defer func() { reinjectDropCounter = saved }()
+
+	remote, _ := crypto.GenerateKey()
+	local, _ := crypto.GenerateKey()
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(remote.PublicKey), big.NewInt(1000000))
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(local.PublicKey), big.NewInt(1000000))
+	pool.locals.add(crypto.PubkeyToAddress(local.PublicKey))
+
+	// Mine six transactions into a block which gets reorged out by an empty one
+	txs := transaction.Transactions{
+		newxtransaction(3, 100, remote), newxtransaction(2, 100, remote),
+		newxtransaction(1, 100, remote), newxtransaction(0, 100, remote),
+		newxtransaction(1, 100, local), newxtransaction(0, 100, local),
+	}
+
+	number := func(n int64) *types.BigInt { return types.NewBigInt(*big.NewInt(n)) }
+	genesis := block.NewBlock(&block.Header{Number: number(0)}, nil, nil)
+	old := block.NewBlock(&block.Header{ParentHash: genesis.Hash(), Number: number(1)}, txs, nil)
+	fork := block.NewBlock(&block.Header{ParentHash: genesis.Hash(), Number: number(1), Extra: []byte("fork")}, nil, nil)
+
+	for _, b := range []*block.Block{genesis, old, fork} {
+		chain.blocks[b.Hash()] = b
+	}
+	pool.lockedReset(old.Header(), fork.Header())
+
+	for i, tx := range txs {
+		reinjected := pool.Get(tx.Hash()) != nil
+		if want := i >= 2; reinjected != want {
+			t.Errorf("transaction %d (nonce %d): reinjected %v, want %v", i, tx.Nonce(), reinjected, want)
+		}
+	}
+	if pending, queued := pool.Stats(); pending != 4 || queued != 0 {
+		t.Errorf("pool size mismatch: have %d/%d, want 4/0", pending, queued)
+	}
+	if count := reinjectDropCounter.Count(); count != 2 {
+		t.Errorf("dropped reinjections mismatch: have %d, want %d", count, 2)
+	}
+}
+
+// Tests that the signer exposed by the pool derives the same senders the pool
+// itself does.
+func TestTransactionSigner(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	tx := newxtransaction(0, 100, key)
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000))
+	if err := pool.AddRemote(tx); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	pending, _ := pool.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("pending accounts mismatch: have %d, want %d", len(pending), 1)
+	}
+	var pooled types.Address
+	for addr := range pending {
+		pooled = addr
+	}
+	// Recover the sender directly, bypassing the sender cached by the pool
+	signer := pool.Signer()
+	if !signer.Equal(pool.signer) {
+		t.Fatalf("exposed signer differs from the pool's")
+	}
+	from, err := signer.Sender(tx)
+	if err != nil {
+		t.Fatalf("failed to derive sender: %v", err)
+	}
+	if from != pooled {
+		t.Fatalf("sender mismatch: have %x, want %x", from, pooled)
+	}
+}
+
+// Tests that the configuration sanitizer keeps at least one pending slot per
+// account and globally at least as many slots as a single account is granted.
+func TestTxPoolConfigSanitizeSlots(t *testing.T) {
+	tests := []struct {
+		account, global uint64
+		wantAccount     uint64
+		wantGlobal      uint64
+	}{
+		{16, 4096, 16, 4096}, // sane values are left alone
+		{0, 4096, 1, 4096},   // zero account slots would starve everyone
+		{0, 0, 1, 1},         // both raised to the minimum
+		{16, 8, 16, 16},      // global slots can't hold a single account
+	}
+	for i, tt := range tests {
+		config := testTxPoolConfig
+		config.AccountSlots, config.GlobalSlots = tt.account, tt.global
+
+		sane := config.sanitize()
+		if sane.AccountSlots != tt.wantAccount || sane.GlobalSlots != tt.wantGlobal {
+			t.Errorf("test %d: slots mismatch: have %d/%d, want %d/%d", i, sane.AccountSlots, sane.GlobalSlots, tt.wantAccount, tt.wantGlobal)
+		}
+	}
+}
+
+// Tests that only the next nonce transaction of every pending account is
+// reported as executable.
+func TestTransactionExecutable(t *testing.T) {
+	t.Parallel()
+
+	pool, _ := setupTxPool()
+	defer pool.Stop()
+
+	keys := make([]*ecdsa.PrivateKey, 3)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+		from := crypto.PubkeyToAddress(keys[i].PublicKey)
+		pool.currentState.AddBalance(from, big.NewInt(1000000))
+		pool.currentState.SetNonce(from, uint64(i))
+	}
+	pool.lockedReset(nil, nil)
+
+	// Every account gets a few pending and one queued transaction
+	for i := range keys {
+		for nonce := uint64(i); nonce < uint64(i)+3; nonce++ {
+			if err := pool.AddRemote(newxtransaction(nonce, 100, keys[i])); err != nil {
+				t.Fatalf("account %d, nonce %d: failed to add transaction: %v", i, nonce, err)
+			}
+		}
+		if err := pool.AddRemote(newxtransaction(uint64(i)+5, 100, keys[i])); err != nil {
+			t.Fatalf("account %d: failed to add queued transaction: %v", i, err)
+		}
+	}
+	// An account with queued transactions only must not show up
+	queuedKey, _ := crypto.GenerateKey()
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(queuedKey.PublicKey), big.NewInt(1000000))
+	if err := pool.AddRemote(newxtransaction(1, 100, queuedKey)); err != nil {
+		t.Fatalf("failed to add queued transaction: %v", err)
+	}
+	executable := pool.Executable()
+	if len(executable) != len(keys) {
+		t.Fatalf("executable accounts mismatch: have %d, want %d", len(executable), len(keys))
+	}
+	for i, key := range keys {
+		from := crypto.PubkeyToAddress(key.PublicKey)
+		txs := executable[from]
+		if len(txs) != 1 {
+			t.Fatalf("account %d: executable transactions mismatch: have %d, want 1", i, len(txs))
+		}
+		if nonce := pool.currentState.GetNonce(from); txs[0].Nonce() != nonce {
+			t.Errorf("account %d: executable nonce mismatch: have %d, want %d", i, txs[0].Nonce(), nonce)
+		}
+	}
+}
+
+// Tests that resubmitting an identical local transaction is a no-op success,
+// while remote duplicates are still rejected.
+func TestTransactionLocalResubmit(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	tx := newxtransaction(0, 100, key)
+	if err := pool.AddLocal(tx); err != nil {
+		t.Fatalf("failed to add local transaction: %v", err)
+	}
+	if err := pool.AddLocal(tx); err != nil {
+		t.Fatalf("identical local resubmission rejected: %v", err)
+	}
+	if err := pool.AddRemote(tx); err == nil {
+		t.Fatalf("remote duplicate accepted")
+	}
+	pending, queued := pool.Stats()
+	if pending != 1 || queued != 0 {
+		t.Fatalf("pool contents mismatch: have %d pending, %d queued, want 1, 0", pending, queued)
+	}
+	// A remote transaction resubmitted locally is still a duplicate
+	remoteKey, _ := crypto.GenerateKey()
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(remoteKey.PublicKey), big.NewInt(1000000))
+
+	remote := newxtransaction(0, 100, remoteKey)
+	if err := pool.AddRemote(remote); err != nil {
+		t.Fatalf("failed to add remote transaction: %v", err)
+	}
+	if err := pool.AddLocal(remote); err == nil {
+		t.Fatalf("local resubmission of remote transaction accepted")
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that batch simulations flag the transactions the pool would refuse,
+// accounting for the ones accepted earlier in the batch, without touching it.
+func TestTransactionSimulateBatch(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.AccountQueue = 4
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	// Two executable transactions, one duplicate and six gapped ones of which
+	// only the first four fit into the account's queue
+	txs := []*transaction.Transaction{
+		newxtransaction(0, 100, key),
+		newxtransaction(1, 100, key),
+	}
+	txs = append(txs, txs[1])
+	for i := uint64(3); i < 9; i++ {
+		txs = append(txs, newxtransaction(i, 100, key))
+	}
+	errs := pool.SimulateBatch(txs)
+	if len(errs) != len(txs) {
+		t.Fatalf("result count mismatch: have %d, want %d", len(errs), len(txs))
+	}
+	for i, err := range errs {
+		switch {
+		case i == 2:
+			if err == nil {
+				t.Errorf("transaction %d: duplicate in batch accepted", i)
+			}
+		case i < 7:
+			if err != nil {
+				t.Errorf("transaction %d: unexpected error: %v", i, err)
+			}
+		default:
+			if err != ErrAccountLimit {
+				t.Errorf("transaction %d: error mismatch: have %v, want %v", i, err, ErrAccountLimit)
+			}
+		}
+	}
+	if pending, queued := pool.Stats(); pending != 0 || queued != 0 || len(pool.all) != 0 {
+		t.Fatalf("pool mutated by simulation: %d pending, %d queued, %d known", pending, queued, len(pool.all))
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that unsigned transactions are reported as such instead of as carrying
+// a bad signature.
+func TestTransactionUnsigned(t *testing.T) {
+	unsigned, signatures := unsignedCounter.Count(), badSignatureCounter.Count()
+
+	pool, _ := setupTxPool()
+	defer pool.Stop()
+
+	tx := transaction.NewTransaction(0, types.Address{}, big.NewInt(100), 0, big.NewInt(0), nil)
+	err := pool.AddRemote(tx)
+	if err != ErrUnsigned {
+		t.Fatalf("unsigned transaction error mismatch: have %v, want %v", err, ErrUnsigned)
+	}
+	if !errors.Is(err, ErrInvalidSender) || !errors.Is(err, transaction.ErrUnsignedTransaction) {
+		t.Errorf("unsigned transaction error %v doesn't match the sender errors", err)
+	}
+	if stats := pool.RejectionStats(); stats["unsigned"] != 1 || stats["bad-signature"] != 0 {
+		t.Errorf("rejection stats mismatch: have %v, want 1 unsigned, 0 bad signatures", stats)
+	}
+	// The metrics are only collected if enabled
+	if metrics.Enabled {
+		if count := unsignedCounter.Count() - unsigned; count != 1 {
+			t.Errorf("unsigned count mismatch: have %d, want %d", count, 1)
+		}
+		if count := badSignatureCounter.Count() - signatures; count != 0 {
+			t.Errorf("bad signature count mismatch: have %d, want %d", count, 0)
+		}
+	}
+}
+
+// Tests that the heartbeats of accounts with journaled transactions survive a
+// restart, so the reloaded transactions keep their age instead of starting over.
+func TestTransactionJournalHeartbeats(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "txpool")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testTxPoolConfig
+	config.Journal = filepath.Join(dir, "transactions.msgp")
+
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	blockchain := &testBlockChain{statedb, new(event.Feed)}
+
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	statedb.AddBalance(from, big.NewInt(1000000))
+
+	// Queue a transaction and age its account before stopping the pool
+	pool := NewTxPool(config, TestChainConfig, blockchain)
+	tx := newxtransaction(1, 100, key)
+	if err := pool.AddLocal(tx); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	aged := time.Now().Add(-time.Hour).Round(0)
+
+	pool.mu.Lock()
+	pool.beats[from] = aged
+	pool.seen[tx.Hash()] = aged
+	pool.mu.Unlock()
+
+	if err := pool.RotateJournal(); err != nil {
+		t.Fatalf("failed to rotate journal: %v", err)
+	}
+	pool.Stop()
+
+	// Reload the journal and ensure the account's heartbeat was restored
+	pool = NewTxPool(config, TestChainConfig, blockchain)
+	defer pool.Stop()
+
+	if _, queued := pool.Stats(); queued != 1 {
+		t.Fatalf("queued transactions mismatch: have %d, want %d", queued, 1)
+	}
+	pool.mu.RLock()
+	beat, seen := pool.beats[from], pool.seen[tx.Hash()]
+	pool.mu.RUnlock()
+
+	if !beat.Equal(aged) {
+		t.Errorf("heartbeat mismatch: have %v, want %v", beat, aged)
+	}
+	if !seen.Equal(aged) {
+		t.Errorf("first seen time mismatch: have %v, want %v", seen, aged)
+	}
+}
+
+// lookupBlockChain is a test chain which can locate included transactions.
+type lookupBlockChain struct {
+	*testBlockChain
+	included map[types.Hash][2]uint64 // Block number and index of included transactions
+}
+
+func (bc *lookupBlockChain) GetTxLookupEntry(hash types.Hash) (types.Hash, uint64, uint64) {
+	pos, ok := bc.included[hash]
+	if !ok {
+		return types.Hash{}, 0, 0
+	}
+	return types.Hash{0x01}, pos[0], pos[1]
+}
+
+// Tests that detailed statuses report pooled transactions as such and carry the
+// chain position of included ones.
+func TestTransactionStatusDetailed(t *testing.T) {
+	t.Parallel()
+
+	key, _ := crypto.GenerateKey()
+	included := newxtransaction(0, 100, key)
+
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	chain := &lookupBlockChain{
+		testBlockChain: &testBlockChain{statedb, new(event.Feed)},
+		included:       map[types.Hash][2]uint64{included.Hash(): {7, 3}},
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	statedb.AddBalance(from, big.NewInt(1000000))
+	statedb.SetNonce(from, 1)
+
+	pool := NewTxPool(testTxPoolConfig, TestChainConfig, chain)
+	defer pool.Stop()
+
+	pending, queued := newxtransaction(1, 100, key), newxtransaction(3, 100, key)
+	for _, tx := range []*transaction.Transaction{pending, queued} {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	unknown := newxtransaction(5, 100, key)
+
+	infos := pool.StatusDetailed([]types.Hash{pending.Hash(), queued.Hash(), included.Hash(), unknown.Hash()})
+	want := []TxStatus{TxStatusPending, TxStatusQueued, TxStatusIncluded, TxStatusUnknown}
+	for i, info := range infos {
+		if info.Status != want[i] {
+			t.Errorf("status %d: mismatch: have %v, want %v", i, info.Status, want[i])
+		}
+		if i != 2 && (info.BlockNumber != nil || info.Index != nil) {
+			t.Errorf("status %d: unexpected block info: %v, %v", i, info.BlockNumber, info.Index)
+		}
+	}
+	if info := infos[2]; info.BlockNumber == nil || *info.BlockNumber != 7 || info.Index == nil || *info.Index != 3 {
+		t.Errorf("included block info mismatch: have %v, %v, want 7, 3", info.BlockNumber, info.Index)
+	}
+}
+
+// Tests that a long executable queue is promoted in batches of the configured
+// size, the rest following in later passes once the lock was released.
+func TestTransactionPromoteBatchSize(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.PromoteBatchSize = 4
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	// Queue up a gapped sequence, then fill the gap while holding the lock to
+	// observe the first pass only
+	for i := uint64(1); i < 20; i++ {
+		if err := pool.AddRemote(newxtransaction(i, 100, key)); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	pool.mu.Lock()
+	if err := pool.addTxLocked(newxtransaction(0, 100, key), false); err != nil {
+		pool.mu.Unlock()
+		t.Fatalf("failed to add gap filler: %v", err)
+	}
+	pending, queued := pool.stats()
+	pool.mu.Unlock()
+
+	if pending != config.PromoteBatchSize || queued != 20-config.PromoteBatchSize {
+		t.Fatalf("first pass mismatch: have %d pending, %d queued, want %d, %d", pending, queued, config.PromoteBatchSize, 20-config.PromoteBatchSize)
+	}
+	// The deferred passes should promote the rest
+	for deadline := time.Now().Add(time.Second); ; {
+		if pending, _ = pool.Stats(); pending == 20 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deferred promotions stalled: have %d pending, want %d", pending, 20)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that refused transactions are counted by rejection reason.
+func TestTransactionRejectionStats(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000))
+	pool.currentState.SetNonce(from, 1)
+
+	known := newxtransaction(1, 100, key)
+	if err := pool.AddRemote(known); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	pool.AddRemote(known)
+	pool.AddRemote(newxtransaction(0, 100, key))
+	pool.AddRemote(newxtransaction(3, 100, key))
+	pool.AddRemote(newxtransaction(2, 100000, key))
+	pool.AddRemote(newxtransaction(4, 100000, key))
+	pool.AddRemote(transaction.NewTransaction(5, types.Address{}, big.NewInt(1), 0, big.NewInt(0), make([]byte, 33*1024)))
+
+	stats := pool.RejectionStats()
+	want := map[string]uint64{
+		"known":              1,
+		"nonce-too-low":      1,
+		"insufficient-funds": 2,
+		"oversized":          1,
+	}
+	if len(stats) != len(want) {
+		t.Errorf("rejection reasons mismatch: have %v, want %v", stats, want)
+	}
+	for reason, count := range want {
+		if stats[reason] != count {
+			t.Errorf("reason %s: count mismatch: have %d, want %d", reason, stats[reason], count)
+		}
+	}
+	// The returned stats are a snapshot
+	stats["known"] = 100
+	if count := pool.RejectionStats()["known"]; count != 1 {
+		t.Errorf("stats snapshot aliased: have %d, want %d", count, 1)
+	}
+}
+
+// Tests that many concurrent Content readers, sharing the read lock, don't race
+// on the lazily sorted transaction lists. Meant to be run with -race.
+func TestTransactionConcurrentContent(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+	for i := uint64(0); i < 16; i++ {
+		if err := pool.AddRemote(newxtransaction(i, 100, key)); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+		if err := pool.AddRemote(newxtransaction(i+32, 100, key)); err != nil {
+			t.Fatalf("transaction %d: failed to queue: %v", i+32, err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pending, queued := pool.Content()
+				for _, txs := range pending {
+					if len(txs) != 16 {
+						t.Errorf("pending content mismatch: have %d, want %d", len(txs), 16)
+						return
+					}
+				}
+				for _, txs := range queued {
+					if len(txs) != 16 {
+						t.Errorf("queued content mismatch: have %d, want %d", len(txs), 16)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Tests that accounts with equal heartbeats are ordered by address, so that the
+// eviction order under queue pressure is deterministic.
+func TestAddressByHeartbeatTieBreak(t *testing.T) {
+	t.Parallel()
+
+	beat := time.Now()
+	low, high := types.Address{0x01}, types.Address{0x02}
+
+	for i := 0; i < 8; i++ {
+		addresses := addresssByHeartbeat{{high, beat}, {low, beat}, {types.Address{0x03}, beat.Add(-time.Second)}}
+		if i%2 == 1 {
+			addresses[0], addresses[1] = addresses[1], addresses[0]
+		}
+		sort.Sort(addresses)
+
+		if addresses[0].address != (types.Address{0x03}) {
+			t.Fatalf("run %d: oldest heartbeat not first: %x", i, addresses[0].address)
+		}
+		if addresses[1].address != low || addresses[2].address != high {
+			t.Fatalf("run %d: tie not broken by address: have %x, %x", i, addresses[1].address, addresses[2].address)
+		}
+	}
+}
+
+// Tests that a gapped queued transaction can be forced into pending when
+// allowed, and that anything but a queued transaction is refused.
+func TestTransactionForcePromote(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.AllowForcePromote = true
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	pending, gapped := newxtransaction(0, 100, key), newxtransaction(5, 100, key)
+	for _, tx := range []*transaction.Transaction{pending, gapped} {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	if err := pool.ForcePromote(gapped.Hash()); err != nil {
+		t.Fatalf("failed to force promote gapped transaction: %v", err)
+	}
+	if status := pool.Status([]types.Hash{gapped.Hash()})[0]; status != TxStatusPending {
+		t.Fatalf("forced transaction status mismatch: have %v, want %v", status, TxStatusPending)
+	}
+	if pending, queued := pool.Stats(); pending != 2 || queued != 0 {
+		t.Fatalf("pool stats mismatch: have %d pending, %d queued, want 2, 0", pending, queued)
+	}
+	// Pending and unknown transactions aren't queued
+	if err := pool.ForcePromote(pending.Hash()); err != ErrNotQueued {
+		t.Errorf("pending transaction error mismatch: have %v, want %v", err, ErrNotQueued)
+	}
+	if err := pool.ForcePromote(types.Hash{0x01}); err != ErrNotQueued {
+		t.Errorf("unknown transaction error mismatch: have %v, want %v", err, ErrNotQueued)
+	}
+	// Without the configuration flag the hook is refused
+	guarded, _ := setupTxPool()
+	defer guarded.Stop()
+
+	if err := guarded.ForcePromote(gapped.Hash()); err != ErrForcePromoteDisabled {
+		t.Errorf("guard error mismatch: have %v, want %v", err, ErrForcePromoteDisabled)
+	}
+}
+
+// Tests that replacing a pooled transaction notifies subscribers of both the
+// replaced and the live transaction.
+func TestTransactionReplaceEvent(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	events := make(chan core.TxReplaceEvent, 1)
+	sub := pool.SubscribeTxReplaceEvent(events)
+	defer sub.Unsubscribe()
+
+	old := newxtransaction(0, 100, key)
+	if err := pool.AddRemote(old); err != nil {
+		t.Fatalf("failed to add transaction: %v", err)
+	}
+	replacement := newxtransaction(0, 0, key)
+	if err := pool.Cancel(from, 0, replacement); err != nil {
+		t.Fatalf("failed to replace transaction: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Old != old || ev.New != replacement {
+			t.Fatalf("replace event mismatch: have %x -> %x, want %x -> %x", ev.Old.Hash(), ev.New.Hash(), old.Hash(), replacement.Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("replace event not fired")
+	}
+}
+
+// Tests that contract creations are held to their own, larger size limit while
+// calls and transfers keep the stricter one.
+func TestTransactionCreationSizeLimit(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.MaxTxSize = 32 * 1024
+	config.MaxCreationSize = 64 * 1024
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	call, _ := transaction.SignTx(transaction.NewTransaction(0, types.Address{0x01}, big.NewInt(100), 0, big.NewInt(0), make([]byte, 40*1024)), mSigner, key)
+	if err := pool.AddRemote(call); err != ErrOversizedData {
+		t.Errorf("oversized call error mismatch: have %v, want %v", err, ErrOversizedData)
+	}
+	creation, _ := transaction.SignTx(transaction.NewContractCreation(0, big.NewInt(0), 0, big.NewInt(0), make([]byte, 40*1024)), mSigner, key)
+	if err := pool.AddRemote(creation); err != nil {
+		t.Errorf("large creation rejected: %v", err)
+	}
+	oversized, _ := transaction.SignTx(transaction.NewContractCreation(1, big.NewInt(0), 0, big.NewInt(0), make([]byte, 65*1024)), mSigner, key)
+	if err := pool.AddRemote(oversized); err != ErrOversizedData {
+		t.Errorf("oversized creation error mismatch: have %v, want %v", err, ErrOversizedData)
+	}
+}
+
+// stateCountingBlockChain is a test chain counting the state retrievals, one of
+// which is done by every pool reset.
+type stateCountingBlockChain struct {
+	*testBlockChain
+	retrievals int32 // Number of StateAt calls (atomic)
+}
+
+func (bc *stateCountingBlockChain) StateAt(hash types.Hash) (*state.StateDB, error) {
+	atomic.AddInt32(&bc.retrievals, 1)
+	return bc.testBlockChain.StateAt(hash)
+}
+
+// Tests that a chain head announced twice only resets the pool once.
+func TestTransactionDuplicateChainHead(t *testing.T) {
+	t.Parallel()
+
+	db, _ := database.OpenMemDB()
+	statedb, _ := state.New(types.Hash{}, state.NewDatabase(db))
+	chain := &stateCountingBlockChain{testBlockChain: &testBlockChain{statedb, new(event.Feed)}}
+
+	pool := NewTxPool(testTxPoolConfig, TestChainConfig, chain)
+	defer pool.Stop()
+
+	head := chain.CurrentBlock()
+	next := block.NewBlock(&block.Header{ParentHash: head.Hash()}, nil, nil)
+
+	before := atomic.LoadInt32(&chain.retrievals)
+	head = pool.chainHead(head, core.ChainHeadEvent{Block: next})
+	head = pool.chainHead(head, core.ChainHeadEvent{Block: next})
+
+	if head != next {
+		t.Fatalf("pool head mismatch: have %x, want %x", head.Hash(), next.Hash())
+	}
+	if resets := atomic.LoadInt32(&chain.retrievals) - before; resets != 1 {
+		t.Fatalf("reset count mismatch: have %d, want %d", resets, 1)
+	}
+}
+
+// Tests that the pending set of an account can be swapped for another one as a
+// whole, announcing the swapped transactions as replaced, and that a faulty set
+// leaves the pool untouched.
+func TestTransactionReplaceAccountPending(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	events := make(chan core.TxReplaceEvent, 4)
+	sub := pool.SubscribeTxReplaceEvent(events)
+	defer sub.Unsubscribe()
+
+	old := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 100, key), newxtransaction(2, 100, key)}
+	for i, tx := range old {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	// A set with a nonce gap must be refused as a whole
+	gapped := transaction.Transactions{newxtransaction(0, 200, key), newxtransaction(2, 200, key)}
+	errs := pool.ReplaceAccountPending(from, gapped)
+	if errs[0] != nil || errs[1] != ErrNonceGap {
+		t.Fatalf("gapped set errors mismatch: have %v, want [nil %v]", errs, ErrNonceGap)
+	}
+	for i, tx := range old {
+		if pool.Get(tx.Hash()) == nil {
+			t.Fatalf("transaction %d: dropped by refused replacement", i)
+		}
+	}
+	// A contiguous set must replace the old one entirely
+	fresh := transaction.Transactions{newxtransaction(0, 200, key), newxtransaction(1, 200, key)}
+	for i, err := range pool.ReplaceAccountPending(from, fresh) {
+		if err != nil {
+			t.Fatalf("transaction %d: replacement failed: %v", i, err)
+		}
+	}
+	for i, tx := range old {
+		if pool.Get(tx.Hash()) != nil {
+			t.Errorf("transaction %d: old transaction still pooled", i)
+		}
+	}
+	pending, _ := pool.Content()
+	if txs := pending[from]; len(txs) != len(fresh) || txs[0] != fresh[0] || txs[1] != fresh[1] {
+		t.Fatalf("pending set mismatch: have %v, want %v", txs, fresh)
+	}
+	if nonce := pool.State().GetNonce(from); nonce != 2 {
+		t.Errorf("pending nonce mismatch: have %d, want %d", nonce, 2)
+	}
+	// Only the swapped nonces are announced as replaced, the refused set and
+	// the dropped tail beyond the new set are not
+	for i := range fresh {
+		select {
+		case ev := <-events:
+			if nonce := ev.New.Nonce(); nonce >= uint64(len(fresh)) || ev.New != fresh[nonce] || ev.Old != old[nonce] {
+				t.Errorf("replace event %d mismatch: have %x -> %x", i, ev.Old.Hash(), ev.New.Hash())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("replace event %d not fired", i)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected replace event: %x -> %x", ev.Old.Hash(), ev.New.Hash())
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that draining the pool hands out the pending transactions once, leaving
+// the queued ones in place to be promoted behind the drained ones.
+func TestTransactionDrain(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	for _, nonce := range []uint64{0, 1, 2, 4} {
+		if err := pool.AddRemote(newxtransaction(nonce, 100, key)); err != nil {
+			t.Fatalf("nonce %d: failed to add transaction: %v", nonce, err)
+		}
+	}
+	drained := pool.Drain()
+	if len(drained) != 1 || len(drained[from]) != 3 {
+		t.Fatalf("drained transactions mismatch: have %v, want 3 of one account", drained)
+	}
+	for i, tx := range drained[from] {
+		if tx.Nonce() != uint64(i) {
+			t.Errorf("drained transaction %d: nonce mismatch: have %d, want %d", i, tx.Nonce(), i)
+		}
+		if pool.Get(tx.Hash()) != nil {
+			t.Errorf("drained transaction %d still in pool", i)
+		}
+	}
+	if pending, queued := pool.Stats(); pending != 0 || queued != 1 {
+		t.Fatalf("pool stats mismatch: have %d pending %d queued, want 0 and 1", pending, queued)
+	}
+	if drained := pool.Drain(); len(drained) != 0 {
+		t.Fatalf("second drain returned transactions: %v", drained)
+	}
+	// Filling the gap promotes it along with the queued transaction behind it
+	if err := pool.AddRemote(newxtransaction(3, 100, key)); err != nil {
+		t.Fatalf("failed to add gap filling transaction: %v", err)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+	drained = pool.Drain()
+	if len(drained[from]) != 2 || drained[from][0].Nonce() != 3 || drained[from][1].Nonce() != 4 {
+		t.Fatalf("drained transactions after promotion mismatch: have %v, want nonces 3 and 4", drained[from])
+	}
+}
+
+// Tests that the BeforeDrop hook can spare a transaction from eviction while the
+// others are dropped, but only up to the configured number of passes.
+func TestTransactionBeforeDrop(t *testing.T) {
+	t.Parallel()
+
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txs := transaction.Transactions{newxtransaction(1, 100, key), newxtransaction(2, 100, key), newxtransaction(3, 100, key)}
+	vetoed := txs[1].Hash()
+
+	var reasons []string
+	config := testTxPoolConfig
+	config.BeforeDropRetain = 1
+	config.BeforeDrop = func(tx *transaction.Transaction, reason string) bool {
+		reasons = append(reasons, reason)
+		return tx.Hash() != vetoed
+	}
+	pool, _ := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+	for _, tx := range txs {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	// Age the account beyond the lifetime and run an eviction round
+	pool.mu.Lock()
+	pool.beats[from] = time.Now().Add(-2 * config.Lifetime)
+	pool.evictStale()
+	pool.mu.Unlock()
+
+	if pool.Get(vetoed) == nil {
+		t.Fatalf("vetoed transaction evicted")
+	}
+	if pool.Get(txs[0].Hash()) != nil || pool.Get(txs[2].Hash()) != nil {
+		t.Errorf("unvetoed transactions not evicted")
+	}
+	for i, reason := range reasons {
+		if reason != dropEvicted {
+			t.Errorf("hook call %d: reason mismatch: have %q, want %q", i, reason, dropEvicted)
+		}
+	}
+	// Having been spared once already, the next pass drops it regardless
+	pool.mu.Lock()
+	pool.beats[from] = time.Now().Add(-2 * config.Lifetime)
+	pool.evictStale()
+	pool.mu.Unlock()
+
+	if pool.Get(vetoed) != nil {
+		t.Errorf("vetoed transaction retained beyond the limit")
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
+
+// Tests that the pool inspection reports every transaction with its fields in
+// the right account and bucket.
+func TestTransactionInspect(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	other, _ := crypto.GenerateKey()
+	from, otherFrom := crypto.PubkeyToAddress(key.PublicKey), crypto.PubkeyToAddress(other.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+	pool.currentState.AddBalance(otherFrom, big.NewInt(1000000))
+
+	txs := transaction.Transactions{newxtransaction(0, 100, key), newxtransaction(1, 200, key), newxtransaction(3, 300, key)}
+	queued := newxtransaction(2, 400, other)
+	for _, tx := range append(txs, queued) {
+		if err := pool.AddRemote(tx); err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	content := pool.Inspect()
+	if len(content) != 2 {
+		t.Fatalf("inspected accounts mismatch: have %d, want 2", len(content))
+	}
+	check := func(account types.Address, bucket string, want transaction.Transactions) {
+		have := content[account.Hex()][bucket]
+		if len(have) != len(want) {
+			t.Fatalf("%x %s: transaction count mismatch: have %d, want %d", account, bucket, len(have), len(want))
+		}
+		for i, tx := range want {
+			summary := have[i]
+			if summary.Nonce != tx.Nonce() || summary.Hash != tx.Hash() || summary.From != account {
+				t.Errorf("%x %s %d: summary mismatch: have %+v, want nonce %d hash %x", account, bucket, i, summary, tx.Nonce(), tx.Hash())
+			}
+			if summary.To == nil || *summary.To != *tx.To() {
+				t.Errorf("%x %s %d: recipient mismatch: have %v, want %x", account, bucket, i, summary.To, *tx.To())
+			}
+			if summary.Value.Cmp(tx.Value()) != 0 {
+				t.Errorf("%x %s %d: value mismatch: have %v, want %v", account, bucket, i, summary.Value, tx.Value())
+			}
+		}
+	}
+	check(from, "pending", txs[:2])
+	check(from, "queued", txs[2:])
+	check(otherFrom, "queued", transaction.Transactions{queued})
+	if _, ok := content[otherFrom.Hex()]["pending"]; ok {
+		t.Errorf("pending bucket reported for account without pending transactions")
+	}
+}
+
+// Tests that an account passed multiple times to promoteExecutables is processed
+// once only, not getting a promotion batch per occurrence.
+func TestTransactionPromoteDuplicateAccounts(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.PromoteBatchSize = 2
+
+	pool, key := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	// Queue up an executable sequence without promoting it, then promote while
+	// holding the lock to observe a single pass only
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for i := uint64(0); i < 8; i++ {
+		tx := newxtransaction(i, 100, key)
+		if _, err := pool.enqueueTx(from, tx.Hash(), tx); err != nil {
+			t.Fatalf("transaction %d: failed to enqueue: %v", i, err)
+		}
+	}
+	pool.promoteExecutables([]types.Address{from, from, from})
+
+	if pending, queued := pool.stats(); pending != config.PromoteBatchSize || queued != 8-config.PromoteBatchSize {
+		t.Fatalf("promotion mismatch: have %d pending, %d queued, want %d, %d", pending, queued, config.PromoteBatchSize, 8-config.PromoteBatchSize)
+	}
+}
+
+// Tests that the current nonce reflects the head state only, regardless of the
+// pending transactions advancing the virtual nonce.
+func TestTransactionCurrentNonce(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+	pool.currentState.SetNonce(from, 2)
+	pool.lockedReset(nil, nil)
+
+	for nonce := uint64(2); nonce < 5; nonce++ {
+		if err := pool.AddRemote(newxtransaction(nonce, 100, key)); err != nil {
+			t.Fatalf("nonce %d: failed to add transaction: %v", nonce, err)
+		}
+	}
+	if nonce := pool.State().GetNonce(from); nonce != 5 {
+		t.Fatalf("pending nonce mismatch: have %d, want %d", nonce, 5)
+	}
+	if nonce := pool.CurrentNonce(from); nonce != 2 {
+		t.Errorf("current nonce mismatch: have %d, want %d", nonce, 2)
+	}
+	if nonce := pool.CurrentNonce(types.Address{0x01}); nonce != 0 {
+		t.Errorf("unknown account nonce mismatch: have %d, want %d", nonce, 0)
+	}
+}
+
+// Tests that the next batch of a deferred promotion is spared from the account
+// queue cap, but that everything queued behind it still counts against the
+// allowance, so the batch size doesn't let a remote sender evade the limits.
+func TestTransactionPromoteBatchAccountQueue(t *testing.T) {
+	t.Parallel()
+
+	config := testTxPoolConfig
+	config.PromoteBatchSize = 4
+	config.AccountQueue = 4
+
+	pool, _ := setupTxPoolWithConfig(config)
+	defer pool.Stop()
+
+	// Queue up an executable sequence without promoting it, then promote
+	enqueue := func(count uint64) types.Address {
+		key, _ := crypto.GenerateKey()
+		from := crypto.PubkeyToAddress(key.PublicKey)
+
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		pool.currentState.AddBalance(from, big.NewInt(1000000))
+		for i := uint64(0); i < count; i++ {
+			tx := newxtransaction(i, 100, key)
+			if _, err := pool.enqueueTx(from, tx.Hash(), tx); err != nil {
+				t.Fatalf("transaction %d: failed to enqueue: %v", i, err)
+			}
+		}
+		pool.promoteExecutables([]types.Address{from})
+		return from
+	}
+	// A sequence within a batch plus the allowance is promoted in full
+	fits := uint64(2*config.PromoteBatchSize) + config.AccountQueue
+	within := enqueue(fits)
+
+	// A longer sequence gets its tail past the allowance trimmed
+	over := enqueue(fits + 8)
+
+	// The deferred passes should promote the rest of both
+	for deadline := time.Now().Add(time.Second); ; {
+		pool.mu.RLock()
+		settled := pool.queue[within] == nil && pool.queue[over] == nil
+		pool.mu.RUnlock()
+		if settled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deferred promotions stalled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	if have := uint64(pool.pending[within].Len()); have != fits {
+		t.Errorf("in-allowance account pending mismatch: have %d, want %d", have, fits)
+	}
+	if have := uint64(pool.pending[over].Len()); have != fits {
+		t.Errorf("over-allowance account pending mismatch: have %d, want %d", have, fits)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_rates.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"math"
+	"time"
+
+	"mjoy.io/common/types"
+)
+
+// recipientRate is the decaying arrival rate of transactions to one recipient.
+type recipientRate struct {
+	rate    float64   // Transactions per second as of the last update
+	updated time.Time // Time the rate was last updated at
+}
+
+// recipientRates tracks an exponentially weighted moving average of the rate
+// at which transactions to each recipient enter the pool, revealing contracts
+// suddenly receiving a flood. Only a bounded number of recipients is tracked,
+// the coldest one making room for newcomers.
+//
+// recipientRates is not safe for concurrent use, the pool lock guards it.
+type recipientRates struct {
+	window time.Duration                    // Time constant of the moving average
+	limit  int                              // Maximum number of recipients tracked
+	rates  map[types.Address]*recipientRate // Decaying rates of the tracked recipients
+}
+
+// newRecipientRates creates a tracker averaging over the given window and
+// keeping at most limit recipients. A nil tracker is returned if either is
+// non-positive, which disables tracking.
+func newRecipientRates(window time.Duration, limit int) *recipientRates {
+	if window <= 0 || limit <= 0 {
+		return nil
+	}
+	return &recipientRates{
+		window: window,
+		limit:  limit,
+		rates:  make(map[types.Address]*recipientRate),
+	}
+}
+
+// decayed returns the rate of an entry as of the given time.
+func (rates *recipientRates) decayed(entry *recipientRate, now time.Time) float64 {
+	elapsed := now.Sub(entry.updated)
+	if elapsed <= 0 {
+		return entry.rate
+	}
+	return entry.rate * math.Exp(-float64(elapsed)/float64(rates.window))
+}
+
+// hit records a transaction sent to addr at the given time. It is a no-op on a
+// nil tracker.
+func (rates *recipientRates) hit(addr types.Address, now time.Time) {
+	if rates == nil {
+		return
+	}
+	entry := rates.rates[addr]
+	if entry == nil {
+		if len(rates.rates) >= rates.limit {
+			rates.evict(now)
+		}
+		entry = &recipientRate{updated: now}
+		rates.rates[addr] = entry
+	}
+	entry.rate = rates.decayed(entry, now) + 1/rates.window.Seconds()
+	entry.updated = now
+}
+
+// evict drops the recipient with the lowest current rate.
+func (rates *recipientRates) evict(now time.Time) {
+	var (
+		coldest types.Address
+		lowest  = math.Inf(1)
+	)
+	for addr, entry := range rates.rates {
+		if rate := rates.decayed(entry, now); rate < lowest {
+			coldest, lowest = addr, rate
+		}
+	}
+	delete(rates.rates, coldest)
+}
+
+// rate returns the arrival rate of transactions to addr as of the given time,
+// in transactions per second. Untracked recipients have a zero rate.
+func (rates *recipientRates) rate(addr types.Address, now time.Time) float64 {
+	if rates == nil {
+		return 0
+	}
+	entry := rates.rates[addr]
+	if entry == nil {
+		return 0
+	}
+	return rates.decayed(entry, now)
+}
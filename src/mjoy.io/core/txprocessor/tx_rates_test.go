@@ -0,0 +1,92 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_rates_test.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"mjoy.io/common/types"
+	"mjoy.io/utils/crypto"
+)
+
+// Tests that a burst of transactions to a recipient raises its arrival rate,
+// which then decays once the burst is over.
+func TestRecipientRate(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	pool.currentState.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1000000))
+
+	// All test transactions are sent to the zero address
+	recipient := types.Address{}
+	if rate := pool.RecipientRate(recipient); rate != 0 {
+		t.Fatalf("rate of idle recipient mismatch: have %v, want 0", rate)
+	}
+	for i := uint64(0); i < 10; i++ {
+		if err := pool.AddRemote(newxtransaction(i, 100, key)); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	burst := pool.RecipientRate(recipient)
+	if want := 10 / testTxPoolConfig.RecipientRateWindow.Seconds(); burst < want*0.9 || burst > want {
+		t.Fatalf("rate after burst mismatch: have %v, want about %v", burst, want)
+	}
+	// Look a few windows ahead and ensure the rate faded away
+	pool.mu.RLock()
+	later := pool.recipients.rate(recipient, time.Now().Add(5*testTxPoolConfig.RecipientRateWindow))
+	pool.mu.RUnlock()
+
+	if later >= burst/100 {
+		t.Fatalf("rate didn't decay: have %v, burst %v", later, burst)
+	}
+}
+
+// Tests that the tracker keeps a bounded number of recipients, evicting the
+// coldest one to make room.
+func TestRecipientRateEviction(t *testing.T) {
+	rates := newRecipientRates(time.Minute, 2)
+	now := time.Now()
+
+	hot, warm, cold := types.Address{1}, types.Address{2}, types.Address{3}
+	for i := 0; i < 3; i++ {
+		rates.hit(hot, now)
+	}
+	rates.hit(warm, now)
+	rates.hit(cold, now.Add(time.Second))
+
+	if _, ok := rates.rates[warm]; ok {
+		t.Fatalf("coldest recipient not evicted")
+	}
+	if len(rates.rates) != 2 {
+		t.Fatalf("tracked recipients mismatch: have %d, want 2", len(rates.rates))
+	}
+	if rates.rate(hot, now) <= rates.rate(cold, now.Add(time.Second)) {
+		t.Fatalf("hot recipient rate not above cold one")
+	}
+	// A disabled tracker records nothing
+	if disabled := newRecipientRates(0, 2); disabled != nil {
+		t.Fatalf("zero window didn't disable tracking")
+	}
+}
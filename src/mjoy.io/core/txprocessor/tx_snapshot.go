@@ -0,0 +1,122 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_snapshot.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"sync/atomic"
+
+	"mjoy.io/common/types"
+	"mjoy.io/core/transaction"
+)
+
+// PendingSnapshot is an immutable view of the pool's processable transactions,
+// flattened once and shared between all callers until the next pool reset. It
+// lets block builders query the pending set repeatedly during a build cycle
+// without paying for a fresh flatten on every call.
+//
+// Snapshots are reference counted: every PendingSnapshot call hands out a new
+// reference which should be given back via Release once the caller is done.
+// The returned transaction slices are shared and must not be modified.
+type PendingSnapshot struct {
+	txs   map[types.Address]transaction.Transactions // Processable transactions by account, sorted by nonce
+	refs  int32                                      // Number of live references, including the pool's own
+	stale int32                                      // Set once a pool reset invalidated the snapshot
+}
+
+// newPendingSnapshot flattens the given pending lists into a snapshot holding a
+// single reference for the pool itself.
+func newPendingSnapshot(pending map[types.Address]*txList) *PendingSnapshot {
+	txs := make(map[types.Address]transaction.Transactions, len(pending))
+	for addr, list := range pending {
+		txs[addr] = list.Flatten()
+	}
+	return &PendingSnapshot{txs: txs, refs: 1}
+}
+
+// retain hands out a new reference to the snapshot.
+func (snap *PendingSnapshot) retain() *PendingSnapshot {
+	atomic.AddInt32(&snap.refs, 1)
+	return snap
+}
+
+// invalidate marks the snapshot outdated and drops the pool's reference to it.
+func (snap *PendingSnapshot) invalidate() {
+	atomic.StoreInt32(&snap.stale, 1)
+	snap.Release()
+}
+
+// Release gives back a reference to the snapshot. Once the pool invalidated it
+// and all references are released, its contents are dropped.
+func (snap *PendingSnapshot) Release() {
+	if atomic.AddInt32(&snap.refs, -1) == 0 {
+		snap.txs = nil
+	}
+}
+
+// Stale reports whether the pool was reset since the snapshot was taken, after
+// which it doesn't track the pending set anymore.
+func (snap *PendingSnapshot) Stale() bool {
+	return atomic.LoadInt32(&snap.stale) == 1
+}
+
+// Accounts returns the number of accounts with processable transactions.
+func (snap *PendingSnapshot) Accounts() int {
+	return len(snap.txs)
+}
+
+// Len returns the total number of processable transactions in the snapshot.
+func (snap *PendingSnapshot) Len() int {
+	count := 0
+	for _, txs := range snap.txs {
+		count += len(txs)
+	}
+	return count
+}
+
+// Transactions returns the processable transactions of an account, sorted by
+// nonce. The returned slice is shared and must not be modified.
+func (snap *PendingSnapshot) Transactions(addr types.Address) transaction.Transactions {
+	return snap.txs[addr]
+}
+
+// Transaction returns the processable transaction of an account with the given
+// nonce, or nil if the snapshot holds none.
+func (snap *PendingSnapshot) Transaction(addr types.Address, nonce uint64) *transaction.Transaction {
+	txs := snap.txs[addr]
+	if len(txs) == 0 || nonce < txs[0].Nonce() {
+		return nil
+	}
+	// Pending lists are gapless, so the nonce offset is the index
+	if offset := nonce - txs[0].Nonce(); offset < uint64(len(txs)) {
+		return txs[offset]
+	}
+	return nil
+}
+
+// ForEach calls fn with the processable transactions of every account in the
+// snapshot, stopping early if it returns false.
+func (snap *PendingSnapshot) ForEach(fn func(addr types.Address, txs transaction.Transactions) bool) {
+	for addr, txs := range snap.txs {
+		if !fn(addr, txs) {
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright (c) 2018 The mjoy-go Authors.
+//
+// The mjoy-go is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @File: tx_snapshot_test.go
+// @Date: 2018/05/08 15:18:08
+////////////////////////////////////////////////////////////////////////////////
+
+package txprocessor
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"mjoy.io/common/types"
+	"mjoy.io/utils/crypto"
+)
+
+// Tests that the pending snapshot is shared between callers until the next
+// reset, and that it can be queried by account and nonce.
+func TestPendingSnapshot(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(from, big.NewInt(1000000))
+
+	for i := uint64(0); i < 3; i++ {
+		if err := pool.AddRemote(newxtransaction(i, 100, key)); err != nil {
+			t.Fatalf("transaction %d: failed to add: %v", i, err)
+		}
+	}
+	snap := pool.PendingSnapshot()
+	defer snap.Release()
+
+	if accounts := snap.Accounts(); accounts != 1 {
+		t.Fatalf("snapshot accounts mismatch: have %d, want %d", accounts, 1)
+	}
+	if count := snap.Len(); count != 3 {
+		t.Fatalf("snapshot transaction count mismatch: have %d, want %d", count, 3)
+	}
+	for i := uint64(0); i < 3; i++ {
+		tx := snap.Transaction(from, i)
+		if tx == nil || tx.Nonce() != i {
+			t.Fatalf("nonce %d: snapshot lookup mismatch: have %v", i, tx)
+		}
+	}
+	if tx := snap.Transaction(from, 3); tx != nil {
+		t.Fatalf("snapshot returned transaction beyond pending: %v", tx)
+	}
+	if txs := snap.Transactions(types.Address{}); txs != nil {
+		t.Fatalf("snapshot returned transactions of unknown account: %v", txs)
+	}
+	// Until the pool resets, the same snapshot should be handed out
+	again := pool.PendingSnapshot()
+	if again != snap {
+		t.Fatalf("snapshot not reused before reset")
+	}
+	again.Release()
+
+	// Reset the pool and ensure the snapshot is invalidated but intact
+	pool.lockedReset(nil, nil)
+
+	if !snap.Stale() {
+		t.Fatalf("snapshot not invalidated by reset")
+	}
+	if count := snap.Len(); count != 3 {
+		t.Fatalf("invalidated snapshot lost its contents: have %d transactions, want %d", count, 3)
+	}
+	fresh := pool.PendingSnapshot()
+	defer fresh.Release()
+
+	if fresh == snap || fresh.Stale() {
+		t.Fatalf("fresh snapshot not taken after reset")
+	}
+}
+
+// Benchmarks the cost of a block builder querying the pending set through
+// repeated Pending calls versus a single shared snapshot.
+func BenchmarkPendingRepeated(b *testing.B) { benchmarkPendingQueries(b, false) }
+func BenchmarkPendingSnapshot(b *testing.B) { benchmarkPendingQueries(b, true) }
+
+func benchmarkPendingQueries(b *testing.B, snapshot bool) {
+	pool, _ := setupTxPool()
+	defer pool.Stop()
+
+	// Fill the pool with a handful of accounts and executable transactions
+	keys := make([]*ecdsa.PrivateKey, 16)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(keys[i].PublicKey), big.NewInt(1000000))
+		for j := uint64(0); j < 64; j++ {
+			pool.AddRemote(newxtransaction(j, 100, keys[i]))
+		}
+	}
+	addr := crypto.PubkeyToAddress(keys[0].PublicKey)
+
+	// Benchmark a build cycle worth of lookups into the pending set
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if snapshot {
+			snap := pool.PendingSnapshot()
+			for j := uint64(0); j < 64; j++ {
+				snap.Transaction(addr, j)
+			}
+			snap.Release()
+		} else {
+			for j := uint64(0); j < 64; j++ {
+				pending, _ := pool.Pending()
+				_ = pending[addr][j]
+			}
+		}
+	}
+}